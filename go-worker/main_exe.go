@@ -5,9 +5,20 @@ package main
 /*
 #include <stdio.h>
 #include <stdbool.h>
+#include <stdint.h>
+#include <stdlib.h>
 void echo_cb(const char *json, bool added) {
 	printf("Added: %d, Json: %s\n", added, json);
 }
+void sync_cb(const char *engine) {
+	printf("Synced: %s\n", engine);
+}
+void not_found_cb(const char *container_id) {
+	printf("Not found: %s\n", container_id);
+}
+void log_cb(const char *msg, uint8_t sev) {
+	fprintf(stderr, "[%d] %s\n", sev, msg);
+}
 */
 import "C"
 
@@ -16,6 +27,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"unsafe"
 )
 
 func main() {
@@ -57,7 +69,12 @@ func main() {
 	}
 	fmt.Println("Starting worker")
 	cstr := C.CString(initCfg)
-	ptr := StartWorker((*[0]byte)(C.echo_cb), cstr)
+	var report *C.char
+	ptr := StartWorker((*[0]byte)(C.echo_cb), (*[0]byte)(C.log_cb), (*[0]byte)(C.sync_cb), (*[0]byte)(C.not_found_cb), cstr, &report)
+	if report != nil {
+		fmt.Println("Startup report:", C.GoString(report))
+		C.free(unsafe.Pointer(report))
+	}
 	if ptr == nil {
 		fmt.Println("Failed to start worker; nothing configured?")
 		os.Exit(1)
@@ -69,5 +86,7 @@ func main() {
 	<-done
 
 	fmt.Println("Stopping worker")
-	StopWorker(ptr)
+	if !StopWorker(ptr, 0) {
+		fmt.Println("Timed out stopping worker")
+	}
 }
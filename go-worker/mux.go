@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"github.com/FedeDP/container-worker/pkg/container"
+	"github.com/FedeDP/container-worker/pkg/event"
+	"sync"
+)
+
+// sourceEvent is an event tagged with the engine it comes from.
+type sourceEvent struct {
+	event.Event
+	source container.EngineID
+	// closed is set when the source channel got closed; no event is carried.
+	closed bool
+	// gen allows to discard events from a source that got removed (and maybe added again) in the meantime.
+	gen uint64
+}
+
+type muxSource struct {
+	gen    uint64
+	cancel context.CancelFunc
+}
+
+// multiplexer fans in events from a dynamic set of sources into a single channel.
+// Each source is forwarded by its own goroutine, thus selecting among many sources
+// does not cost more than selecting on a single channel.
+// All methods but events() must be called by the same goroutine that consumes events().
+type multiplexer struct {
+	out     chan sourceEvent
+	sources map[container.EngineID]*muxSource
+	lastGen uint64
+	wg      sync.WaitGroup
+}
+
+func newMultiplexer() *multiplexer {
+	return &multiplexer{
+		out:     make(chan sourceEvent),
+		sources: make(map[container.EngineID]*muxSource),
+	}
+}
+
+// add starts forwarding events from ch, tagged with id.
+// If a source with the same id is already present, it gets replaced.
+func (m *multiplexer) add(id container.EngineID, ch <-chan event.Event) {
+	m.remove(id)
+	ctx, cancel := context.WithCancel(context.Background())
+	m.lastGen++
+	src := &muxSource{gen: m.lastGen, cancel: cancel}
+	m.sources[id] = src
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		for {
+			var sEvt sourceEvent
+			select {
+			case <-ctx.Done():
+				return
+			case evt, ok := <-ch:
+				sEvt = sourceEvent{Event: evt, source: id, closed: !ok, gen: src.gen}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case m.out <- sEvt:
+			}
+			if sEvt.closed {
+				return
+			}
+		}
+	}()
+}
+
+// remove stops forwarding events from the source identified by id.
+func (m *multiplexer) remove(id container.EngineID) {
+	src, ok := m.sources[id]
+	if !ok {
+		return
+	}
+	src.cancel()
+	delete(m.sources, id)
+}
+
+func (m *multiplexer) events() <-chan sourceEvent {
+	return m.out
+}
+
+// isCurrent returns whether sEvt comes from a source that is still registered.
+func (m *multiplexer) isCurrent(sEvt sourceEvent) bool {
+	src, ok := m.sources[sEvt.source]
+	return ok && src.gen == sEvt.gen
+}
+
+// len returns the number of registered sources.
+func (m *multiplexer) len() int {
+	return len(m.sources)
+}
+
+// close removes all sources and waits for their forwarding goroutines to exit.
+func (m *multiplexer) close() {
+	for id := range m.sources {
+		m.remove(id)
+	}
+	m.wg.Wait()
+}
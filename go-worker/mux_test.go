@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/FedeDP/container-worker/pkg/container"
+	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func waitSourceEvent(t *testing.T, mux *multiplexer) sourceEvent {
+	select {
+	case sEvt := <-mux.events():
+		return sEvt
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for multiplexer event")
+	}
+	return sourceEvent{}
+}
+
+func TestMultiplexer(t *testing.T) {
+	dockerID := container.EngineID{Type: "docker", Socket: "/var/run/docker.sock"}
+	podmanID := container.EngineID{Type: "podman", Socket: "/run/podman/podman.sock"}
+
+	mux := newMultiplexer()
+	t.Cleanup(mux.close)
+
+	dockerCh := make(chan event.Event)
+	podmanCh := make(chan event.Event)
+	mux.add(dockerID, dockerCh)
+	mux.add(podmanID, podmanCh)
+	assert.Equal(t, 2, mux.len())
+
+	// Events are tagged with their source
+	go func() { dockerCh <- testEvent("docker_ctr", true) }()
+	sEvt := waitSourceEvent(t, mux)
+	assert.True(t, mux.isCurrent(sEvt))
+	assert.False(t, sEvt.closed)
+	assert.Equal(t, dockerID, sEvt.source)
+	assert.Equal(t, testEvent("docker_ctr", true), sEvt.Event)
+
+	go func() { podmanCh <- testEvent("podman_ctr", false) }()
+	sEvt = waitSourceEvent(t, mux)
+	assert.Equal(t, podmanID, sEvt.source)
+	assert.Equal(t, testEvent("podman_ctr", false), sEvt.Event)
+
+	// Closed channels are detected
+	close(podmanCh)
+	sEvt = waitSourceEvent(t, mux)
+	assert.True(t, sEvt.closed)
+	assert.Equal(t, podmanID, sEvt.source)
+	mux.remove(podmanID)
+	assert.Equal(t, 1, mux.len())
+
+	// Removed sources are not forwarded anymore
+	mux.remove(dockerID)
+	assert.Equal(t, 0, mux.len())
+	select {
+	case dockerCh <- testEvent("docker_ctr", false):
+		t.Fatal("removed source still consumed")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMultiplexerReAdd(t *testing.T) {
+	id := container.EngineID{Type: "docker", Socket: "/var/run/docker.sock"}
+	mux := newMultiplexer()
+	t.Cleanup(mux.close)
+
+	oldCh := make(chan event.Event, 1)
+	mux.add(id, oldCh)
+	oldCh <- testEvent("old", true)
+	sEvt := waitSourceEvent(t, mux)
+
+	// Re-adding the same source makes events from the previous one stale
+	mux.add(id, make(chan event.Event))
+	assert.Equal(t, 1, mux.len())
+	assert.False(t, mux.isCurrent(sEvt))
+}
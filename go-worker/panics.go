@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"github.com/FedeDP/container-worker/pkg/container"
+	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/FedeDP/container-worker/pkg/logger"
+	"github.com/FedeDP/container-worker/pkg/stats"
+	"runtime/debug"
+)
+
+// recoverPanic recovers a panic of a worker goroutine, so that it never crosses into C:
+// the panic is logged and accounted in stats. It must be directly deferred.
+func (w *worker) recoverPanic() {
+	if r := recover(); r != nil {
+		w.log.Errorf("recovered from panic: %v\n%s", r, debug.Stack())
+		w.stats.Panicked()
+	}
+}
+
+// run runs the worker loop until ctx is done.
+// The loop is restarted after a panic, since a single bad event must not stop the worker.
+func (w *worker) run(ctx context.Context) {
+	for !w.runLoop(ctx) {
+	}
+}
+
+// runLoop runs the worker loop, returning false if it panicked.
+func (w *worker) runLoop(ctx context.Context) (done bool) {
+	defer w.recoverPanic()
+	w.loop(ctx)
+	return true
+}
+
+// safeList lists the containers of an engine; if the engine panics, it gets disabled in st.
+func safeList(ctx context.Context, log logger.Logger, st *stats.Registry, id container.EngineID, engine container.Engine) (evts []event.Event, err error) {
+	defer container.Recover(log.WithPrefix(id.String()), st.Engine(id.String()), &err)
+	return engine.List(ctx)
+}
+
+// disableEngine stops for good an engine that panicked.
+// It is kept in stats to report it, and it is not started again
+// until it gets removed from the config and then added back.
+func (w *worker) disableEngine(ctx context.Context, id container.EngineID) {
+	w.log.Errorf("%s: engine disabled after a panic", id)
+	w.disabled[id] = struct{}{}
+	w.cancelStart(id)
+	w.removeListener(id)
+	w.inotifier.Forget(id)
+	w.tracked.forget(id)
+	w.updateFetcher(ctx)
+}
+
+// disablePanicked disables the engines that got marked as disabled in stats after a panic.
+func (w *worker) disablePanicked(ctx context.Context) {
+	for id := range w.generators {
+		if _, ok := w.disabled[id]; ok {
+			continue
+		}
+		if w.stats.Engine(id.String()).State() == stats.StateDisabled {
+			w.disableEngine(ctx, id)
+		}
+	}
+}
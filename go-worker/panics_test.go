@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"github.com/FedeDP/container-worker/pkg/config"
+	"github.com/FedeDP/container-worker/pkg/container"
+	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/FedeDP/container-worker/pkg/stats"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// panicEngine panics while listing or, once listening, in its Listen goroutine.
+type panicEngine struct {
+	fakeEngine
+	panicList bool
+	stats     *stats.Engine
+}
+
+func (p *panicEngine) List(_ context.Context) ([]event.Event, error) {
+	if p.panicList {
+		var ctrs []event.Event
+		return ctrs[:1], nil
+	}
+	return nil, nil
+}
+
+func (p *panicEngine) Listen(ctx context.Context, wg *sync.WaitGroup) (<-chan event.Event, error) {
+	outCh := make(chan event.Event)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(outCh)
+		// Like real engines
+		defer container.Recover(nil, p.stats, nil)
+		var labels map[string]string
+		labels["malformed"] = "response"
+	}()
+	return outCh, nil
+}
+
+func fakeEngineID(t *testing.T, name string) container.EngineID {
+	socket := filepath.Join(t.TempDir(), name+".sock")
+	listenSocket(t, socket)
+	return container.EngineID{Type: "docker", Socket: socket}
+}
+
+func TestEnginePanicWhileListing(t *testing.T) {
+	w, ctx := newTestWorker(t, func(string, bool) {}, nil)
+	badID := fakeEngineID(t, "bad")
+	goodID := fakeEngineID(t, "good")
+
+	bad := &panicEngine{panicList: true}
+	w.startEngine(ctx, badID, func(_ context.Context) (container.Engine, error) {
+		return bad, nil
+	})
+	w.onEngineStarted(ctx, waitEngineStart(t, w))
+	w.startEngine(ctx, goodID, func(_ context.Context) (container.Engine, error) {
+		return &fakeEngine{evts: []event.Event{testEvent("ctr", true)}}, nil
+	})
+	w.onEngineStarted(ctx, waitEngineStart(t, w))
+
+	// Only the panicking engine is disabled
+	assert.True(t, bad.closed.Load())
+	assert.NotContains(t, w.listeners, badID)
+	assert.Contains(t, w.listeners, goodID)
+	assert.Contains(t, w.disabled, badID)
+	snapshot := w.stats.Snapshot()
+	assert.Equal(t, "disabled", snapshot.Engines[badID.String()].State)
+	assert.Equal(t, uint64(1), snapshot.Engines[badID.String()].Panics)
+	assert.Equal(t, uint64(1), snapshot.Engines[goodID.String()].Creates)
+}
+
+func TestEnginePanicWhileListening(t *testing.T) {
+	p, w, ctx, _ := newTestPluginCtx(t)
+	id := fakeEngineID(t, "bad")
+	bad := &panicEngine{stats: w.stats.Engine(id.String())}
+	generator := func(_ context.Context) (container.Engine, error) {
+		return bad, nil
+	}
+	w.generators[id] = generator
+	w.startEngine(ctx, id, generator)
+	p.run(ctx, w)
+
+	// Disabled engine is stopped for good
+	assert.Eventually(t, bad.closed.Load, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, stats.StateDisabled, w.stats.Engine(id.String()).State())
+	assert.True(t, p.stop(5*time.Second))
+}
+
+func TestLoopRecoversPanic(t *testing.T) {
+	p := &PluginCtx{}
+	var ctx context.Context
+	ctx, p.ctxCancel = context.WithCancel(context.Background())
+	t.Cleanup(p.ctxCancel)
+
+	var calls atomic.Int64
+	cb := func(string, bool) {
+		if calls.Add(1) == 1 {
+			panic("callback failed")
+		}
+	}
+	w := newWorker(cb, nil, nil, nil, config.New(nil), &p.wg)
+	engine := &floodEngine{prefix: "ctr"}
+	startFakeEngine(t, w, ctx, "flood", func(_ context.Context) (container.Engine, error) {
+		return engine, nil
+	})
+	p.run(ctx, w)
+
+	// Events keep flowing after the loop panicked
+	assert.Eventually(t, func() bool {
+		return calls.Load() > 100
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint64(1), w.stats.Snapshot().Panics)
+	assert.True(t, p.stop(5*time.Second))
+}
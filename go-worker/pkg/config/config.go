@@ -2,13 +2,78 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/FedeDP/container-worker/pkg/logger"
+	"maps"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
-const defaultLabelMaxLen = 100
+const (
+	defaultLabelMaxLen    = 100
+	defaultConnectTimeout = 10 * time.Second
+	defaultRequestTimeout = 5 * time.Second
+	defaultListTimeout    = 60 * time.Second
+	defaultFetcherQueue   = 1024
+)
+
+// Delays between the attempts to look up a container unknown to all engines, by default
+var defaultFetcherRetries = []int{100, 500, 2000, 5000}
+
+// OverflowPolicy tells which request is dropped when the fetcher queue is full.
+type OverflowPolicy string
+
+const (
+	// DropOldest drops the oldest queued request, to make room for the new one
+	DropOldest OverflowPolicy = "drop_oldest"
+	// DropNewest drops the new request
+	DropNewest OverflowPolicy = "drop_newest"
+)
 
 type SocketsEngine struct {
-	Enabled bool     `json:"enabled"`
-	Sockets []string `json:"sockets"`
+	Enabled          bool     `json:"enabled"`
+	Sockets          []string `json:"sockets"`
+	ConnectTimeoutMs int      `json:"connect_timeout_ms"`
+	RequestTimeoutMs int      `json:"request_timeout_ms"`
+	ListTimeoutMs    int      `json:"list_timeout_ms"`
+	TLS              *TLSCfg  `json:"tls"`
+	// Containerd namespaces watched on each socket, or on all of them if keyed by "*"
+	Namespaces map[string]NamespacesCfg `json:"namespaces"`
+}
+
+// TLSCfg configures the TLS client used to connect to the tcp:// sockets of an engine.
+// Paths are relative to the host root, like sockets.
+type TLSCfg struct {
+	// CA bundle verifying the engine certificate; system roots if empty
+	CAFile string `json:"ca_file"`
+	// Client certificate and key, for mutual TLS; both or none must be set
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Name verified against the engine certificate; the socket host if empty
+	ServerName string `json:"server_name"`
+}
+
+// Timeouts bound the calls made to an engine.
+type Timeouts struct {
+	// Connect bounds the connection to the engine
+	Connect time.Duration
+	// Request bounds each single API call, eg: a container inspect
+	Request time.Duration
+	// List bounds a whole listing, including the inspect of each container
+	List time.Duration
+}
+
+// FetcherCfg configures the queue of requests of the fetcher engine.
+type FetcherCfg struct {
+	QueueSize      int            `json:"queue_size"`
+	OverflowPolicy OverflowPolicy `json:"overflow_policy"`
+	// Delays in ms before looking up again a container not found; empty to disable retries
+	RetryScheduleMs []int `json:"retry_schedule_ms"`
 }
 
 type EngineCfg struct {
@@ -16,36 +81,313 @@ type EngineCfg struct {
 	LabelMaxLen    int                      `json:"label_max_len"`
 	WithSize       bool                     `json:"with_size"`
 	HostRoot       string                   `json:"host_root"`
+	ResyncInterval int                      `json:"resync_interval"`
+	Fetcher        FetcherCfg               `json:"fetcher"`
+	Labels         LabelsCfg                `json:"labels"`
+	Env            EnvCfg                   `json:"env"`
+	Filters        FiltersCfg               `json:"filters"`
+	// Compiled from LabelMaxLen and Labels by Load
+	labelPolicy *LabelPolicy
+	// Compiled from Env by Load
+	envPolicy *EnvPolicy
+	// Compiled from Filters by Load
+	filterPolicy *FilterPolicy
+	// Compiled from containerd Namespaces by Load, keyed by socket
+	namespacePolicies map[string]*NamespacePolicy
+}
+
+// Config holds the configuration of a worker.
+// The configuration is swapped atomically, since it can be reloaded while engines are reading it.
+type Config struct {
+	c   atomic.Pointer[EngineCfg]
+	log logger.Logger
+}
+
+// New returns a Config with default values; log reports configuration loading outcome.
+func New(log logger.Logger) *Config {
+	cfg := Config{log: log}
+	c := newDefault()
+	// Defaults are always valid
+	_ = compilePolicies(c)
+	cfg.c.Store(c)
+	return &cfg
+}
+
+func newDefault() *EngineCfg {
+	return &EngineCfg{
+		LabelMaxLen: defaultLabelMaxLen,
+		WithSize:    false,
+		Fetcher: FetcherCfg{
+			QueueSize:      defaultFetcherQueue,
+			OverflowPolicy: DropOldest,
+			// Cloned, since json.Unmarshal reuses the backing array
+			RetryScheduleMs: slices.Clone(defaultFetcherRetries),
+		},
+		Labels: LabelsCfg{
+			TruncateMarker: defaultTruncateMarker,
+		},
+		Env: EnvCfg{
+			RedactMode: RedactMask,
+		},
+	}
+}
+
+// compilePolicies compiles the policies of c, returning the errors of invalid patterns.
+func compilePolicies(c *EngineCfg) Errors {
+	var errs, policyErrs Errors
+	c.labelPolicy, policyErrs = newLabelPolicy(c)
+	errs = append(errs, policyErrs...)
+	c.envPolicy, policyErrs = newEnvPolicy(c)
+	errs = append(errs, policyErrs...)
+	c.filterPolicy, policyErrs = newFilterPolicy(c)
+	errs = append(errs, policyErrs...)
+	c.namespacePolicies, policyErrs = newNamespacePolicies(c)
+	return append(errs, policyErrs...)
+}
+
+// Error describes an invalid configuration.
+type Error struct {
+	// Key is the dotted path of the invalid key, eg: "engines.docker.enabled"; empty if unknown.
+	Key string
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Key == "" {
+		return e.Err.Error()
+	}
+	return e.Key + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
 }
 
-var c EngineCfg
+// Errors lists all the problems found in a configuration.
+type Errors []*Error
 
-// Init sets cfg default values
-func init() {
-	c.LabelMaxLen = defaultLabelMaxLen
-	c.WithSize = false
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
 }
 
-func Load(initCfg string) error {
-	err := json.Unmarshal([]byte(initCfg), &c)
+func (e Errors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Load parses initCfg, validates it against Schema and replaces the current configuration with it.
+// Missing keys get their default value, while unknown keys are rejected.
+// On failure, the current configuration is kept and Errors, listing all the invalid keys, is returned.
+func (cfg *Config) Load(initCfg string) error {
+	errs := validate(initCfg)
+	c := newDefault()
+	if len(errs) == 0 {
+		if err := json.Unmarshal([]byte(initCfg), c); err != nil {
+			cfgErr := &Error{Err: err}
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				cfgErr.Key = typeErr.Field
+			}
+			errs = Errors{cfgErr}
+		} else {
+			errs = compilePolicies(c)
+		}
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			cfg.log.Errorf("failed to parse config: %v", err)
+		}
+		return errs
+	}
+	cfg.c.Store(c)
+	for name, eCfg := range c.SocketsEngines {
+		if eCfg.Enabled {
+			cfg.log.Debugf("engine %s enabled on sockets %v", name, eCfg.Sockets)
+		}
+	}
+	return nil
+}
+
+// validate checks initCfg against Schema, and the semantics that cannot be expressed by it.
+func validate(initCfg string) Errors {
+	dec := json.NewDecoder(strings.NewReader(initCfg))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return Errors{{Err: err}}
+	}
+	if dec.More() {
+		return Errors{{Err: errors.New("unexpected data after the config object")}}
+	}
+	errs := rootSchema.validate(v, "")
+	if len(errs) > 0 {
+		return errs
+	}
+	engines, _ := v.(map[string]any)["engines"].(map[string]any)
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		engine, _ := engines[name].(map[string]any)
+		sockets, _ := engine["sockets"].([]any)
+		for i, socket := range sockets {
+			if err := validateSocket(socket.(string)); err != nil {
+				errs = append(errs, &Error{Key: fmt.Sprintf("engines.%s.sockets[%d]", name, i), Err: err})
+			}
+		}
+		if namespaces, ok := engine["namespaces"].(map[string]any); ok {
+			errs = append(errs, validateNamespaces(name, namespaces, sockets)...)
+		}
+		if tls, ok := engine["tls"].(map[string]any); ok {
+			if name != "docker" {
+				// Podman bindings build their own transport, that cannot be given a TLS config
+				errs = append(errs, &Error{Key: fmt.Sprintf("engines.%s.tls", name), Err: errors.New("only supported by docker")})
+				continue
+			}
+			_, hasCert := tls["cert_file"]
+			_, hasKey := tls["key_file"]
+			if hasCert != hasKey {
+				errs = append(errs, &Error{Key: fmt.Sprintf("engines.%s.tls", name), Err: errors.New("cert_file and key_file must be set together")})
+			}
+		}
+	}
+	return errs
+}
+
+// validateNamespaces checks that namespaces are only configured for containerd, and keyed by its sockets or "*".
+func validateNamespaces(engine string, namespaces map[string]any, sockets []any) Errors {
+	key := fmt.Sprintf("engines.%s.namespaces", engine)
+	if engine != "containerd" {
+		return Errors{{Key: key, Err: errors.New("only supported by containerd")}}
+	}
+	var errs Errors
+	for _, socket := range slices.Sorted(maps.Keys(namespaces)) {
+		if socket != allSockets && !slices.Contains(sockets, any(socket)) {
+			errs = append(errs, &Error{Key: key + "." + socket, Err: errors.New("not a configured socket")})
+		}
+	}
+	return errs
+}
+
+// validateSocket checks that socket is an absolute path or an unix, tcp or npipe URL.
+func validateSocket(socket string) error {
+	if filepath.IsAbs(socket) {
+		return nil
+	}
+	u, err := url.Parse(socket)
 	if err != nil {
 		return err
 	}
+	switch u.Scheme {
+	case "unix", "npipe":
+		// eg: unix://run/docker.sock, whose host is "run"
+		if u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+			return fmt.Errorf("%q has no absolute path", socket)
+		}
+	case "tcp":
+		if u.Hostname() == "" || u.Port() == "" {
+			return fmt.Errorf("%q has no host:port", socket)
+		}
+	case "":
+		return fmt.Errorf("%q is not an absolute path", socket)
+	default:
+		return fmt.Errorf("%q has unsupported scheme %q, expected one of unix, tcp, npipe", socket, u.Scheme)
+	}
 	return nil
 }
 
-func Get() EngineCfg {
-	return c
+func (cfg *Config) Get() EngineCfg {
+	return *cfg.c.Load()
 }
 
-func GetLabelMaxLen() int {
-	return c.LabelMaxLen
+func (cfg *Config) GetLabelMaxLen() int {
+	return cfg.c.Load().LabelMaxLen
 }
 
-func GetWithSize() bool {
-	return c.WithSize
+// GetLabelPolicy returns the policy filtering and bounding the labels reported by engines.
+func (cfg *Config) GetLabelPolicy() *LabelPolicy {
+	return cfg.c.Load().labelPolicy
 }
 
-func GetHostRoot() string {
-	return c.HostRoot
+// GetEnvPolicy returns the policy filtering and redacting the env of containers.
+func (cfg *Config) GetEnvPolicy() *EnvPolicy {
+	return cfg.c.Load().envPolicy
+}
+
+// GetFilterPolicy returns the policy selecting which containers are announced.
+func (cfg *Config) GetFilterPolicy() *FilterPolicy {
+	return cfg.c.Load().filterPolicy
+}
+
+func (cfg *Config) GetWithSize() bool {
+	return cfg.c.Load().WithSize
+}
+
+func (cfg *Config) GetHostRoot() string {
+	return cfg.c.Load().HostRoot
+}
+
+// GetResyncInterval returns the interval between periodic resyncs of engines state; 0 means disabled.
+func (cfg *Config) GetResyncInterval() time.Duration {
+	return time.Duration(cfg.c.Load().ResyncInterval) * time.Second
+}
+
+func msOrDefault(ms int, def time.Duration) time.Duration {
+	if ms <= 0 {
+		return def
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// GetTimeouts returns the timeouts of the given engine; unset values get their default.
+func (cfg *Config) GetTimeouts(engine string) Timeouts {
+	eCfg := cfg.c.Load().SocketsEngines[engine]
+	return Timeouts{
+		Connect: msOrDefault(eCfg.ConnectTimeoutMs, defaultConnectTimeout),
+		Request: msOrDefault(eCfg.RequestTimeoutMs, defaultRequestTimeout),
+		List:    msOrDefault(eCfg.ListTimeoutMs, defaultListTimeout),
+	}
+}
+
+// GetNamespacePolicy returns the policy of the containerd namespaces watched on socket,
+// as configured in engines.containerd.namespaces; nil if all namespaces are watched.
+func (cfg *Config) GetNamespacePolicy(socket string) *NamespacePolicy {
+	policies := cfg.c.Load().namespacePolicies
+	if p, ok := policies[socket]; ok {
+		return p
+	}
+	return policies[allSockets]
+}
+
+// GetTLS returns the TLS config of the given engine, or nil if not set.
+func (cfg *Config) GetTLS(engine string) *TLSCfg {
+	return cfg.c.Load().SocketsEngines[engine].TLS
+}
+
+// GetFetcherQueue returns the max number of queued fetcher requests and what to do when it is reached.
+func (cfg *Config) GetFetcherQueue() (int, OverflowPolicy) {
+	c := cfg.c.Load()
+	if c.Fetcher.QueueSize <= 0 {
+		return defaultFetcherQueue, c.Fetcher.OverflowPolicy
+	}
+	return c.Fetcher.QueueSize, c.Fetcher.OverflowPolicy
+}
+
+// GetFetcherRetries returns the delays between the attempts to look up a container not found by any engine.
+func (cfg *Config) GetFetcherRetries() []time.Duration {
+	retries := cfg.c.Load().Fetcher.RetryScheduleMs
+	delays := make([]time.Duration, len(retries))
+	for i, ms := range retries {
+		delays[i] = time.Duration(ms) * time.Millisecond
+	}
+	return delays
 }
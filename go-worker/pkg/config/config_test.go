@@ -0,0 +1,93 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadValid(t *testing.T) {
+	cfg := New(nil)
+	err := cfg.Load(`{
+		"label_max_len": 0,
+		"host_root": "/host",
+		"fetcher": {"overflow_policy": "drop_newest", "retry_schedule_ms": [0, 10]},
+		"engines": {
+			"docker": {"enabled": true, "sockets": ["/var/run/docker.sock", "unix:///run/docker.sock", "tcp://10.0.0.1:2376"]},
+			"podman": {"enabled": true, "sockets": ["npipe:////./pipe/podman"], "request_timeout_ms": 100},
+			"static": {"enabled": false, "container_id": "id", "container_name": "name", "container_image": "image"}
+		}
+	}`)
+	require.NoError(t, err)
+	assert.Equal(t, "/host", cfg.GetHostRoot())
+	assert.Zero(t, cfg.GetLabelMaxLen())
+	assert.Equal(t, []time.Duration{0, 10 * time.Millisecond}, cfg.GetFetcherRetries())
+	assert.Equal(t, 100*time.Millisecond, cfg.GetTimeouts("podman").Request)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tCases := map[string]struct {
+		cfg          string
+		expectedKeys []string
+	}{
+		"Syntax error": {
+			cfg:          `{"engines":`,
+			expectedKeys: []string{""},
+		},
+		"Not an object": {
+			cfg:          `[]`,
+			expectedKeys: []string{""},
+		},
+		"Unknown keys": {
+			cfg:          `{"labels_max_len": 10, "engines": {"dockerd": {}, "docker": {"socket": ["/run/docker.sock"]}}}`,
+			expectedKeys: []string{"engines.docker.socket", "engines.dockerd", "labels_max_len"},
+		},
+		"Wrong types": {
+			cfg:          `{"with_size": "yes", "engines": {"cri": {"enabled": 1, "sockets": "/run/cri.sock"}}}`,
+			expectedKeys: []string{"engines.cri.enabled", "engines.cri.sockets", "with_size"},
+		},
+		"Out of range": {
+			cfg:          `{"label_max_len": -1, "resync_interval": 1.5, "fetcher": {"queue_size": 0, "retry_schedule_ms": [10, -1]}}`,
+			expectedKeys: []string{"fetcher.queue_size", "fetcher.retry_schedule_ms[1]", "label_max_len", "resync_interval"},
+		},
+		"Unknown enum value": {
+			cfg:          `{"fetcher": {"overflow_policy": "drop_all"}}`,
+			expectedKeys: []string{"fetcher.overflow_policy"},
+		},
+		"Invalid sockets": {
+			cfg: `{"engines": {"docker": {"sockets": ["run/docker.sock", "unix://run/docker.sock", "tcp://10.0.0.1", "http://10.0.0.1:80"]}}}`,
+			expectedKeys: []string{"engines.docker.sockets[0]", "engines.docker.sockets[1]",
+				"engines.docker.sockets[2]", "engines.docker.sockets[3]"},
+		},
+		"TLS": {
+			cfg:          `{"engines": {"docker": {"tls": {"cert_file": "/cert.pem"}}, "podman": {"tls": {"ca_file": "/ca.pem"}}}}`,
+			expectedKeys: []string{"engines.docker.tls", "engines.podman.tls"},
+		},
+	}
+
+	for name, tc := range tCases {
+		t.Run(name, func(t *testing.T) {
+			cfg := New(nil)
+			err := cfg.Load(tc.cfg)
+			var errs Errors
+			require.ErrorAs(t, err, &errs)
+			keys := make([]string, len(errs))
+			for i, e := range errs {
+				keys[i] = e.Key
+			}
+			assert.Equal(t, tc.expectedKeys, keys)
+			// The current configuration is kept
+			assert.Equal(t, defaultLabelMaxLen, cfg.GetLabelMaxLen())
+		})
+	}
+}
+
+func TestSchemaHeaderUpToDate(t *testing.T) {
+	header, err := os.ReadFile("../../../src/plugin_config_schema.h")
+	require.NoError(t, err)
+	assert.True(t, strings.Contains(string(header), strings.TrimRight(string(Schema), "\n")),
+		"src/plugin_config_schema.h is stale: run `go generate ./pkg/config`")
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// RedactMode tells how the values of redacted env variables are replaced.
+type RedactMode string
+
+const (
+	// RedactMask replaces values with redactedValue
+	RedactMask RedactMode = "mask"
+	// RedactHash replaces values with their sha256, so that they can still be compared
+	RedactHash RedactMode = "hash"
+
+	redactedValue = "<redacted>"
+)
+
+// EnvCfg configures which container env variables are reported, and which values are redacted.
+// Patterns match variable names, like label patterns, but globs ignore case.
+type EnvCfg struct {
+	// Do not report env at all
+	Drop bool `json:"drop"`
+	// Variables to be reported; all if empty
+	Allow []string `json:"allow"`
+	// Variables whose value is redacted
+	Redact     []string   `json:"redact"`
+	RedactMode RedactMode `json:"redact_mode"`
+	// Max number of reported variables; 0 means unlimited
+	MaxEntries int `json:"max_entries"`
+}
+
+// EnvPolicy filters and redacts the env of containers, as configured by EnvCfg.
+type EnvPolicy struct {
+	drop       bool
+	allow      []*regexp.Regexp
+	redact     []*regexp.Regexp
+	mode       RedactMode
+	maxEntries int
+}
+
+func newEnvPolicy(c *EngineCfg) (*EnvPolicy, Errors) {
+	p := &EnvPolicy{
+		drop:       c.Env.Drop,
+		mode:       c.Env.RedactMode,
+		maxEntries: c.Env.MaxEntries,
+	}
+	var errs, patternErrs Errors
+	p.allow, patternErrs = compilePatterns(c.Env.Allow, "env.allow", true)
+	errs = append(errs, patternErrs...)
+	p.redact, patternErrs = compilePatterns(c.Env.Redact, "env.redact", true)
+	errs = append(errs, patternErrs...)
+	return p, errs
+}
+
+// FilterEnv returns the reported env, made of "NAME=value" entries; env is left untouched.
+func (p *EnvPolicy) FilterEnv(env []string) []string {
+	if p.drop {
+		return []string{}
+	}
+	if len(p.allow) == 0 && len(p.redact) == 0 && (p.maxEntries == 0 || len(env) <= p.maxEntries) {
+		return env
+	}
+	filtered := make([]string, 0, len(env))
+	for _, entry := range env {
+		if p.maxEntries > 0 && len(filtered) == p.maxEntries {
+			break
+		}
+		name, value, _ := strings.Cut(entry, "=")
+		if len(p.allow) > 0 && !matchesAny(p.allow, name) {
+			continue
+		}
+		if matchesAny(p.redact, name) {
+			entry = name + "=" + p.redactValue(value)
+		}
+		filtered = append(filtered, entry)
+	}
+	return filtered
+}
+
+func (p *EnvPolicy) redactValue(value string) string {
+	if p.mode == RedactHash {
+		sum := sha256.Sum256([]byte(value))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+	return redactedValue
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestEnvPolicy(t *testing.T) {
+	env := []string{
+		"PATH=/usr/bin:/bin",
+		"DB_PASSWORD=hunter2",
+		"GITHUB_TOKEN=ghp_abc",
+		"api_token_file=/run/secrets/token",
+		"HOME=/root",
+		"EMPTY",
+	}
+	tCases := map[string]struct {
+		cfg         string
+		expectedEnv []string
+	}{
+		"Default": {
+			cfg:         `{}`,
+			expectedEnv: env,
+		},
+		"Drop": {
+			cfg:         `{"env": {"drop": true, "allow": ["PATH"]}}`,
+			expectedEnv: []string{},
+		},
+		"Redact mask ignoring case": {
+			cfg: `{"env": {"redact": ["*_PASSWORD", "*TOKEN*"]}}`,
+			expectedEnv: []string{
+				"PATH=/usr/bin:/bin",
+				"DB_PASSWORD=<redacted>",
+				"GITHUB_TOKEN=<redacted>",
+				"api_token_file=<redacted>",
+				"HOME=/root",
+				"EMPTY",
+			},
+		},
+		"Redact hash": {
+			cfg: `{"env": {"redact": ["re:DB_.*"], "redact_mode": "hash", "allow": ["DB_*"]}}`,
+			expectedEnv: []string{
+				// sha256 of "hunter2"
+				"DB_PASSWORD=sha256:f52fbd32b2b3b86ff88ef6c490628285f482af15ddcb29541f94bcf526a3f6c7",
+			},
+		},
+		"Allowlist": {
+			cfg:         `{"env": {"allow": ["PATH", "HOME"]}}`,
+			expectedEnv: []string{"PATH=/usr/bin:/bin", "HOME=/root"},
+		},
+		"Max entries": {
+			cfg:         `{"env": {"max_entries": 2, "redact": ["*PASSWORD"]}}`,
+			expectedEnv: []string{"PATH=/usr/bin:/bin", "DB_PASSWORD=<redacted>"},
+		},
+	}
+
+	for name, tc := range tCases {
+		t.Run(name, func(t *testing.T) {
+			cfg := New(nil)
+			require.NoError(t, cfg.Load(tc.cfg))
+			orig := append([]string(nil), env...)
+			assert.Equal(t, tc.expectedEnv, cfg.GetEnvPolicy().FilterEnv(env))
+			// Never modified in place
+			assert.Equal(t, orig, env)
+		})
+	}
+}
+
+func TestEnvPolicyInvalid(t *testing.T) {
+	err := New(nil).Load(`{"env": {"redact": ["re:["], "redact_mode": "rot13"}}`)
+	var errs Errors
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 1)
+	// Schema errors are reported before compiling patterns
+	assert.Equal(t, "env.redact_mode", errs[0].Key)
+
+	err = New(nil).Load(`{"env": {"redact": ["re:["]}}`)
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 1)
+	assert.Equal(t, "env.redact[0]", errs[0].Key)
+}
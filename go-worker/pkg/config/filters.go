@@ -0,0 +1,197 @@
+package config
+
+import (
+	"fmt"
+	"github.com/FedeDP/container-worker/pkg/event"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Label holding the kubernetes namespace of a container
+const k8sNamespaceLabel = "io.kubernetes.pod.namespace"
+
+// FiltersCfg selects which containers are announced by engines.
+// A container is announced if it matches any Include rule, or Include is empty,
+// and it does not match any Exclude rule.
+type FiltersCfg struct {
+	Include []FilterRule `json:"include"`
+	Exclude []FilterRule `json:"exclude"`
+}
+
+// FilterRule matches a container if all of its set fields match.
+type FilterRule struct {
+	// Engines of the container, eg: "docker" or "cri"
+	Engines []string `json:"engines"`
+	// Containerd namespaces of the container, eg: "k8s.io"
+	ContainerdNamespaces []string `json:"containerd_namespaces"`
+	// Kubernetes namespaces of the container, from the io.kubernetes.pod.namespace label
+	K8sNamespaces []string `json:"k8s_namespaces"`
+	// Image repositories of the container, as patterns like labels ones
+	ImageRepos []string `json:"image_repos"`
+	// Label selector, eg: "app=nginx,tier!=db,owner,!ci"
+	Labels string `json:"labels"`
+	// Whether the container is a pod sandbox
+	PodSandbox *bool `json:"pod_sandbox"`
+}
+
+// selectorOp is the operator of a label selector requirement.
+type selectorOp int
+
+const (
+	opEquals selectorOp = iota
+	opNotEquals
+	opExists
+	opNotExists
+)
+
+// requirement is a single comma separated term of a label selector.
+type requirement struct {
+	key   string
+	op    selectorOp
+	value string
+}
+
+func (r requirement) matches(labels map[string]string) bool {
+	val, ok := labels[r.key]
+	switch r.op {
+	case opEquals:
+		return ok && val == r.value
+	case opNotEquals:
+		return !ok || val != r.value
+	case opExists:
+		return ok
+	default:
+		return !ok
+	}
+}
+
+// parseSelector parses a label selector made of comma separated
+// "key=value", "key==value", "key!=value", "key" and "!key" requirements.
+func parseSelector(selector string) ([]requirement, error) {
+	var reqs []requirement
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		var req requirement
+		if key, value, ok := strings.Cut(term, "!="); ok {
+			req = requirement{key: key, op: opNotEquals, value: value}
+		} else if key, value, ok := strings.Cut(term, "=="); ok {
+			req = requirement{key: key, op: opEquals, value: value}
+		} else if key, value, ok := strings.Cut(term, "="); ok {
+			req = requirement{key: key, op: opEquals, value: value}
+		} else if key, ok := strings.CutPrefix(term, "!"); ok {
+			req = requirement{key: key, op: opNotExists}
+		} else {
+			req = requirement{key: term, op: opExists}
+		}
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+		if req.key == "" {
+			return nil, fmt.Errorf("requirement %q has no key", term)
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// filterRule is a compiled FilterRule.
+type filterRule struct {
+	engines              []string
+	containerdNamespaces []string
+	k8sNamespaces        []string
+	imageRepos           []*regexp.Regexp
+	labels               []requirement
+	podSandbox           *bool
+}
+
+func newFilterRule(r FilterRule, key string) (filterRule, Errors) {
+	rule := filterRule{
+		engines:              r.Engines,
+		containerdNamespaces: r.ContainerdNamespaces,
+		k8sNamespaces:        r.K8sNamespaces,
+		podSandbox:           r.PodSandbox,
+	}
+	var errs Errors
+	rule.imageRepos, errs = compilePatterns(r.ImageRepos, key+".image_repos", false)
+	if r.Labels != "" {
+		var err error
+		if rule.labels, err = parseSelector(r.Labels); err != nil {
+			errs = append(errs, &Error{Key: key + ".labels", Err: err})
+		}
+	}
+	return rule, errs
+}
+
+// imageRepo returns the image repository of ctr, stripping tag and digest from its image if not known.
+func imageRepo(ctr *event.Container) string {
+	if ctr.ImageRepo != "" {
+		return ctr.ImageRepo
+	}
+	repo, _, _ := strings.Cut(ctr.Image, "@")
+	// A colon after the last slash separates the tag, otherwise the registry port
+	if idx := strings.LastIndex(repo, ":"); idx > strings.LastIndex(repo, "/") {
+		repo = repo[:idx]
+	}
+	return repo
+}
+
+func (r filterRule) matches(engine string, ctr *event.Container) bool {
+	if len(r.engines) > 0 && !slices.Contains(r.engines, engine) {
+		return false
+	}
+	if len(r.containerdNamespaces) > 0 && !slices.Contains(r.containerdNamespaces, ctr.Namespace) {
+		return false
+	}
+	if len(r.k8sNamespaces) > 0 && !slices.Contains(r.k8sNamespaces, ctr.Labels[k8sNamespaceLabel]) {
+		return false
+	}
+	if len(r.imageRepos) > 0 && !matchesAny(r.imageRepos, imageRepo(ctr)) {
+		return false
+	}
+	for _, req := range r.labels {
+		if !req.matches(ctr.Labels) {
+			return false
+		}
+	}
+	return r.podSandbox == nil || *r.podSandbox == ctr.IsPodSandbox
+}
+
+// FilterPolicy decides which containers are announced, as configured by FiltersCfg.
+type FilterPolicy struct {
+	include []filterRule
+	exclude []filterRule
+}
+
+func compileRules(rules []FilterRule, key string) ([]filterRule, Errors) {
+	var (
+		compiled []filterRule
+		errs     Errors
+	)
+	for i, r := range rules {
+		rule, ruleErrs := newFilterRule(r, fmt.Sprintf("%s[%d]", key, i))
+		errs = append(errs, ruleErrs...)
+		compiled = append(compiled, rule)
+	}
+	return compiled, errs
+}
+
+func newFilterPolicy(c *EngineCfg) (*FilterPolicy, Errors) {
+	p := &FilterPolicy{}
+	var errs, ruleErrs Errors
+	p.include, ruleErrs = compileRules(c.Filters.Include, "filters.include")
+	errs = append(errs, ruleErrs...)
+	p.exclude, ruleErrs = compileRules(c.Filters.Exclude, "filters.exclude")
+	errs = append(errs, ruleErrs...)
+	return p, errs
+}
+
+// Announces tells whether ctr, from the given engine type, is announced.
+func (p *FilterPolicy) Announces(engine string, ctr *event.Container) bool {
+	matches := func(r filterRule) bool {
+		return r.matches(engine, ctr)
+	}
+	if len(p.include) > 0 && !slices.ContainsFunc(p.include, matches) {
+		return false
+	}
+	return !slices.ContainsFunc(p.exclude, matches)
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestFilterPolicy(t *testing.T) {
+	nginx := &event.Container{
+		Image: "docker.io/library/nginx:1.27",
+		Labels: map[string]string{
+			"app":                         "nginx",
+			"tier":                        "frontend",
+			"io.kubernetes.pod.namespace": "default",
+		},
+		Namespace: "k8s.io",
+	}
+	pause := &event.Container{
+		Image:        "registry.k8s.io/pause:3.9",
+		ImageRepo:    "registry.k8s.io/pause",
+		IsPodSandbox: true,
+		Namespace:    "k8s.io",
+	}
+	build := &event.Container{
+		Image:  "localhost:5000/ci/builder@sha256:0ca0fed353fb",
+		Labels: map[string]string{"ci": "true"},
+	}
+	type announced struct {
+		engine string
+		ctr    *event.Container
+		ok     bool
+	}
+	tCases := map[string]struct {
+		cfg      string
+		expected []announced
+	}{
+		"Default": {
+			cfg: `{}`,
+			expected: []announced{
+				{"containerd", nginx, true},
+				{"cri", pause, true},
+				{"docker", build, true},
+			},
+		},
+		"Exclude pod sandboxes and ci": {
+			cfg: `{"filters": {"exclude": [{"pod_sandbox": true}, {"labels": "ci"}]}}`,
+			expected: []announced{
+				{"containerd", nginx, true},
+				{"cri", pause, false},
+				{"docker", build, false},
+			},
+		},
+		"Include engines and namespaces": {
+			cfg: `{"filters": {"include": [{"engines": ["containerd", "cri"], "containerd_namespaces": ["k8s.io"], "k8s_namespaces": ["default"]}]}}`,
+			expected: []announced{
+				{"containerd", nginx, true},
+				{"docker", nginx, false},
+				// No kubernetes namespace label
+				{"cri", pause, false},
+				{"docker", build, false},
+			},
+		},
+		"Image repos": {
+			cfg: `{"filters": {"exclude": [{"image_repos": ["registry.k8s.io/*", "localhost:5000/ci/*"]}]}}`,
+			expected: []announced{
+				{"containerd", nginx, true},
+				{"cri", pause, false},
+				{"docker", build, false},
+			},
+		},
+		"Label selector": {
+			cfg: `{"filters": {"include": [{"labels": "app=nginx, tier!=db, !ci"}, {"labels": "ci==false"}]}}`,
+			expected: []announced{
+				{"containerd", nginx, true},
+				{"cri", pause, false},
+				{"docker", build, false},
+			},
+		},
+		"Exclude wins over include": {
+			cfg: `{"filters": {"include": [{"engines": ["docker"]}], "exclude": [{"engines": ["docker"], "labels": "ci=true"}]}}`,
+			expected: []announced{
+				{"docker", nginx, true},
+				{"docker", build, false},
+			},
+		},
+	}
+
+	for name, tc := range tCases {
+		t.Run(name, func(t *testing.T) {
+			cfg := New(nil)
+			require.NoError(t, cfg.Load(tc.cfg))
+			for _, exp := range tc.expected {
+				assert.Equal(t, exp.ok, cfg.GetFilterPolicy().Announces(exp.engine, exp.ctr), "%s %s", exp.engine, exp.ctr.Image)
+			}
+		})
+	}
+}
+
+func TestFilterPolicyInvalid(t *testing.T) {
+	err := New(nil).Load(`{"filters": {"include": [{"engines": ["lxc"]}]}}`)
+	var errs Errors
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 1)
+	assert.Equal(t, "filters.include[0].engines[0]", errs[0].Key)
+
+	err = New(nil).Load(`{"filters": {"exclude": [{"pod_sandbox": true}, {"labels": "app,=x", "image_repos": ["re:["]}]}}`)
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 2)
+	assert.Equal(t, "filters.exclude[1].image_repos[0]", errs[0].Key)
+	assert.Equal(t, "filters.exclude[1].labels", errs[1].Key)
+}
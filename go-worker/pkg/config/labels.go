@@ -0,0 +1,169 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	defaultTruncateMarker = "..."
+	// Prefix of patterns that are regular expressions rather than globs
+	regexPrefix = "re:"
+)
+
+// LabelsCfg configures which labels are reported, and how long values are handled.
+// Patterns are globs, where `*` matches any sequence of chars and `?` a single char,
+// or regular expressions if prefixed by "re:".
+type LabelsCfg struct {
+	// Container labels to be reported; all if empty
+	Include []string `json:"include"`
+	// Container labels not to be reported, even if included
+	Exclude []string `json:"exclude"`
+	// Same as Include and Exclude, for pod sandbox labels
+	PodSandboxInclude []string `json:"pod_sandbox_include"`
+	PodSandboxExclude []string `json:"pod_sandbox_exclude"`
+	// Max value length of the given label keys, overriding label_max_len
+	KeyMaxLen map[string]int `json:"key_max_len"`
+	// Whether values exceeding their max length are truncated, ending with TruncateMarker, rather than dropped
+	Truncate       bool   `json:"truncate"`
+	TruncateMarker string `json:"truncate_marker"`
+}
+
+// patternFilter tells whether a name, eg: a label key, is selected.
+type patternFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func (f patternFilter) allows(key string) bool {
+	return (len(f.include) == 0 || matchesAny(f.include, key)) && !matchesAny(f.exclude, key)
+}
+
+func matchesAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// LabelPolicy filters and bounds the labels reported by engines, as configured by LabelsCfg and label_max_len.
+type LabelPolicy struct {
+	container  patternFilter
+	podSandbox patternFilter
+	maxLen     int
+	keyMaxLen  map[string]int
+	truncate   bool
+	marker     string
+}
+
+// compilePattern compiles a glob, or a regular expression if prefixed by "re:", matching whole keys;
+// globs ignore case if foldCase is set.
+func compilePattern(pattern string, foldCase bool) (*regexp.Regexp, error) {
+	if expr, ok := strings.CutPrefix(pattern, regexPrefix); ok {
+		return regexp.Compile("^(?:" + expr + ")$")
+	}
+	var expr strings.Builder
+	if foldCase {
+		expr.WriteString("(?i)")
+	}
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+// compilePatterns compiles the patterns of the given config key.
+func compilePatterns(patterns []string, key string, foldCase bool) ([]*regexp.Regexp, Errors) {
+	var (
+		res  []*regexp.Regexp
+		errs Errors
+	)
+	for i, pattern := range patterns {
+		re, err := compilePattern(pattern, foldCase)
+		if err != nil {
+			errs = append(errs, &Error{Key: fmt.Sprintf("%s[%d]", key, i), Err: err})
+			continue
+		}
+		res = append(res, re)
+	}
+	return res, errs
+}
+
+func newLabelPolicy(c *EngineCfg) (*LabelPolicy, Errors) {
+	p := &LabelPolicy{
+		maxLen:    c.LabelMaxLen,
+		keyMaxLen: c.Labels.KeyMaxLen,
+		truncate:  c.Labels.Truncate,
+		marker:    c.Labels.TruncateMarker,
+	}
+	var errs, patternErrs Errors
+	p.container.include, patternErrs = compilePatterns(c.Labels.Include, "labels.include", false)
+	errs = append(errs, patternErrs...)
+	p.container.exclude, patternErrs = compilePatterns(c.Labels.Exclude, "labels.exclude", false)
+	errs = append(errs, patternErrs...)
+	p.podSandbox.include, patternErrs = compilePatterns(c.Labels.PodSandboxInclude, "labels.pod_sandbox_include", false)
+	errs = append(errs, patternErrs...)
+	p.podSandbox.exclude, patternErrs = compilePatterns(c.Labels.PodSandboxExclude, "labels.pod_sandbox_exclude", false)
+	errs = append(errs, patternErrs...)
+	return p, errs
+}
+
+// Filter returns the container labels to be reported.
+func (p *LabelPolicy) Filter(labels map[string]string) map[string]string {
+	return p.apply(p.container, labels)
+}
+
+// FilterPodSandbox returns the pod sandbox labels to be reported.
+func (p *LabelPolicy) FilterPodSandbox(labels map[string]string) map[string]string {
+	return p.apply(p.podSandbox, labels)
+}
+
+func (p *LabelPolicy) apply(f patternFilter, labels map[string]string) map[string]string {
+	filtered := make(map[string]string, len(labels))
+	for key, val := range labels {
+		if !f.allows(key) {
+			continue
+		}
+		if val, ok := p.bound(key, val); ok {
+			filtered[key] = val
+		}
+	}
+	return filtered
+}
+
+// bound returns val, truncated if configured so, and whether it fits the max length of key.
+func (p *LabelPolicy) bound(key, val string) (string, bool) {
+	maxLen, ok := p.keyMaxLen[key]
+	if !ok {
+		maxLen = p.maxLen
+	}
+	if len(val) <= maxLen {
+		return val, true
+	}
+	if !p.truncate {
+		return "", false
+	}
+	marker := p.marker
+	if len(marker) > maxLen {
+		marker = ""
+	}
+	end := maxLen - len(marker)
+	// Never split a multi-byte char
+	for end > 0 && !utf8.RuneStart(val[end]) {
+		end--
+	}
+	return val[:end] + marker, true
+}
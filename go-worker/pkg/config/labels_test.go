@@ -0,0 +1,112 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestLabelPolicy(t *testing.T) {
+	labels := map[string]string{
+		"app":                         "nginx",
+		"app.kubernetes.io/name":      "nginx",
+		"app.kubernetes.io/version":   "1.27",
+		"io.kubernetes.pod.name":      "nginx-5f4b8c-xyz",
+		"io.kubernetes.pod.namespace": "default",
+		"annotation":                  "a very long annotation value",
+	}
+	tCases := map[string]struct {
+		cfg            string
+		expectedLabels map[string]string
+	}{
+		"Default": {
+			cfg:            `{}`,
+			expectedLabels: labels,
+		},
+		"Max len": {
+			cfg: `{"label_max_len": 10}`,
+			expectedLabels: map[string]string{
+				"app":                         "nginx",
+				"app.kubernetes.io/name":      "nginx",
+				"app.kubernetes.io/version":   "1.27",
+				"io.kubernetes.pod.namespace": "default",
+			},
+		},
+		"Include globs and regex": {
+			cfg: `{"labels": {"include": ["app.kubernetes.io/*", "re:io\\.kubernetes\\.pod\\.na.*"]}}`,
+			expectedLabels: map[string]string{
+				"app.kubernetes.io/name":      "nginx",
+				"app.kubernetes.io/version":   "1.27",
+				"io.kubernetes.pod.name":      "nginx-5f4b8c-xyz",
+				"io.kubernetes.pod.namespace": "default",
+			},
+		},
+		"Regex matches whole keys": {
+			cfg: `{"labels": {"include": ["re:app|io\\.kubernetes"]}}`,
+			expectedLabels: map[string]string{
+				"app": "nginx",
+			},
+		},
+		"Exclude wins over include": {
+			cfg: `{"labels": {"include": ["app*"], "exclude": ["app.kubernetes.io/vers?on"]}}`,
+			expectedLabels: map[string]string{
+				"app":                    "nginx",
+				"app.kubernetes.io/name": "nginx",
+			},
+		},
+		"Per key max len": {
+			cfg: `{"label_max_len": 10, "labels": {"include": ["io.*"], "key_max_len": {"io.kubernetes.pod.name": 253, "io.kubernetes.pod.namespace": 3}}}`,
+			expectedLabels: map[string]string{
+				"io.kubernetes.pod.name": "nginx-5f4b8c-xyz",
+			},
+		},
+		"Truncate": {
+			cfg: `{"label_max_len": 10, "labels": {"include": ["annotation", "app"], "truncate": true}}`,
+			expectedLabels: map[string]string{
+				"app":        "nginx",
+				"annotation": "a very ...",
+			},
+		},
+		"Truncate without marker": {
+			cfg: `{"label_max_len": 10, "labels": {"include": ["annotation"], "truncate": true, "truncate_marker": ""}}`,
+			expectedLabels: map[string]string{
+				"annotation": "a very lon",
+			},
+		},
+	}
+
+	for name, tc := range tCases {
+		t.Run(name, func(t *testing.T) {
+			cfg := New(nil)
+			require.NoError(t, cfg.Load(tc.cfg))
+			assert.Equal(t, tc.expectedLabels, cfg.GetLabelPolicy().Filter(labels))
+		})
+	}
+}
+
+func TestLabelPolicyPodSandbox(t *testing.T) {
+	cfg := New(nil)
+	require.NoError(t, cfg.Load(`{"labels": {"include": ["app"], "pod_sandbox_exclude": ["pod-template-hash"]}}`))
+	labels := map[string]string{"app": "nginx", "pod-template-hash": "5f4b8c"}
+	assert.Equal(t, map[string]string{"app": "nginx"}, cfg.GetLabelPolicy().Filter(labels))
+	assert.Equal(t, map[string]string{"app": "nginx"}, cfg.GetLabelPolicy().FilterPodSandbox(labels))
+}
+
+func TestLabelPolicyTruncateMultiByte(t *testing.T) {
+	cfg := New(nil)
+	require.NoError(t, cfg.Load(`{"label_max_len": 4, "labels": {"truncate": true, "truncate_marker": "~"}}`))
+	// "é" takes 2 bytes, and cannot be split
+	assert.Equal(t, map[string]string{"name": "ab~"}, cfg.GetLabelPolicy().Filter(map[string]string{"name": "abéé"}))
+}
+
+func TestLabelPolicyInvalidPattern(t *testing.T) {
+	cfg := New(nil)
+	err := cfg.Load(`{"labels": {"include": ["app", "re:("]}}`)
+	var errs Errors
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 1)
+	assert.Equal(t, "labels.include[1]", errs[0].Key)
+	// The current policy is kept
+	assert.NotNil(t, cfg.GetLabelPolicy())
+	assert.Len(t, cfg.GetLabelPolicy().Filter(map[string]string{"other": "x"}), 1)
+}
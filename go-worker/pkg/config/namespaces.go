@@ -0,0 +1,60 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Key of the namespaces config applied to sockets without their own
+const allSockets = "*"
+
+// NamespacesCfg selects the containerd namespaces watched on a socket.
+// Patterns are globs, or regular expressions if prefixed by "re:", like label ones.
+type NamespacesCfg struct {
+	// Namespaces to be watched; all if empty
+	Allow []string `json:"allow"`
+	// Namespaces not to be watched, even if allowed
+	Deny []string `json:"deny"`
+}
+
+// NamespacePolicy tells which containerd namespaces are watched, as configured by NamespacesCfg.
+// A nil policy allows all namespaces.
+type NamespacePolicy struct {
+	filter patternFilter
+}
+
+// newNamespacePolicies compiles the namespaces config of each containerd socket.
+func newNamespacePolicies(c *EngineCfg) (map[string]*NamespacePolicy, Errors) {
+	var errs Errors
+	namespaces := c.SocketsEngines["containerd"].Namespaces
+	policies := make(map[string]*NamespacePolicy, len(namespaces))
+	for _, socket := range slices.Sorted(maps.Keys(namespaces)) {
+		nsCfg := namespaces[socket]
+		key := fmt.Sprintf("engines.containerd.namespaces.%s", socket)
+		p := &NamespacePolicy{}
+		var patternErrs Errors
+		p.filter.include, patternErrs = compilePatterns(nsCfg.Allow, key+".allow", false)
+		errs = append(errs, patternErrs...)
+		p.filter.exclude, patternErrs = compilePatterns(nsCfg.Deny, key+".deny", false)
+		errs = append(errs, patternErrs...)
+		policies[socket] = p
+	}
+	return policies, errs
+}
+
+// Allows tells whether namespace is watched.
+func (p *NamespacePolicy) Allows(namespace string) bool {
+	return p == nil || p.filter.allows(namespace)
+}
+
+// Filter returns the watched namespaces among the given ones.
+func (p *NamespacePolicy) Filter(namespaces []string) []string {
+	allowed := make([]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		if p.Allows(ns) {
+			allowed = append(allowed, ns)
+		}
+	}
+	return allowed
+}
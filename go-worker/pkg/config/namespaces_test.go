@@ -0,0 +1,37 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNamespacePolicy(t *testing.T) {
+	cfg := New(nil)
+	// All namespaces by default
+	assert.Nil(t, cfg.GetNamespacePolicy("/run/containerd/containerd.sock"))
+	assert.True(t, cfg.GetNamespacePolicy("/run/containerd/containerd.sock").Allows("moby"))
+
+	require.NoError(t, cfg.Load(`{"engines": {"containerd": {"enabled": true,
+		"sockets": ["/run/containerd/containerd.sock", "unix:///run/k3s/containerd/containerd.sock"],
+		"namespaces": {"*": {"deny": ["moby", "re:buildkit.*"]}, "unix:///run/k3s/containerd/containerd.sock": {"allow": ["k8s.*"]}}}}}`))
+	nss := []string{"default", "moby", "buildkit-history", "k8s.io"}
+	assert.Equal(t, []string{"default", "k8s.io"}, cfg.GetNamespacePolicy("/run/containerd/containerd.sock").Filter(nss))
+	assert.Equal(t, []string{"k8s.io"}, cfg.GetNamespacePolicy("unix:///run/k3s/containerd/containerd.sock").Filter(nss))
+}
+
+func TestNamespacePolicyInvalid(t *testing.T) {
+	err := New(nil).Load(`{"engines": {
+		"containerd": {"enabled": true, "sockets": ["/run/containerd/containerd.sock"], "namespaces": {"/run/other.sock": {}}},
+		"docker": {"enabled": true, "sockets": ["/var/run/docker.sock"], "namespaces": {"*": {}}}}}`)
+	var errs Errors
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 2)
+	assert.Equal(t, "engines.containerd.namespaces./run/other.sock", errs[0].Key)
+	assert.Equal(t, "engines.docker.namespaces", errs[1].Key)
+
+	err = New(nil).Load(`{"engines": {"containerd": {"enabled": true, "sockets": ["/run/containerd/containerd.sock"], "namespaces": {"*": {"allow": ["re:("]}}}}}`)
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 1)
+	assert.Equal(t, "engines.containerd.namespaces.*.allow[0]", errs[0].Key)
+}
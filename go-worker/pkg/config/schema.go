@@ -0,0 +1,175 @@
+package config
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+//go:generate go run schema_gen.go
+
+// Schema is the JSON schema of the plugin configuration.
+// It is shared with the plugin, that embeds it through src/plugin_config_schema.h:
+// run `go generate ./pkg/config` after changing schema.json.
+//
+//go:embed schema.json
+var Schema []byte
+
+// Keys set by the plugin itself, not by users, thus missing from the schema
+var internalKeys = []string{"host_root"}
+
+// schema is the subset of draft-04 JSON schema used by schema.json.
+// Required keys are not enforced, since missing keys get their default value.
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties *additional        `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	Enum                 []any              `json:"enum"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinLength            *int               `json:"minLength"`
+	Definitions          map[string]*schema `json:"definitions"`
+}
+
+// additional is the additionalProperties of an object schema: either a boolean or the schema of their values.
+type additional struct {
+	denied bool
+	schema *schema
+}
+
+func (a *additional) UnmarshalJSON(data []byte) error {
+	var allowed bool
+	if err := json.Unmarshal(data, &allowed); err == nil {
+		a.denied = !allowed
+		return nil
+	}
+	return json.Unmarshal(data, &a.schema)
+}
+
+var rootSchema = mustParseSchema(Schema)
+
+func mustParseSchema(data []byte) *schema {
+	var s schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		panic(fmt.Sprintf("invalid config schema: %v", err))
+	}
+	return &s
+}
+
+// resolve follows s $ref, that can only point to the root definitions.
+func (s *schema) resolve() *schema {
+	for s.Ref != "" {
+		s = rootSchema.Definitions[strings.TrimPrefix(s.Ref, "#/definitions/")]
+	}
+	return s
+}
+
+func joinKey(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// validate checks v, decoded with json.Decoder.UseNumber, against s; path is the key of v.
+func (s *schema) validate(v any, path string) Errors {
+	s = s.resolve()
+	if err := s.validateType(v); err != nil {
+		return Errors{{Key: path, Err: err}}
+	}
+	var errs Errors
+	switch v := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			prop, ok := s.Properties[key]
+			if !ok && s.AdditionalProperties != nil {
+				prop = s.AdditionalProperties.schema
+				if s.AdditionalProperties.denied && !(s == rootSchema && slices.Contains(internalKeys, key)) {
+					errs = append(errs, &Error{Key: joinKey(path, key), Err: fmt.Errorf("unknown key")})
+				}
+			}
+			if prop == nil {
+				continue
+			}
+			errs = append(errs, prop.validate(v[key], joinKey(path, key))...)
+		}
+	case []any:
+		if s.Items != nil {
+			for i, item := range v {
+				errs = append(errs, s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case json.Number:
+		n, _ := v.Float64()
+		if s.Minimum != nil && n < *s.Minimum {
+			errs = append(errs, &Error{Key: path, Err: fmt.Errorf("%s is less than %v", v, *s.Minimum)})
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			errs = append(errs, &Error{Key: path, Err: fmt.Errorf("%s is greater than %v", v, *s.Maximum)})
+		}
+	case string:
+		if s.MinLength != nil && len(v) < *s.MinLength {
+			errs = append(errs, &Error{Key: path, Err: fmt.Errorf("shorter than %d", *s.MinLength)})
+		}
+	}
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e any) bool {
+		return fmt.Sprint(e) == fmt.Sprint(v)
+	}) {
+		errs = append(errs, &Error{Key: path, Err: fmt.Errorf("unknown value %q, expected one of %v", fmt.Sprint(v), s.Enum)})
+	}
+	return errs
+}
+
+func (s *schema) validateType(v any) error {
+	var ok bool
+	switch s.Type {
+	case "":
+		return nil
+	case "object":
+		_, ok = v.(map[string]any)
+	case "array":
+		_, ok = v.([]any)
+	case "string":
+		_, ok = v.(string)
+	case "boolean":
+		_, ok = v.(bool)
+	case "number":
+		_, ok = v.(json.Number)
+	case "integer":
+		var n json.Number
+		if n, ok = v.(json.Number); ok {
+			_, err := n.Int64()
+			ok = err == nil
+		}
+	}
+	if !ok {
+		return fmt.Errorf("expected %s, got %s", s.Type, jsonType(v))
+	}
+	return nil
+}
+
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	default:
+		return "number"
+	}
+}
@@ -0,0 +1,37 @@
+//go:build ignore
+
+// schema_gen generates src/plugin_config_schema.h from schema.json,
+// so that the plugin and the worker share the same config schema.
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const header = `#pragma once
+
+// Code generated by go-worker/pkg/config/schema_gen.go from schema.json; DO NOT EDIT.
+
+#define LONG_STRING_CONST(...) #__VA_ARGS__
+
+const char plugin_schema_string[] = LONG_STRING_CONST(
+
+%s
+
+); // LONG_STRING_CONST macro
+`
+
+func main() {
+	data, err := os.ReadFile("schema.json")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	out := fmt.Sprintf(header, strings.TrimRight(string(data), "\n"))
+	if err = os.WriteFile("../../../src/plugin_config_schema.h", []byte(out), 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,121 @@
+package container
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrNoContainer is returned by MatchPid when the process does not run in a container.
+var ErrNoContainer = errors.New("process not running in a container")
+
+// cgroupLayout is a well-known cgroup path layout of the containers run by an engine.
+// The first submatch of re is the container id; an empty engine marks cgroups not belonging to containers.
+type cgroupLayout struct {
+	re     *regexp.Regexp
+	engine engineType
+}
+
+// Checked in order: the first matching layout wins.
+var cgroupLayouts = []cgroupLayout{
+	// podman, eg: /machine.slice/libpod-<id>.scope/container or /libpod_parent/libpod-<id>
+	// libpod-conmon-<id>.scope is skipped, since conmon runs outside of the container
+	{regexp.MustCompile(`(?:^|/)libpod-([0-9a-f]{64})(?:\.scope)?(?:/|$)`), typePodman},
+	// docker, eg: /docker/<id> or /system.slice/docker-<id>.scope
+	{regexp.MustCompile(`(?:^|/)docker[-/]([0-9a-f]{64})(?:\.scope)?(?:/|$)`), typeDocker},
+	// cri-o, eg: /kubepods.slice/kubepods-pod<uid>.slice/crio-<id>.scope or /kubepods/pod<uid>/crio-<id>
+	{regexp.MustCompile(`(?:^|/)crio-([0-9a-f]{64})(?:\.scope)?(?:/|$)`), typeCrio},
+	// containerd through cri, eg: /kubepods.slice/kubepods-pod<uid>.slice/cri-containerd-<id>.scope
+	// or, with the cgroupfs driver, /system.slice/containerd.service/kubepods-pod<uid>.slice:cri-containerd:<id>
+	{regexp.MustCompile(`[/:]cri-containerd[-:]([0-9a-f]{64})(?:\.scope)?(?:/|$)`), typeContainerd},
+	// kubernetes with the cgroupfs driver, whatever the runtime, eg: /kubepods/besteffort/pod<uid>/<id>
+	{regexp.MustCompile(`(?:^|/)kubepods(?:/[a-z]+)?/pod[0-9a-f_-]+/([0-9a-f]{64})(?:/|$)`), typeCri},
+	// other kubepods cgroups are pod or qos level ones, that do not belong to a container
+	{regexp.MustCompile(`^/kubepods(?:/|$)`), ""},
+	// other systemd slices and units, eg: /user.slice/user-1000, do not belong to a container either
+	{regexp.MustCompile(`^/[^/]+\.(?:slice|service|scope)(?:/|$)`), ""},
+	// containerd, eg: /k8s.io/<id> or /<namespace>/<id>; only generated ids are matched,
+	// since any other two levels cgroup, eg: /lxc/<name>, would look the same
+	{regexp.MustCompile(`^/[A-Za-z0-9][A-Za-z0-9._-]*/([0-9a-f]{64})$`), typeContainerd},
+}
+
+// CgroupMatch is a container resolved from a cgroup path.
+type CgroupMatch struct {
+	// Type of the engine expected to run the container, eg: "docker"
+	Engine string
+	// Container id, shortened like the ones sent by engines
+	ContainerID string
+}
+
+// Request returns a request for the matched container, with cgroup and pid as hints.
+func (m CgroupMatch) Request(cgroup string, pid int64) Request {
+	return Request{
+		ContainerID: m.ContainerID,
+		Type:        engineType(m.Engine).ToCTValue(),
+		Cgroup:      cgroup,
+		Pid:         pid,
+	}
+}
+
+// MatchCgroup resolves the container owning cgroup, using the well-known layouts of container engines
+// and of systemd slices.
+func MatchCgroup(cgroup string) (CgroupMatch, bool) {
+	for _, layout := range cgroupLayouts {
+		if m := layout.re.FindStringSubmatch(cgroup); m != nil {
+			if layout.engine == "" {
+				break
+			}
+			return CgroupMatch{
+				Engine:      string(layout.engine),
+				ContainerID: shortContainerID(m[1]),
+			}, true
+		}
+	}
+	return CgroupMatch{}, false
+}
+
+// fullContainerID returns the full id of containerId, if cgroup follows a layout of engine.
+func fullContainerID(cgroup string, engine engineType, containerId string) (string, bool) {
+	for _, layout := range cgroupLayouts {
+		if layout.engine != engine {
+			continue
+		}
+		if m := layout.re.FindStringSubmatch(cgroup); m != nil && strings.HasPrefix(m[1], containerId) {
+			return m[1], true
+		}
+	}
+	return "", false
+}
+
+// MatchPid resolves the container running the host process pid, reading its cgroups
+// from <hostRoot>/proc/<pid>/cgroup. It returns the matching cgroup path too,
+// or ErrNoContainer if no cgroup of the process belongs to a container.
+func MatchPid(hostRoot string, pid int64) (CgroupMatch, string, error) {
+	path := filepath.Join(hostRoot, "proc", strconv.FormatInt(pid, 10), "cgroup")
+	f, err := os.Open(path)
+	if err != nil {
+		return CgroupMatch{}, "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path; the path may contain colons
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if m, ok := MatchCgroup(fields[2]); ok {
+			return m, fields[2], nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return CgroupMatch{}, "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return CgroupMatch{}, "", ErrNoContainer
+}
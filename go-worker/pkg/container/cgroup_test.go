@@ -0,0 +1,126 @@
+package container
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testCgroupID = "3ad7b26ded6d8e7b23da7d48fe889434573036c27ae5a74837233de441c3601e"
+
+func TestMatchCgroup(t *testing.T) {
+	tCases := map[string]struct {
+		cgroup         string
+		expectedEngine engineType
+	}{
+		"Docker cgroupfs": {
+			cgroup:         "/docker/" + testCgroupID,
+			expectedEngine: typeDocker,
+		},
+		"Docker systemd": {
+			cgroup:         "/system.slice/docker-" + testCgroupID + ".scope",
+			expectedEngine: typeDocker,
+		},
+		"Podman systemd": {
+			cgroup:         "/machine.slice/libpod-" + testCgroupID + ".scope/container",
+			expectedEngine: typePodman,
+		},
+		"Podman rootless": {
+			cgroup:         "/user.slice/user-1000.slice/user@1000.service/user.slice/libpod-" + testCgroupID + ".scope",
+			expectedEngine: typePodman,
+		},
+		"Podman cgroupfs": {
+			cgroup:         "/libpod_parent/libpod-" + testCgroupID,
+			expectedEngine: typePodman,
+		},
+		"Cri-o systemd": {
+			cgroup:         "/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1a2b.slice/crio-" + testCgroupID + ".scope",
+			expectedEngine: typeCrio,
+		},
+		"Containerd cri systemd": {
+			cgroup:         "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1a2b.slice/cri-containerd-" + testCgroupID + ".scope",
+			expectedEngine: typeContainerd,
+		},
+		"Containerd cri cgroupfs": {
+			cgroup:         "/system.slice/containerd.service/kubepods-burstable-pod1a2b.slice:cri-containerd:" + testCgroupID,
+			expectedEngine: typeContainerd,
+		},
+		"Kubepods cgroupfs": {
+			cgroup:         "/kubepods/besteffort/pod1a2b-3c4d/" + testCgroupID,
+			expectedEngine: typeCri,
+		},
+		"Containerd namespace": {
+			cgroup:         "/default/" + testCgroupID,
+			expectedEngine: typeContainerd,
+		},
+		"Containerd dotted namespace": {
+			cgroup:         "/k8s.io/" + testCgroupID,
+			expectedEngine: typeContainerd,
+		},
+	}
+
+	for name, tc := range tCases {
+		t.Run(name, func(t *testing.T) {
+			m, ok := MatchCgroup(tc.cgroup)
+			assert.True(t, ok)
+			assert.Equal(t, string(tc.expectedEngine), m.Engine)
+			assert.Equal(t, testCgroupID[:shortIDLength], m.ContainerID)
+		})
+	}
+}
+
+func TestMatchCgroupHost(t *testing.T) {
+	for _, cgroup := range []string{
+		"/",
+		"/init.scope",
+		"/system.slice/sshd.service",
+		"/user.slice/user-1000.slice/session-2.scope",
+		"/user.slice/user-1000",
+		"/system.slice/" + testCgroupID,
+		"/machine.slice/libpod-conmon-" + testCgroupID + ".scope",
+		"/kubepods.slice/kubepods-pod1a2b.slice/crio-conmon-" + testCgroupID + ".scope",
+		"/kubepods/besteffort",
+		"/lxc/foo",
+		"/user/session1",
+		"/k8s.io/ctr",
+	} {
+		_, ok := MatchCgroup(cgroup)
+		assert.False(t, ok, cgroup)
+	}
+}
+
+func TestMatchPid(t *testing.T) {
+	hostRoot := t.TempDir()
+	writeCgroup := func(pid, content string) {
+		dir := filepath.Join(hostRoot, "proc", pid)
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "cgroup"), []byte(content), 0o644))
+	}
+	// cgroup v1, where only some hierarchies belong to the container
+	writeCgroup("10", "12:cpuset:/\n"+
+		"4:memory:/kubepods/pod1a2b:cri-containerd:"+testCgroupID+"\n"+
+		"1:name=systemd:/system.slice/containerd.service/kubepods-pod1a2b.slice:cri-containerd:"+testCgroupID+"\n")
+	// cgroup v2
+	writeCgroup("20", "0::/system.slice/docker-"+testCgroupID+".scope\n")
+	writeCgroup("30", "0::/user.slice/user-1000.slice/session-2.scope\n")
+
+	m, cgroup, err := MatchPid(hostRoot, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, CgroupMatch{Engine: string(typeContainerd), ContainerID: testCgroupID[:shortIDLength]}, m)
+	assert.Equal(t, "/kubepods/pod1a2b:cri-containerd:"+testCgroupID, cgroup)
+	req := m.Request(cgroup, 10)
+	assert.Equal(t, typeContainerd.ToCTValue(), req.Type)
+	assert.Equal(t, int64(10), req.Pid)
+
+	m, _, err = MatchPid(hostRoot, 20)
+	assert.NoError(t, err)
+	assert.Equal(t, string(typeDocker), m.Engine)
+
+	_, _, err = MatchPid(hostRoot, 30)
+	assert.ErrorIs(t, err, ErrNoContainer)
+
+	_, _, err = MatchPid(hostRoot, 40)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
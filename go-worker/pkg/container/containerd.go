@@ -4,19 +4,30 @@ import (
 	"context"
 	"github.com/FedeDP/container-worker/pkg/config"
 	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/FedeDP/container-worker/pkg/logger"
+	"github.com/FedeDP/container-worker/pkg/stats"
 	"github.com/containerd/containerd/api/events"
 	containerd "github.com/containerd/containerd/v2/client"
 	"github.com/containerd/containerd/v2/core/containers"
+	eventsapi "github.com/containerd/containerd/v2/core/events"
 	"github.com/containerd/containerd/v2/pkg/namespaces"
 	"github.com/containerd/containerd/v2/pkg/oci"
+	"github.com/containerd/errdefs"
 	"github.com/containerd/typeurl/v2"
 	"github.com/opencontainers/runtime-spec/specs-go"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
-const typeContainerd engineType = "containerd"
+const (
+	typeContainerd engineType = "containerd"
+
+	topicNamespaceCreate = "/namespaces/create"
+	topicNamespaceDelete = "/namespaces/delete"
+)
 
 func init() {
 	engineGenerators[typeContainerd] = newContainerdEngine
@@ -24,28 +35,44 @@ func init() {
 
 type containerdEngine struct {
 	client *containerd.Client
+	cfg    *config.Config
+	log    logger.Logger
+	stats  *stats.Engine
 	socket string
+	// Namespaces cache, kept up to date by Listen; nil until listed
+	nsMtx   sync.Mutex
+	nsCache []string
 }
 
-func newContainerdEngine(_ context.Context, socket string) (Engine, error) {
-	client, err := containerd.New(socket)
+func newContainerdEngine(_ context.Context, cfg *config.Config, log logger.Logger, st *stats.Engine, socket string) (Engine, error) {
+	client, err := containerd.New(socket, containerd.WithTimeout(cfg.GetTimeouts(string(typeContainerd)).Connect))
 	if err != nil {
 		return nil, err
 	}
-	return &containerdEngine{client: client, socket: socket}, nil
+	return &containerdEngine{client: client, cfg: cfg, log: log, stats: st, socket: socket}, nil
 }
 
 func (c *containerdEngine) copy(ctx context.Context) (Engine, error) {
-	return newContainerdEngine(ctx, c.socket)
+	return newContainerdEngine(ctx, c.cfg, c.log, c.stats, c.socket)
+}
+
+func (c *containerdEngine) Close() error {
+	return c.client.Close()
 }
 
 func (c *containerdEngine) ctrToInfo(namespacedContext context.Context, container containerd.Container) event.Info {
-	info, err := container.Info(namespacedContext)
+	reqCtx, cancel := withRequestTimeout(namespacedContext, c.cfg, typeContainerd)
+	info, err := container.Info(reqCtx)
+	cancel()
 	if err != nil {
+		c.log.Debugf("failed to get info of container %s: %v", container.ID(), err)
 		info = containers.Container{}
 	}
-	spec, err := container.Spec(namespacedContext)
+	reqCtx, cancel = withRequestTimeout(namespacedContext, c.cfg, typeContainerd)
+	spec, err := container.Spec(reqCtx)
+	cancel()
 	if err != nil {
+		c.log.Debugf("failed to get spec of container %s: %v", container.ID(), err)
 		spec = &oci.Spec{
 			Process: &specs.Process{},
 			Mounts:  nil,
@@ -87,6 +114,10 @@ func (c *containerdEngine) ctrToInfo(namespacedContext context.Context, containe
 	}
 
 	// Mounts related
+	var propagation string
+	if spec.Linux != nil {
+		propagation = spec.Linux.RootfsPropagation
+	}
 	mounts := make([]event.Mount, 0)
 	for _, m := range spec.Mounts {
 		readOnly := false
@@ -104,7 +135,7 @@ func (c *containerdEngine) ctrToInfo(namespacedContext context.Context, containe
 			Destination: m.Destination,
 			Mode:        mode,
 			RW:          !readOnly,
-			Propagation: spec.Linux.RootfsPropagation,
+			Propagation: propagation,
 		})
 	}
 
@@ -136,12 +167,12 @@ func (c *containerdEngine) ctrToInfo(namespacedContext context.Context, containe
 		imageTag    string
 		imageSize   int64 = -1
 	)
-	// TODO this is an extra API call; shall we move it behing config.GetWithSize()?
+	// TODO this is an extra API call; shall we move it behing cfg.GetWithSize()?
 	// Or rename `with_size` option with something more generic like `full_info`?
 	image, _ := container.Image(namespacedContext)
 	if image != nil {
 		imageDigest = image.Target().Digest.String()
-		if config.GetWithSize() {
+		if c.cfg.GetWithSize() {
 			imageSize = image.Target().Size
 		}
 	}
@@ -153,26 +184,20 @@ func (c *containerdEngine) ctrToInfo(namespacedContext context.Context, containe
 
 	// Network related - TODO
 
-	labels := make(map[string]string)
-	for key, val := range info.Labels {
-		if len(val) <= config.GetLabelMaxLen() {
-			labels[key] = val
-		}
-	}
+	labels := c.cfg.GetLabelPolicy().Filter(info.Labels)
 
 	isPodSandbox := false
 	var podSandboxLabels map[string]string
-	sandbox, _ := c.client.LoadSandbox(namespacedContext, info.SandboxID)
+	reqCtx, cancel = withRequestTimeout(namespacedContext, c.cfg, typeContainerd)
+	sandbox, _ := c.client.LoadSandbox(reqCtx, info.SandboxID)
+	cancel()
 	if sandbox != nil {
 		isPodSandbox = true
-		sandboxLabels, _ := sandbox.Labels(namespacedContext)
+		reqCtx, cancel = withRequestTimeout(namespacedContext, c.cfg, typeContainerd)
+		sandboxLabels, _ := sandbox.Labels(reqCtx)
+		cancel()
 		if len(sandboxLabels) > 0 {
-			podSandboxLabels = make(map[string]string)
-			for key, val := range sandboxLabels {
-				if len(val) <= config.GetLabelMaxLen() {
-					podSandboxLabels[key] = val
-				}
-			}
+			podSandboxLabels = c.cfg.GetLabelPolicy().FilterPodSandbox(sandboxLabels)
 		}
 	}
 
@@ -198,6 +223,16 @@ func (c *containerdEngine) ctrToInfo(namespacedContext context.Context, containe
 		privileged = false
 	}
 
+	var (
+		user string
+		env  []string
+	)
+	if spec.Process != nil {
+		user = strconv.FormatUint(uint64(spec.Process.User.UID), 10)
+		env = spec.Process.Env
+	}
+
+	namespace, _ := namespaces.Namespace(namespacedContext)
 	return event.Info{
 		Container: event.Container{
 			Type:             typeContainerd.ToCTValue(),
@@ -207,13 +242,13 @@ func (c *containerdEngine) ctrToInfo(namespacedContext context.Context, containe
 			ImageDigest:      imageDigest,
 			ImageRepo:        imageRepo,
 			ImageTag:         imageTag,
-			User:             strconv.FormatUint(uint64(spec.Process.User.UID), 10),
+			User:             user,
 			CPUPeriod:        int64(cpuPeriod),
 			CPUQuota:         cpuQuota,
 			CPUShares:        int64(cpuShares),
 			CPUSetCPUCount:   cpusetCount,
 			CreatedTime:      info.CreatedAt.Unix(),
-			Env:              spec.Process.Env,
+			Env:              env,
 			FullID:           container.ID(),
 			HostIPC:          hostIPC,
 			HostNetwork:      hostNetwork,
@@ -228,38 +263,135 @@ func (c *containerdEngine) ctrToInfo(namespacedContext context.Context, containe
 			PodSandboxLabels: podSandboxLabels,
 			Mounts:           mounts,
 			Size:             imageSize,
+			Namespace:        namespace,
 		},
 	}
 }
 
+// namespacePolicy returns the policy of the namespaces watched on the engine socket.
+func (c *containerdEngine) namespacePolicy() *config.NamespacePolicy {
+	// Policies are keyed by configured sockets, that are not prefixed by host root
+	hostRoot := c.cfg.GetHostRoot()
+	for _, socket := range c.cfg.Get().SocketsEngines[string(typeContainerd)].Sockets {
+		if hostSocket(hostRoot, socket) == c.socket {
+			return c.cfg.GetNamespacePolicy(socket)
+		}
+	}
+	return c.cfg.GetNamespacePolicy(c.socket)
+}
+
+// namespaces returns the watched containerd namespaces, listing them only if not cached yet.
+func (c *containerdEngine) namespaces(ctx context.Context) ([]string, error) {
+	c.nsMtx.Lock()
+	defer c.nsMtx.Unlock()
+	if c.nsCache == nil {
+		ctx, cancel := withRequestTimeout(ctx, c.cfg, typeContainerd)
+		defer cancel()
+		namespacesList, err := c.client.NamespaceService().List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// Never nil, even if empty, to tell it is cached
+		c.nsCache = append(make([]string, 0, len(namespacesList)), namespacesList...)
+	}
+	return c.namespacePolicy().Filter(c.nsCache), nil
+}
+
+// invalidateNamespaces drops the namespaces cache, eg: since namespace events could have been lost.
+func (c *containerdEngine) invalidateNamespaces() {
+	c.nsMtx.Lock()
+	defer c.nsMtx.Unlock()
+	c.nsCache = nil
+}
+
+// updateNamespaces updates the namespaces cache given a namespace create or delete event,
+// returning the created or deleted namespace; empty if the event could not be decoded.
+func (c *containerdEngine) updateNamespaces(ev *eventsapi.Envelope) string {
+	var name string
+	if ev.Topic == topicNamespaceCreate {
+		nsCreate := events.NamespaceCreate{}
+		if err := typeurl.UnmarshalTo(ev.Event, &nsCreate); err != nil {
+			c.log.Debugf("failed to decode namespace event: %v", err)
+			c.invalidateNamespaces()
+			return ""
+		}
+		name = nsCreate.Name
+	} else {
+		nsDelete := events.NamespaceDelete{}
+		if err := typeurl.UnmarshalTo(ev.Event, &nsDelete); err != nil {
+			c.log.Debugf("failed to decode namespace event: %v", err)
+			c.invalidateNamespaces()
+			return ""
+		}
+		name = nsDelete.Name
+	}
+	c.nsMtx.Lock()
+	defer c.nsMtx.Unlock()
+	if c.nsCache == nil {
+		// Listed from scratch when needed
+		return name
+	}
+	c.nsCache = slices.DeleteFunc(c.nsCache, func(ns string) bool {
+		return ns == name
+	})
+	if ev.Topic == topicNamespaceCreate {
+		c.nsCache = append(c.nsCache, name)
+	}
+	return name
+}
+
+// loadContainer loads a container from the namespace of namespacedContext.
+func (c *containerdEngine) loadContainer(namespacedContext context.Context, id string) (containerd.Container, error) {
+	ctx, cancel := withRequestTimeout(namespacedContext, c.cfg, typeContainerd)
+	defer cancel()
+	return c.client.LoadContainer(ctx, id)
+}
+
 func (c *containerdEngine) get(ctx context.Context, containerId string) (*event.Event, error) {
-	namespacesList, err := c.client.NamespaceService().List(ctx)
+	namespacesList, err := c.namespaces(ctx)
 	if err != nil {
+		c.log.Debugf("failed to list namespaces: %v", err)
 		return nil, err
 	}
+	start := time.Now()
+	var loadErr error
 	for _, namespace := range namespacesList {
 		namespacedContext := namespaces.WithNamespace(ctx, namespace)
-		container, err := c.client.LoadContainer(namespacedContext, containerId)
+		container, err := c.loadContainer(namespacedContext, containerId)
 		if err == nil {
+			c.stats.Inspected(start, nil)
 			return &event.Event{
 				Info:     c.ctrToInfo(namespacedContext, container),
 				IsCreate: true,
 			}, nil
 		}
+		// Not a failure: engines are asked for containers run by other engines too
+		if !errdefs.IsNotFound(err) {
+			loadErr = err
+		}
+	}
+	c.stats.Inspected(start, loadErr)
+	if loadErr != nil {
+		c.log.Debugf("failed to load container %s: %v", containerId, loadErr)
 	}
-	return nil, nil
+	return nil, loadErr
 }
 
 func (c *containerdEngine) List(ctx context.Context) ([]event.Event, error) {
-	namespacesList, err := c.client.NamespaceService().List(ctx)
+	ctx, cancel := withListTimeout(ctx, c.cfg, typeContainerd)
+	defer cancel()
+	namespacesList, err := c.namespaces(ctx)
 	if err != nil {
 		return nil, err
 	}
 	evts := make([]event.Event, 0)
 	for _, namespace := range namespacesList {
 		namespacedContext := namespaces.WithNamespace(ctx, namespace)
-		containersList, err := c.client.Containers(namespacedContext)
+		reqCtx, reqCancel := withRequestTimeout(namespacedContext, c.cfg, typeContainerd)
+		containersList, err := c.client.Containers(reqCtx)
+		reqCancel()
 		if err != nil {
+			c.log.Warnf("failed to list containers in namespace %s: %v", namespace, err)
 			continue
 		}
 		for _, container := range containersList {
@@ -272,62 +404,158 @@ func (c *containerdEngine) List(ctx context.Context) ([]event.Event, error) {
 	return evts, nil
 }
 
+func (c *containerdEngine) envelopeToEvent(ctx context.Context, ev *eventsapi.Envelope) event.Event {
+	var (
+		id       string
+		isCreate bool
+		image    string
+		info     event.Info
+	)
+	ctrCreate := events.ContainerCreate{}
+	err := typeurl.UnmarshalTo(ev.Event, &ctrCreate)
+	if err == nil {
+		id = ctrCreate.ID
+		isCreate = true
+		image = ctrCreate.Image
+	} else {
+		ctrDelete := events.ContainerDelete{}
+		err = typeurl.UnmarshalTo(ev.Event, &ctrDelete)
+		if err == nil {
+			id = ctrDelete.ID
+			isCreate = false
+			image = ""
+		}
+	}
+	namespacedContext := namespaces.WithNamespace(ctx, ev.Namespace)
+	start := time.Now()
+	container, err := c.loadContainer(namespacedContext, id)
+	if isCreate {
+		c.stats.Inspected(start, err)
+	}
+	if err != nil {
+		if isCreate {
+			c.log.Warnf("failed to load container %s, using minimum set of infos: %v", id, err)
+			c.stats.Fallback()
+		}
+		// minimum set of infos
+		info = event.Info{
+			Container: event.Container{
+				Type:      typeContainerd.ToCTValue(),
+				ID:        shortContainerID(id),
+				FullID:    id,
+				Image:     image,
+				Namespace: ev.Namespace,
+			},
+		}
+	} else {
+		info = c.ctrToInfo(namespacedContext, container)
+	}
+	return event.Event{
+		Info:     info,
+		IsCreate: isCreate,
+	}
+}
+
+// subscription returns the filters of the events subscription: if the watched namespaces are restricted,
+// container events are only subscribed in them, so that other namespaces never reach the worker.
+// It also returns the policy the filters were built from.
+func (c *containerdEngine) subscription(ctx context.Context) ([]string, *config.NamespacePolicy) {
+	filters := []string{`topic=="` + topicNamespaceCreate + `"`, `topic=="` + topicNamespaceDelete + `"`}
+	containerTopics := []string{`topic=="/containers/create"`, `topic=="/containers/delete"`}
+	policy := c.namespacePolicy()
+	if policy == nil {
+		return append(containerTopics, filters...), nil
+	}
+	nss, err := c.namespaces(ctx)
+	if err != nil {
+		// Events from other namespaces are still dropped once received
+		c.log.Warnf("failed to list namespaces, subscribing to all of them: %v", err)
+		return append(containerTopics, filters...), policy
+	}
+	for _, ns := range nss {
+		for _, topic := range containerTopics {
+			filters = append(filters, topic+`,namespace==`+strconv.Quote(ns))
+		}
+	}
+	return filters, policy
+}
+
 func (c *containerdEngine) Listen(ctx context.Context, wg *sync.WaitGroup) (<-chan event.Event, error) {
 	outCh := make(chan event.Event)
 	eventsClient := c.client.EventService()
-	eventsCh, _ := eventsClient.Subscribe(ctx,
-		`topic=="/containers/create"`, `topic=="/containers/delete"`)
 	wg.Add(1)
 	go func() {
 		defer close(outCh)
 		defer wg.Done()
-		for {
-			select {
-			case <-ctx.Done():
+		defer Recover(c.log, c.stats, nil)
+		b := newBackoff()
+		resubscribe := false
+		for attempt := 0; ; attempt++ {
+			if attempt > 0 && !resubscribe && !b.wait(ctx) {
+				return
+			}
+			filters, policy := c.subscription(ctx)
+			sCtx, cancel := context.WithCancel(ctx)
+			eventsCh, errCh := eventsClient.Subscribe(sCtx, filters...)
+			if attempt > 0 && !resubscribe {
+				// Namespace events may have been lost too
+				c.invalidateNamespaces()
+			}
+			// Subscribe before listing, so that no event gets lost in between
+			if attempt > 0 {
+				relist(ctx, c.log, c, outCh)
+			}
+			h := newStreamHealth(listenHealthyAfter, b, c.stats)
+			var done bool
+			done, resubscribe = c.consume(ctx, policy, eventsCh, errCh, h, outCh)
+			h.stop()
+			cancel()
+			if done {
 				return
-			case ev := <-eventsCh:
-				var (
-					id       string
-					isCreate bool
-					image    string
-					info     event.Info
-				)
-				ctrCreate := events.ContainerCreate{}
-				err := typeurl.UnmarshalTo(ev.Event, &ctrCreate)
-				if err == nil {
-					id = ctrCreate.ID
-					isCreate = true
-					image = ctrCreate.Image
-				} else {
-					ctrDelete := events.ContainerDelete{}
-					err = typeurl.UnmarshalTo(ev.Event, &ctrDelete)
-					if err == nil {
-						id = ctrDelete.ID
-						isCreate = false
-						image = ""
-					}
-				}
-				namespacedContext := namespaces.WithNamespace(ctx, ev.Namespace)
-				container, err := c.client.LoadContainer(namespacedContext, id)
-				if err != nil {
-					// minimum set of infos
-					info = event.Info{
-						Container: event.Container{
-							Type:   typeContainerd.ToCTValue(),
-							ID:     shortContainerID(id),
-							FullID: id,
-							Image:  image,
-						},
-					}
-				} else {
-					info = c.ctrToInfo(namespacedContext, container)
-				}
-				outCh <- event.Event{
-					Info:     info,
-					IsCreate: isCreate,
-				}
 			}
 		}
 	}()
 	return outCh, nil
 }
+
+// consume forwards events from eventsCh to outCh until either the stream
+// reports an error or ctx is done; in the latter case, it returns true.
+// It also returns true, as second value, once the subscription built from policy must be
+// restricted to other namespaces, eg: since a watched namespace got created.
+func (c *containerdEngine) consume(ctx context.Context, policy *config.NamespacePolicy, eventsCh <-chan *eventsapi.Envelope, errCh <-chan error, h *streamHealth, outCh chan<- event.Event) (bool, bool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return true, false
+		case <-h.C():
+			h.healthy()
+		case err := <-errCh:
+			if ctx.Err() != nil {
+				return true, false
+			}
+			// Stream broken, eg: daemon restarted; reconnect.
+			c.log.Warnf("events stream disconnected: %v", err)
+			c.stats.SetState(stats.StateReconnecting)
+			return false, false
+		case ev := <-eventsCh:
+			cur := c.namespacePolicy()
+			if ev.Topic == topicNamespaceCreate || ev.Topic == topicNamespaceDelete {
+				name := c.updateNamespaces(ev)
+				if cur != policy || (cur != nil && ev.Topic == topicNamespaceCreate && cur.Allows(name)) {
+					return false, true
+				}
+				continue
+			}
+			if cur != policy {
+				// Config reloaded
+				return false, true
+			}
+			if !cur.Allows(ev.Namespace) {
+				continue
+			}
+			if !send(ctx, outCh, c.envelopeToEvent(ctx, ev)) {
+				return true, false
+			}
+		}
+	}
+}
@@ -2,16 +2,25 @@ package container
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"github.com/FedeDP/container-worker/pkg/config"
 	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/containerd/containerd/api/events"
 	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/containers"
+	eventsapi "github.com/containerd/containerd/v2/core/events"
 	"github.com/containerd/containerd/v2/pkg/namespaces"
 	"github.com/containerd/containerd/v2/pkg/oci"
+	"github.com/containerd/typeurl/v2"
 	"github.com/google/uuid"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"os/user"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestContainerd(t *testing.T) {
@@ -27,7 +36,7 @@ func TestContainerd(t *testing.T) {
 		t.Skip("Socket "+containerdSocket+" mandatory to run containerd tests:", err.Error())
 	}
 
-	engine, err := newContainerdEngine(context.Background(), containerdSocket)
+	engine, err := newContainerdEngine(context.Background(), config.New(nil), nil, nil, containerdSocket)
 	assert.NoError(t, err)
 
 	namespacedCtx := namespaces.WithNamespace(context.Background(), "test_ns")
@@ -99,6 +108,7 @@ func TestContainerd(t *testing.T) {
 				Mounts:           []event.Mount{},
 				User:             "0",
 				Size:             -1,
+				Namespace:        "test_ns",
 			}},
 		IsCreate: true,
 	}
@@ -132,9 +142,10 @@ func TestContainerd(t *testing.T) {
 	expectedEvent = event.Event{
 		Info: event.Info{
 			Container: event.Container{
-				Type:   typeContainerd.ToCTValue(),
-				ID:     shortContainerID(ctr.ID()),
-				FullID: ctr.ID(),
+				Type:      typeContainerd.ToCTValue(),
+				ID:        shortContainerID(ctr.ID()),
+				FullID:    ctr.ID(),
+				Namespace: "test_ns",
 			}},
 		IsCreate: false,
 	}
@@ -143,3 +154,116 @@ func TestContainerd(t *testing.T) {
 	evt := waitOnChannelOrTimeout(t, listCh)
 	assert.Equal(t, expectedEvent, evt)
 }
+
+func namespaceEnvelope(t *testing.T, topic string, evt any) *eventsapi.Envelope {
+	anyEvt, err := typeurl.MarshalAny(evt)
+	require.NoError(t, err)
+	return &eventsapi.Envelope{Topic: topic, Event: anyEvt}
+}
+
+func TestNamespacesCache(t *testing.T) {
+	cfg := config.New(nil)
+	require.NoError(t, cfg.Load(`{"host_root": "/host", "engines": {"containerd": {"enabled": true,
+		"sockets": ["/run/containerd/containerd.sock", "/run/k3s/containerd/containerd.sock"],
+		"namespaces": {"*": {"deny": ["moby", "buildkit"]}, "/run/k3s/containerd/containerd.sock": {"allow": ["k8s.io"]}}}}}`))
+	ctx := context.Background()
+
+	// Cached, thus never listed through the (missing) client
+	engine := &containerdEngine{cfg: cfg, socket: "/host/run/containerd/containerd.sock", nsCache: []string{"default", "moby", "k8s.io"}}
+	nss, err := engine.namespaces(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default", "k8s.io"}, nss)
+
+	engine.updateNamespaces(namespaceEnvelope(t, topicNamespaceCreate, &events.NamespaceCreate{Name: "buildkit"}))
+	engine.updateNamespaces(namespaceEnvelope(t, topicNamespaceCreate, &events.NamespaceCreate{Name: "test_ns"}))
+	engine.updateNamespaces(namespaceEnvelope(t, topicNamespaceDelete, &events.NamespaceDelete{Name: "default"}))
+	nss, err = engine.namespaces(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k8s.io", "test_ns"}, nss)
+	assert.Equal(t, []string{"moby", "k8s.io", "buildkit", "test_ns"}, engine.nsCache)
+
+	// Each socket has its own policy
+	k3s := &containerdEngine{cfg: cfg, socket: "/host/run/k3s/containerd/containerd.sock", nsCache: engine.nsCache}
+	nss, err = k3s.namespaces(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k8s.io"}, nss)
+
+	// Not cached, events are not applied
+	engine.invalidateNamespaces()
+	engine.updateNamespaces(namespaceEnvelope(t, topicNamespaceCreate, &events.NamespaceCreate{Name: "other"}))
+	assert.Nil(t, engine.nsCache)
+}
+
+func TestContainerdSubscription(t *testing.T) {
+	cfg := config.New(nil)
+	require.NoError(t, cfg.Load(`{"engines": {"containerd": {"enabled": true,
+		"sockets": ["/run/containerd/containerd.sock", "/run/k3s/containerd/containerd.sock"],
+		"namespaces": {"/run/k3s/containerd/containerd.sock": {"allow": ["k8s.*"], "deny": ["k8s.test"]}}}}}`))
+	ctx := context.Background()
+	namespaceTopics := []string{`topic=="/namespaces/create"`, `topic=="/namespaces/delete"`}
+
+	// All namespaces
+	engine := &containerdEngine{cfg: cfg, socket: "/run/containerd/containerd.sock"}
+	filters, policy := engine.subscription(ctx)
+	assert.Nil(t, policy)
+	assert.Equal(t, append([]string{`topic=="/containers/create"`, `topic=="/containers/delete"`}, namespaceTopics...), filters)
+
+	// Only the watched ones, cached thus never listed through the (missing) client
+	k3s := &containerdEngine{cfg: cfg, socket: "/run/k3s/containerd/containerd.sock", nsCache: []string{"default", "k8s.io", "k8s.test"}}
+	filters, policy = k3s.subscription(ctx)
+	assert.Same(t, cfg.GetNamespacePolicy("/run/k3s/containerd/containerd.sock"), policy)
+	assert.Equal(t, append(namespaceTopics,
+		`topic=="/containers/create",namespace=="k8s.io"`, `topic=="/containers/delete",namespace=="k8s.io"`), filters)
+
+	// Subscribed again once a watched namespace gets created, but not for other ones
+	eventsCh := make(chan *eventsapi.Envelope, 2)
+	eventsCh <- namespaceEnvelope(t, topicNamespaceCreate, &events.NamespaceCreate{Name: "other"})
+	eventsCh <- namespaceEnvelope(t, topicNamespaceCreate, &events.NamespaceCreate{Name: "k8s.new"})
+	done, resubscribe := k3s.consume(ctx, policy, eventsCh, make(chan error), newStreamHealth(time.Hour, newBackoff(), nil), make(chan event.Event))
+	assert.False(t, done)
+	assert.True(t, resubscribe)
+	assert.Empty(t, eventsCh)
+}
+
+// specContainer is a container whose spec is given, while its image and record cannot be got.
+type specContainer struct {
+	containerd.Container
+	spec *oci.Spec
+}
+
+func (s *specContainer) ID() string {
+	return "ctr"
+}
+
+func (s *specContainer) Info(_ context.Context, _ ...containerd.InfoOpts) (containers.Container, error) {
+	return containers.Container{}, errors.New("unavailable")
+}
+
+func (s *specContainer) Spec(_ context.Context) (*oci.Spec, error) {
+	return s.spec, nil
+}
+
+func (s *specContainer) Image(_ context.Context) (containerd.Image, error) {
+	return nil, errors.New("unavailable")
+}
+
+// FuzzContainerdCtrToInfo checks that malformed specs cannot make the engine panic.
+func FuzzContainerdCtrToInfo(f *testing.F) {
+	f.Add([]byte(`{"mounts":[{"destination":"/data","options":["ro","mode=755"]}]}`))
+	f.Add([]byte(`{"linux":{"resources":{"cpu":{"cpus":"0-"}}},"process":null}`))
+	f.Add([]byte(`{"linux":{"namespaces":[{"type":"pid"}],"rootfsPropagation":"rslave"},"mounts":[{"type":"sysfs","options":["ro"]}]}`))
+
+	// Unreachable daemon: sandboxes cannot be loaded
+	engine, err := newContainerdEngine(context.Background(), config.New(nil), nil, nil, "/nonexistent/containerd.sock")
+	require.NoError(f, err)
+	c := engine.(*containerdEngine)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var spec oci.Spec
+		if json.Unmarshal(data, &spec) != nil {
+			t.Skip()
+		}
+		assert.NotPanics(t, func() {
+			c.ctrToInfo(namespaces.WithNamespace(context.Background(), "default"), &specContainer{spec: &spec})
+		})
+	})
+}
@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"github.com/FedeDP/container-worker/pkg/config"
 	"github.com/FedeDP/container-worker/pkg/event"
-	internalapi "k8s.io/cri-api/pkg/apis"
+	"github.com/FedeDP/container-worker/pkg/logger"
+	"github.com/FedeDP/container-worker/pkg/stats"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	v1 "k8s.io/cri-api/pkg/apis/runtime/v1"
-	remote "k8s.io/cri-client/pkg"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,7 +19,6 @@ import (
 
 const (
 	typeCri   engineType = "cri"
-	typeCrio  engineType = "cri-o"
 	maxCNILen            = 4096
 )
 
@@ -26,38 +27,68 @@ func init() {
 }
 
 type criEngine struct {
-	client  internalapi.RuntimeService
+	client  *criClient
 	runtime int // as CT_FOO value
+	cfg     *config.Config
+	log     logger.Logger
+	stats   *stats.Engine
 	socket  string
 }
 
 // See https://github.com/falcosecurity/libs/blob/4d04cad02cd27e53cb18f431361a4d031836bb75/userspace/libsinsp/cri.hpp#L71
 func getRuntime(runtime string) int {
-	if runtime == "containerd" || runtime == "cri-o" {
-		tp := engineType(runtime)
-		return tp.ToCTValue()
+	switch runtime {
+	case "containerd":
+		return typeContainerd.ToCTValue()
+	case "cri-o":
+		return typeCrio.ToCTValue()
+	default:
+		return typeCri.ToCTValue()
 	}
-	return typeCri.ToCTValue()
 }
 
-func newCriEngine(ctx context.Context, socket string) (Engine, error) {
-	client, err := remote.NewRemoteRuntimeService(socket, 5*time.Second, nil, nil)
+// mountPropagation returns the name of a CRI mount propagation mode.
+func mountPropagation(p v1.MountPropagation) string {
+	switch p {
+	case v1.MountPropagation_PROPAGATION_PRIVATE:
+		return "private"
+	case v1.MountPropagation_PROPAGATION_HOST_TO_CONTAINER:
+		return "rslave"
+	case v1.MountPropagation_PROPAGATION_BIDIRECTIONAL:
+		return "rshared"
+	default:
+		return "unknown"
+	}
+}
+
+func newCriEngine(ctx context.Context, cfg *config.Config, log logger.Logger, st *stats.Engine, socket string) (Engine, error) {
+	client, err := newCriClient(socket, func() time.Duration {
+		return cfg.GetTimeouts(string(typeCri)).Request
+	})
 	if err != nil {
 		return nil, err
 	}
 	version, err := client.Version(ctx, "")
 	if err != nil {
+		_ = client.Close()
 		return nil, err
 	}
 	return &criEngine{
 		client:  client,
 		runtime: getRuntime(version.RuntimeName),
+		cfg:     cfg,
+		log:     log,
+		stats:   st,
 		socket:  socket,
 	}, nil
 }
 
 func (c *criEngine) copy(ctx context.Context) (Engine, error) {
-	return newCriEngine(ctx, c.socket)
+	return newCriEngine(ctx, c.cfg, c.log, c.stats, c.socket)
+}
+
+func (c *criEngine) Close() error {
+	return c.client.Close()
 }
 
 // Structures that maps container.Info() map
@@ -189,22 +220,11 @@ func (c *criEngine) ctrToInfo(ctx context.Context, ctr *v1.ContainerStatus, podS
 
 	mounts := make([]event.Mount, 0)
 	for _, m := range ctr.Mounts {
-		var propagation string
-		switch m.Propagation {
-		case v1.MountPropagation_PROPAGATION_PRIVATE:
-			propagation = "private"
-		case v1.MountPropagation_PROPAGATION_HOST_TO_CONTAINER:
-			propagation = "rslave"
-		case v1.MountPropagation_PROPAGATION_BIDIRECTIONAL:
-			propagation = "rshared"
-		default:
-			propagation = "unknown"
-		}
 		mounts = append(mounts, event.Mount{
 			Source:      m.HostPath,
 			Destination: m.ContainerPath,
 			RW:          !m.Readonly,
-			Propagation: propagation,
+			Propagation: mountPropagation(m.Propagation),
 		})
 	}
 
@@ -232,7 +252,7 @@ func (c *criEngine) ctrToInfo(ctx context.Context, ctr *v1.ContainerStatus, podS
 			if cniInfo.CNIResult != nil && cniInfo.CNIResult.Interfaces != nil {
 				ifaces := make([]*CNIInterface, 0)
 				for _, iface := range cniInfo.CNIResult.Interfaces {
-					if iface.Name != "lo" && iface.Name != "veth" {
+					if iface != nil && iface.Name != "lo" && iface.Name != "veth" {
 						ifaces = append(ifaces, iface)
 					}
 				}
@@ -240,8 +260,10 @@ func (c *criEngine) ctrToInfo(ctx context.Context, ctr *v1.ContainerStatus, podS
 				if err != nil {
 					cniJson = string(bytes)
 				}
-			} else if val, ok := cniInfo.RuntimeSpec.Annotations["io.kubernetes.cri-o.CNIResult"]; ok {
-				cniJson = val
+			} else if cniInfo.RuntimeSpec != nil {
+				if val, ok := cniInfo.RuntimeSpec.Annotations["io.kubernetes.cri-o.CNIResult"]; ok {
+					cniJson = val
+				}
 			}
 
 			if len(cniJson) > maxCNILen {
@@ -250,12 +272,7 @@ func (c *criEngine) ctrToInfo(ctx context.Context, ctr *v1.ContainerStatus, podS
 		}
 	}
 
-	labels := make(map[string]string)
-	for key, val := range ctr.Labels {
-		if len(val) <= config.GetLabelMaxLen() {
-			labels[key] = val
-		}
-	}
+	labels := c.cfg.GetLabelPolicy().Filter(ctr.Labels)
 	labels["io.kubernetes.sandbox.id"] = podSandboxID
 	if podSandboxStatus.Metadata != nil {
 		labels["io.kubernetes.pod.uid"] = podSandboxStatus.Metadata.Uid
@@ -263,15 +280,10 @@ func (c *criEngine) ctrToInfo(ctx context.Context, ctr *v1.ContainerStatus, podS
 		labels["io.kubernetes.pod.namespace"] = podSandboxStatus.Metadata.Namespace
 	}
 
-	podSandboxLabels := make(map[string]string)
-	for key, val := range podSandboxStatus.Labels {
-		if len(val) <= config.GetLabelMaxLen() {
-			podSandboxLabels[key] = val
-		}
-	}
+	podSandboxLabels := c.cfg.GetLabelPolicy().FilterPodSandbox(podSandboxStatus.Labels)
 
 	var size int64 = -1
-	if config.GetWithSize() {
+	if c.cfg.GetWithSize() {
 		stats, _ := c.client.ContainerStats(ctx, ctr.Id)
 		if stats != nil {
 			size = int64(stats.GetWritableLayer().GetUsedBytes().GetValue())
@@ -366,10 +378,10 @@ func (c *criEngine) ctrToInfo(ctx context.Context, ctr *v1.ContainerStatus, podS
 			CreatedTime:      nanoSecondsToUnix(ctr.CreatedAt),
 			Env:              ctrInfo.getEnvs(),
 			FullID:           ctr.Id,
-			HostIPC:          podSandboxStatus.Linux.Namespaces.Options.Ipc == v1.NamespaceMode_NODE,
-			HostNetwork:      podSandboxStatus.Linux.Namespaces.Options.Network == v1.NamespaceMode_NODE,
-			HostPID:          podSandboxStatus.Linux.Namespaces.Options.Pid == v1.NamespaceMode_NODE,
-			Ip:               podSandboxStatus.Network.Ip,
+			HostIPC:          podSandboxStatus.GetLinux().GetNamespaces().GetOptions().GetIpc() == v1.NamespaceMode_NODE,
+			HostNetwork:      podSandboxStatus.GetLinux().GetNamespaces().GetOptions().GetNetwork() == v1.NamespaceMode_NODE,
+			HostPID:          podSandboxStatus.GetLinux().GetNamespaces().GetOptions().GetPid() == v1.NamespaceMode_NODE,
+			Ip:               podSandboxStatus.GetNetwork().GetIp(),
 			IsPodSandbox:     isPodSandbox,
 			Labels:           labels,
 			MemoryLimit:      memoryLimit,
@@ -389,21 +401,31 @@ func (c *criEngine) get(ctx context.Context, containerId string) (*event.Event,
 		return nil, err
 	}
 	ctr := ctrs[0]
+	start := time.Now()
 	container, err := c.client.ContainerStatus(ctx, ctr.Id, true)
-	if err == nil {
-		podSandboxStatus, _ := c.client.PodSandboxStatus(ctx, ctr.GetPodSandboxId(), false)
-		if podSandboxStatus == nil {
-			podSandboxStatus = &v1.PodSandboxStatusResponse{}
-		}
-		return &event.Event{
-			IsCreate: true,
-			Info:     c.ctrToInfo(ctx, container.Status, podSandboxStatus.GetStatus(), container.GetInfo(), podSandboxStatus.GetInfo()),
-		}, nil
+	if status.Code(err) == codes.NotFound {
+		// Removed in the meantime
+		c.stats.Inspected(start, nil)
+		return nil, nil
+	}
+	c.stats.Inspected(start, err)
+	if err != nil {
+		c.log.Debugf("failed to get status of container %s: %v", ctr.Id, err)
+		return nil, err
 	}
-	return nil, nil
+	podSandboxStatus, _ := c.client.PodSandboxStatus(ctx, ctr.GetPodSandboxId(), false)
+	if podSandboxStatus == nil {
+		podSandboxStatus = &v1.PodSandboxStatusResponse{}
+	}
+	return &event.Event{
+		IsCreate: true,
+		Info:     c.ctrToInfo(ctx, container.Status, podSandboxStatus.GetStatus(), container.GetInfo(), podSandboxStatus.GetInfo()),
+	}, nil
 }
 
 func (c *criEngine) List(ctx context.Context) ([]event.Event, error) {
+	ctx, cancel := withListTimeout(ctx, c.cfg, typeCri)
+	defer cancel()
 	ctrs, err := c.client.ListContainers(ctx, &v1.ContainerFilter{State: &v1.ContainerStateValue{}})
 	if err != nil {
 		return nil, err
@@ -411,8 +433,12 @@ func (c *criEngine) List(ctx context.Context) ([]event.Event, error) {
 	evts := make([]event.Event, len(ctrs))
 	for idx, ctr := range ctrs {
 		// verbose true to return container.Info
+		start := time.Now()
 		container, err := c.client.ContainerStatus(ctx, ctr.Id, true)
+		c.stats.Inspected(start, err)
 		if err != nil || container.Status == nil {
+			c.log.Warnf("failed to get status of container %s, using minimum set of infos: %v", ctr.Id, err)
+			c.stats.Fallback()
 			evts[idx] = event.Event{
 				IsCreate: true,
 				Info: event.Info{
@@ -422,7 +448,7 @@ func (c *criEngine) List(ctx context.Context) ([]event.Event, error) {
 						FullID:      ctr.Id,
 						ImageID:     ctr.ImageId,
 						CreatedTime: nanoSecondsToUnix(ctr.CreatedAt),
-						Labels:      ctr.Labels,
+						Labels:      c.cfg.GetLabelPolicy().Filter(ctr.Labels),
 					},
 				},
 			}
@@ -440,50 +466,100 @@ func (c *criEngine) List(ctx context.Context) ([]event.Event, error) {
 	return evts, nil
 }
 
+func (c *criEngine) evtToEvent(ctx context.Context, evt *v1.ContainerEventResponse) event.Event {
+	var info event.Info
+	isCreate := evt.ContainerEventType == v1.ContainerEventType_CONTAINER_CREATED_EVENT
+	// verbose true to return container.Info
+	start := time.Now()
+	ctr, err := c.client.ContainerStatus(ctx, evt.ContainerId, true)
+	if isCreate {
+		c.stats.Inspected(start, err)
+	}
+	if err != nil || ctr == nil {
+		if isCreate {
+			c.log.Warnf("failed to get status of container %s, using minimum set of infos: %v", evt.ContainerId, err)
+			c.stats.Fallback()
+		}
+		info = event.Info{
+			Container: event.Container{
+				Type:        c.runtime,
+				ID:          shortContainerID(evt.ContainerId),
+				FullID:      evt.ContainerId,
+				CreatedTime: nanoSecondsToUnix(evt.CreatedAt),
+			},
+		}
+	} else {
+		cPodSandbox := evt.GetPodSandboxStatus()
+		podSandboxStatus, _ := c.client.PodSandboxStatus(ctx, cPodSandbox.GetId(), false)
+		if podSandboxStatus == nil {
+			podSandboxStatus = &v1.PodSandboxStatusResponse{}
+		}
+		info = c.ctrToInfo(ctx, ctr.GetStatus(), cPodSandbox, ctr.GetInfo(), podSandboxStatus.GetInfo())
+	}
+	return event.Event{
+		Info:     info,
+		IsCreate: isCreate,
+	}
+}
+
 func (c *criEngine) Listen(ctx context.Context, wg *sync.WaitGroup) (<-chan event.Event, error) {
 	containerEventsCh := make(chan *v1.ContainerEventResponse)
+	// Notified each time the events stream gets (re)connected
+	connectedCh := make(chan struct{})
 	wg.Add(1)
 	go func() {
 		defer close(containerEventsCh)
 		defer wg.Done()
-		_ = c.client.GetContainerEvents(ctx, containerEventsCh, nil)
+		defer Recover(c.log, c.stats, nil)
+		b := newBackoff()
+		for attempt := 0; ; attempt++ {
+			if attempt > 0 && !b.wait(ctx) {
+				return
+			}
+			err := c.client.GetContainerEvents(ctx, containerEventsCh, func(_ v1.RuntimeService_GetContainerEventsClient) {
+				b.reset()
+				c.stats.SetState(stats.StateConnected)
+				select {
+				case <-ctx.Done():
+				case connectedCh <- struct{}{}:
+				}
+			})
+			if status.Code(err) == codes.Unimplemented {
+				// Evented PLEG not supported by the runtime; no reason to retry.
+				c.log.Infof("container events not supported by the runtime, relying on resync only")
+				return
+			}
+			if ctx.Err() == nil {
+				c.log.Warnf("events stream disconnected: %v", err)
+				c.stats.SetState(stats.StateReconnecting)
+			}
+		}
 	}()
 	outCh := make(chan event.Event)
 	wg.Add(1)
 	go func() {
 		defer close(outCh)
 		defer wg.Done()
+		defer Recover(c.log, c.stats, nil)
+		connections := 0
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case evt := <-containerEventsCh:
+			case <-connectedCh:
+				// Stream reconnected, eg: after a daemon restart.
+				if connections > 0 {
+					relist(ctx, c.log, c, outCh)
+				}
+				connections++
+			case evt, ok := <-containerEventsCh:
+				if !ok {
+					return
+				}
 				if evt.ContainerEventType == v1.ContainerEventType_CONTAINER_CREATED_EVENT ||
 					evt.ContainerEventType == v1.ContainerEventType_CONTAINER_DELETED_EVENT {
-
-					var info event.Info
-					// verbose true to return container.Info
-					ctr, err := c.client.ContainerStatus(ctx, evt.ContainerId, true)
-					if err != nil || ctr == nil {
-						info = event.Info{
-							Container: event.Container{
-								Type:        c.runtime,
-								ID:          shortContainerID(evt.ContainerId),
-								FullID:      evt.ContainerId,
-								CreatedTime: nanoSecondsToUnix(evt.CreatedAt),
-							},
-						}
-					} else {
-						cPodSandbox := evt.GetPodSandboxStatus()
-						podSandboxStatus, _ := c.client.PodSandboxStatus(ctx, cPodSandbox.GetId(), false)
-						if podSandboxStatus == nil {
-							podSandboxStatus = &v1.PodSandboxStatusResponse{}
-						}
-						info = c.ctrToInfo(ctx, ctr.GetStatus(), cPodSandbox, ctr.GetInfo(), podSandboxStatus.GetInfo())
-					}
-					outCh <- event.Event{
-						Info:     info,
-						IsCreate: evt.ContainerEventType == v1.ContainerEventType_CONTAINER_CREATED_EVENT,
+					if !send(ctx, outCh, c.evtToEvent(ctx, evt)) {
+						return
 					}
 				}
 			}
@@ -0,0 +1,133 @@
+package container
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	grpcbackoff "google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials/insecure"
+	v1 "k8s.io/cri-api/pkg/apis/runtime/v1"
+	"k8s.io/cri-client/pkg/util"
+	"time"
+)
+
+const (
+	// Same values used by k8s.io/cri-client
+	criMaxMsgSize           = 1024 * 1024 * 16
+	criMaxBackoffDelay      = 3 * time.Second
+	criBaseBackoffDelay     = 100 * time.Millisecond
+	criMinConnectionTimeout = 5 * time.Second
+)
+
+// criClient is a minimal CRI runtime service client exposing the subset of
+// k8s.io/cri-api/pkg/apis.RuntimeService used by the cri engine.
+// Unlike k8s.io/cri-client, it owns the underlying grpc connection,
+// that can then be closed when the engine gets closed.
+type criClient struct {
+	conn          *grpc.ClientConn
+	runtimeClient v1.RuntimeServiceClient
+	// timeout returns the per-call timeout; it is evaluated on each call
+	// so that it follows config reloads.
+	timeout func() time.Duration
+}
+
+func newCriClient(endpoint string, timeout func() time.Duration) (*criClient, error) {
+	addr, dialer, err := util.GetAddressAndDialer(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	connParams := grpc.ConnectParams{
+		Backoff:           grpcbackoff.DefaultConfig,
+		MinConnectTimeout: criMinConnectionTimeout,
+	}
+	connParams.Backoff.BaseDelay = criBaseBackoffDelay
+	connParams.Backoff.MaxDelay = criMaxBackoffDelay
+	// Passthrough resolver, as grpc.NewClient defaults to dns one
+	conn, err := grpc.NewClient("passthrough:///"+addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithAuthority("localhost"),
+		grpc.WithContextDialer(dialer),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(criMaxMsgSize)),
+		grpc.WithConnectParams(connParams))
+	if err != nil {
+		return nil, err
+	}
+	return &criClient{
+		conn:          conn,
+		runtimeClient: v1.NewRuntimeServiceClient(conn),
+		timeout:       timeout,
+	}, nil
+}
+
+func (c *criClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *criClient) Version(ctx context.Context, apiVersion string) (*v1.VersionResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+	return c.runtimeClient.Version(ctx, &v1.VersionRequest{Version: apiVersion})
+}
+
+func (c *criClient) ListContainers(ctx context.Context, filter *v1.ContainerFilter) ([]*v1.Container, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+	resp, err := c.runtimeClient.ListContainers(ctx, &v1.ListContainersRequest{Filter: filter})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Containers, nil
+}
+
+func (c *criClient) ContainerStatus(ctx context.Context, containerID string, verbose bool) (*v1.ContainerStatusResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+	return c.runtimeClient.ContainerStatus(ctx, &v1.ContainerStatusRequest{
+		ContainerId: containerID,
+		Verbose:     verbose,
+	})
+}
+
+func (c *criClient) PodSandboxStatus(ctx context.Context, podSandboxID string, verbose bool) (*v1.PodSandboxStatusResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+	return c.runtimeClient.PodSandboxStatus(ctx, &v1.PodSandboxStatusRequest{
+		PodSandboxId: podSandboxID,
+		Verbose:      verbose,
+	})
+}
+
+func (c *criClient) ContainerStats(ctx context.Context, containerID string) (*v1.ContainerStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+	resp, err := c.runtimeClient.ContainerStats(ctx, &v1.ContainerStatsRequest{ContainerId: containerID})
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetStats(), nil
+}
+
+// GetContainerEvents streams container events to containerEventsCh until the stream breaks or ctx is done.
+// connectionEstablishedCallback, if any, is called once the stream is established.
+func (c *criClient) GetContainerEvents(ctx context.Context, containerEventsCh chan *v1.ContainerEventResponse,
+	connectionEstablishedCallback func(v1.RuntimeService_GetContainerEventsClient)) error {
+	stream, err := c.runtimeClient.GetContainerEvents(ctx, &v1.GetEventsRequest{})
+	if err != nil {
+		return err
+	}
+	if connectionEstablishedCallback != nil {
+		connectionEstablishedCallback(stream)
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if resp != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case containerEventsCh <- resp:
+			}
+		}
+	}
+}
@@ -3,6 +3,7 @@ package container
 import (
 	"context"
 	"encoding/json"
+	"github.com/FedeDP/container-worker/pkg/config"
 	"github.com/FedeDP/container-worker/pkg/event"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -208,7 +209,7 @@ func TestCRIFake(t *testing.T) {
 	err = fakeRuntime.Start(endpoint)
 	assert.NoError(t, err)
 
-	engine, err := newCriEngine(context.Background(), endpoint)
+	engine, err := newCriEngine(context.Background(), config.New(nil), nil, nil, endpoint)
 	assert.NoError(t, err)
 
 	id := uuid.New()
@@ -307,7 +308,7 @@ func TestCRI(t *testing.T) {
 		t.Skip("Socket "+criSocket+" mandatory to run cri tests:", err.Error())
 	}
 
-	engine, err := newCriEngine(context.Background(), criSocket)
+	engine, err := newCriEngine(context.Background(), config.New(nil), nil, nil, criSocket)
 	assert.NoError(t, err)
 
 	id := uuid.New()
@@ -437,3 +438,25 @@ func TestCRI(t *testing.T) {
 		}
 	}
 }
+
+// FuzzCRICtrToInfo checks that malformed container and sandbox statuses cannot make the engine panic.
+func FuzzCRICtrToInfo(f *testing.F) {
+	f.Add([]byte(`{"id":"ctr","image":{"image":"alpine:3.20.3"},"labels":{"a":"b"}}`), []byte(`{"id":"sandbox"}`), `{"config":{}}`, `{}`)
+	f.Add([]byte(`{"image_ref":"sha256"}`), []byte(`{"linux":{}}`), `{"runtimeSpec":{}}`, `{"runtimeSpec":{"annotations":null}}`)
+	f.Add([]byte(`{"mounts":[{"propagation":7}],"resources":{"linux":{"cpuset_cpus":"1-"}}}`), []byte(`null`), `null`, ``)
+
+	c := &criEngine{cfg: config.New(nil)}
+	f.Fuzz(func(t *testing.T, ctrData, sandboxData []byte, info, sandboxInfo string) {
+		var ctr v1.ContainerStatus
+		if json.Unmarshal(ctrData, &ctr) != nil {
+			t.Skip()
+		}
+		var sandbox *v1.PodSandboxStatus
+		if json.Unmarshal(sandboxData, &sandbox) != nil {
+			t.Skip()
+		}
+		assert.NotPanics(t, func() {
+			c.ctrToInfo(context.Background(), &ctr, sandbox, map[string]string{"info": info}, map[string]string{"info": sandboxInfo})
+		})
+	})
+}
@@ -0,0 +1,313 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/FedeDP/container-worker/pkg/config"
+	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/FedeDP/container-worker/pkg/logger"
+	"github.com/FedeDP/container-worker/pkg/stats"
+	v1 "k8s.io/cri-api/pkg/apis/runtime/v1"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	typeCrio engineType = "crio"
+
+	// Any host works, since requests are sent over the unix socket
+	crioBaseURL = "http://crio"
+
+	crioAnnotationContainerType = "io.kubernetes.cri-o.ContainerType"
+	crioAnnotationImageName     = "io.kubernetes.cri-o.ImageName"
+	crioAnnotationVolumes       = "io.kubernetes.cri-o.Volumes"
+	crioAnnotationHostNetwork   = "io.kubernetes.cri-o.HostNetwork"
+	crioAnnotationCNIResult     = "io.kubernetes.cri-o.CNIResult"
+	crioContainerTypeSandbox    = "sandbox"
+)
+
+func init() {
+	engineGenerators[typeCrio] = newCrioEngine
+}
+
+// crioEngine gets containers from the CRI-O HTTP API, served on its socket.
+// Since that API can neither list containers nor stream events,
+// it only looks up containers on demand, ie: through the fetcher.
+type crioEngine struct {
+	client *http.Client
+	cfg    *config.Config
+	log    logger.Logger
+	stats  *stats.Engine
+	socket string
+}
+
+// crioInfo is the response of the /info endpoint.
+type crioInfo struct {
+	StorageDriver string `json:"storage_driver"`
+	StorageRoot   string `json:"storage_root"`
+	CgroupDriver  string `json:"cgroup_driver"`
+}
+
+// crioContainer is the response of the /containers/{id} endpoint.
+type crioContainer struct {
+	Name            string            `json:"name"`
+	Pid             int               `json:"pid"`
+	Image           string            `json:"image"`
+	ImageRef        string            `json:"image_ref"`
+	CreatedTime     int64             `json:"created_time"`
+	Labels          map[string]string `json:"labels"`
+	Annotations     map[string]string `json:"annotations"`
+	CrioAnnotations map[string]string `json:"crio_annotations"`
+	LogPath         string            `json:"log_path"`
+	Root            string            `json:"root"`
+	Sandbox         string            `json:"sandbox"`
+	IPs             []string          `json:"ip_addresses"`
+}
+
+// crioVolume is an entry of the io.kubernetes.cri-o.Volumes annotation.
+type crioVolume struct {
+	ContainerPath string              `json:"container_path"`
+	HostPath      string              `json:"host_path"`
+	Readonly      bool                `json:"readonly"`
+	Propagation   v1.MountPropagation `json:"propagation"`
+}
+
+// errCrioNotFound is returned by crioEngine.request when the requested resource does not exist.
+var errCrioNotFound = errors.New("not found")
+
+func newCrioEngine(ctx context.Context, cfg *config.Config, log logger.Logger, st *stats.Engine, socket string) (Engine, error) {
+	if isRemoteSocket(socket) {
+		return nil, fmt.Errorf("remote socket %s not supported", socket)
+	}
+	dialer := net.Dialer{Timeout: cfg.GetTimeouts(string(typeCrio)).Connect}
+	c := &crioEngine{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+		cfg:    cfg,
+		log:    log,
+		stats:  st,
+		socket: socket,
+	}
+	// Make sure that CRI-O is actually serving the socket
+	var info crioInfo
+	if err := c.request(ctx, "/info", &info); err != nil {
+		c.client.CloseIdleConnections()
+		return nil, err
+	}
+	log.Debugf("storage driver %s at %s, cgroup driver %s", info.StorageDriver, info.StorageRoot, info.CgroupDriver)
+	return c, nil
+}
+
+func (c *crioEngine) copy(ctx context.Context) (Engine, error) {
+	return newCrioEngine(ctx, c.cfg, c.log, c.stats, c.socket)
+}
+
+func (c *crioEngine) Close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+// request gets path from the CRI-O HTTP API, decoding the JSON response into v.
+func (c *crioEngine) request(ctx context.Context, path string, v any) error {
+	ctx, cancel := withRequestTimeout(ctx, c.cfg, typeCrio)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, crioBaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(resp.Body).Decode(v)
+	case http.StatusNotFound:
+		return errCrioNotFound
+	default:
+		return fmt.Errorf("GET %s: unexpected status %s", path, resp.Status)
+	}
+}
+
+// inspect gets a container, or a pod sandbox, by id.
+func (c *crioEngine) inspect(ctx context.Context, containerId string) (*crioContainer, error) {
+	var ctr crioContainer
+	if err := c.request(ctx, "/containers/"+url.PathEscape(containerId), &ctr); err != nil {
+		return nil, err
+	}
+	return &ctr, nil
+}
+
+// splitImage splits an image name into its repository and tag, if any.
+func splitImage(image string) (string, string) {
+	repo, _, _ := strings.Cut(image, "@")
+	// A colon after the last slash separates the tag, otherwise the registry port
+	if idx := strings.LastIndex(repo, ":"); idx > strings.LastIndex(repo, "/") {
+		return repo[:idx], repo[idx+1:]
+	}
+	return repo, ""
+}
+
+// ctrToInfo converts a CRI-O container; sandbox is its pod sandbox, nil if unknown.
+func (c *crioEngine) ctrToInfo(fullID string, ctr, sandbox *crioContainer) event.Info {
+	isPodSandbox := ctr.CrioAnnotations[crioAnnotationContainerType] == crioContainerTypeSandbox
+	if isPodSandbox {
+		sandbox = ctr
+	}
+	if sandbox == nil {
+		sandbox = &crioContainer{}
+	}
+
+	imageName := ctr.Image
+	if name, ok := ctr.CrioAnnotations[crioAnnotationImageName]; ok && name != "" {
+		imageName = name
+	}
+	imageRepo, imageTag := splitImage(imageName)
+	// image_ref is either host/image@sha256:digest or the image id
+	var imageID, imageDigest string
+	if _, digest, ok := strings.Cut(ctr.ImageRef, "@"); ok {
+		imageDigest = digest
+	} else {
+		imageID = strings.TrimPrefix(ctr.ImageRef, "sha256:")
+	}
+
+	mounts := make([]event.Mount, 0)
+	if volumes, ok := ctr.CrioAnnotations[crioAnnotationVolumes]; ok {
+		var vols []crioVolume
+		if err := json.Unmarshal([]byte(volumes), &vols); err != nil {
+			c.log.Debugf("failed to decode volumes of container %s: %v", fullID, err)
+		}
+		for _, vol := range vols {
+			mounts = append(mounts, event.Mount{
+				Source:      vol.HostPath,
+				Destination: vol.ContainerPath,
+				RW:          !vol.Readonly,
+				Propagation: mountPropagation(vol.Propagation),
+			})
+		}
+	}
+
+	ip := ""
+	if len(ctr.IPs) > 0 {
+		ip = ctr.IPs[0]
+	} else if len(sandbox.IPs) > 0 {
+		ip = sandbox.IPs[0]
+	}
+
+	cniJson := sandbox.CrioAnnotations[crioAnnotationCNIResult]
+	if len(cniJson) > maxCNILen {
+		cniJson = cniJson[:maxCNILen]
+	}
+
+	// Same names as the CRI metadata ones, rather than the CRI-O internal one
+	name := ctr.Labels["io.kubernetes.container.name"]
+	if isPodSandbox {
+		name = ctr.Labels["io.kubernetes.pod.name"]
+	}
+	if name == "" {
+		name = ctr.Name
+	}
+
+	podSandboxID := ctr.Sandbox
+	if podSandboxID == "" {
+		podSandboxID = fullID
+	}
+	labels := c.cfg.GetLabelPolicy().Filter(ctr.Labels)
+	labels["io.kubernetes.sandbox.id"] = podSandboxID
+
+	return event.Info{
+		Container: event.Container{
+			Type:             typeCrio.ToCTValue(),
+			ID:               shortContainerID(fullID),
+			Name:             name,
+			Image:            imageName,
+			ImageDigest:      imageDigest,
+			ImageID:          imageID,
+			ImageRepo:        imageRepo,
+			ImageTag:         imageTag,
+			CniJson:          cniJson,
+			CPUPeriod:        defaultCpuPeriod,
+			CPUShares:        defaultCpuShares,
+			CreatedTime:      nanoSecondsToUnix(ctr.CreatedTime),
+			FullID:           fullID,
+			HostNetwork:      sandbox.CrioAnnotations[crioAnnotationHostNetwork] == "true",
+			Ip:               ip,
+			IsPodSandbox:     isPodSandbox,
+			Labels:           labels,
+			PodSandboxID:     podSandboxID,
+			PodSandboxLabels: c.cfg.GetLabelPolicy().FilterPodSandbox(sandbox.Labels),
+			Mounts:           mounts,
+			Size:             -1,
+		},
+	}
+}
+
+// getRequest gets the requested container by its full id, resolved from the request cgroup,
+// since the CRI-O HTTP API only knows full ids.
+func (c *crioEngine) getRequest(ctx context.Context, req Request) (*event.Event, error) {
+	containerId := req.ContainerID
+	if fullID, ok := fullContainerID(req.Cgroup, typeCrio, containerId); ok {
+		containerId = fullID
+	}
+	return c.get(ctx, containerId)
+}
+
+// get gets a container, or a pod sandbox, by its full id.
+func (c *crioEngine) get(ctx context.Context, containerId string) (*event.Event, error) {
+	start := time.Now()
+	ctr, err := c.inspect(ctx, containerId)
+	if errors.Is(err, errCrioNotFound) {
+		// Not a failure: engines are asked for containers run by other engines too
+		c.stats.Inspected(start, nil)
+		return nil, nil
+	}
+	c.stats.Inspected(start, err)
+	if err != nil {
+		c.log.Debugf("failed to inspect container %s: %v", containerId, err)
+		return nil, err
+	}
+	fullID := containerId
+	var sandbox *crioContainer
+	if ctr.Sandbox != "" && ctr.Sandbox != fullID {
+		// Best effort: only pod sandbox infos are missing
+		if sandbox, err = c.inspect(ctx, ctr.Sandbox); err != nil {
+			c.log.Debugf("failed to inspect pod sandbox %s: %v", ctr.Sandbox, err)
+		}
+	}
+	return &event.Event{
+		IsCreate: true,
+		Info:     c.ctrToInfo(fullID, ctr, sandbox),
+	}, nil
+}
+
+// List returns no containers, since the CRI-O HTTP API cannot list them.
+func (c *crioEngine) List(_ context.Context) ([]event.Event, error) {
+	return []event.Event{}, nil
+}
+
+// Listen never sends events, since the CRI-O HTTP API does not stream them;
+// the returned channel is closed once ctx is done.
+func (c *crioEngine) Listen(ctx context.Context, wg *sync.WaitGroup) (<-chan event.Event, error) {
+	outCh := make(chan event.Event)
+	c.stats.SetState(stats.StateConnected)
+	wg.Add(1)
+	go func() {
+		defer close(outCh)
+		defer wg.Done()
+		defer Recover(c.log, c.stats, nil)
+		<-ctx.Done()
+	}()
+	return outCh, nil
+}
@@ -0,0 +1,271 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/FedeDP/container-worker/pkg/config"
+	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/FedeDP/container-worker/pkg/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testCrioSandboxID   = "5e1a7f3b9c2d4e6f8a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f"
+	testCrioContainerID = "8a9b0c1d2e3f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b"
+)
+
+// newCrioStandIn serves the CRI-O HTTP API on a unix socket, with a nginx pod, returning the socket path.
+func newCrioStandIn(t *testing.T) string {
+	// Unix socket paths are short
+	dir, err := os.MkdirTemp("", "crio")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "crio.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	podLabels := map[string]string{
+		"app":                          "nginx",
+		"io.kubernetes.pod.name":       "nginx",
+		"io.kubernetes.pod.namespace":  "default",
+		"io.kubernetes.pod.uid":        "0c1d2e3f",
+		"io.kubernetes.container.name": "POD",
+	}
+	ctrs := map[string]crioContainer{
+		testCrioSandboxID: {
+			Name:        "k8s_POD_nginx_default_0c1d2e3f_0",
+			Image:       "registry.k8s.io/pause:3.9",
+			CreatedTime: 1730977803000000000,
+			Labels:      podLabels,
+			CrioAnnotations: map[string]string{
+				"io.kubernetes.cri-o.ContainerID": testCrioSandboxID,
+				crioAnnotationContainerType:       crioContainerTypeSandbox,
+				crioAnnotationHostNetwork:         "false",
+				crioAnnotationCNIResult:           `{"interfaces":[{"name":"eth0"}]}`,
+			},
+			Sandbox: testCrioSandboxID,
+			IPs:     []string{"10.88.0.7"},
+		},
+		testCrioContainerID: {
+			Name:        "k8s_nginx_nginx_default_0c1d2e3f_0",
+			Pid:         4242,
+			Image:       "docker.io/library/nginx:1.27",
+			ImageRef:    "docker.io/library/nginx@sha256:b9ff6f23cceb5bde20bb1f79b492b98d71ef7a7ae518ca1b15b26661a11e6a94",
+			CreatedTime: 1730977804000000000,
+			Labels: map[string]string{
+				"io.kubernetes.container.name": "nginx",
+				"io.kubernetes.pod.name":       "nginx",
+				"io.kubernetes.pod.namespace":  "default",
+				"io.kubernetes.pod.uid":        "0c1d2e3f",
+			},
+			CrioAnnotations: map[string]string{
+				"io.kubernetes.cri-o.ContainerID": testCrioContainerID,
+				crioAnnotationContainerType:       "container",
+				crioAnnotationImageName:           "docker.io/library/nginx:1.27",
+				crioAnnotationVolumes:             `[{"container_path":"/etc/hosts","host_path":"/var/lib/kubelet/pods/0c1d2e3f/etc-hosts","readonly":false,"propagation":0},{"container_path":"/data","host_path":"/mnt/data","readonly":true,"propagation":1}]`,
+			},
+			LogPath: "/var/log/pods/default_nginx_0c1d2e3f/nginx/0.log",
+			Root:    "/var/lib/containers/storage/overlay/8a9b0c1d/merged",
+			Sandbox: testCrioSandboxID,
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /info", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(crioInfo{StorageDriver: "overlay", StorageRoot: "/var/lib/containers/storage", CgroupDriver: "systemd"})
+	})
+	mux.HandleFunc("GET /containers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") == "broken" {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if ctr, ok := ctrs[r.PathValue("id")]; ok {
+			_ = json.NewEncoder(w).Encode(ctr)
+			return
+		}
+		http.Error(w, "can't find the container with id "+r.PathValue("id"), http.StatusNotFound)
+	})
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return socket
+}
+
+func TestCrioEngineGet(t *testing.T) {
+	socket := newCrioStandIn(t)
+	cfg := config.New(nil)
+	require.NoError(t, cfg.Load(`{"labels": {"pod_sandbox_exclude": ["io.kubernetes.container.name"]}}`))
+	engine, err := newCrioEngine(context.Background(), cfg, nil, nil, socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = engine.Close() })
+	podSandboxLabels := map[string]string{
+		"app":                         "nginx",
+		"io.kubernetes.pod.name":      "nginx",
+		"io.kubernetes.pod.namespace": "default",
+		"io.kubernetes.pod.uid":       "0c1d2e3f",
+	}
+
+	evt, err := engine.(getter).get(context.Background(), testCrioContainerID)
+	require.NoError(t, err)
+	require.NotNil(t, evt)
+	assert.Equal(t, event.Event{
+		IsCreate: true,
+		Info: event.Info{Container: event.Container{
+			Type:        typeCrio.ToCTValue(),
+			ID:          shortContainerID(testCrioContainerID),
+			Name:        "nginx",
+			Image:       "docker.io/library/nginx:1.27",
+			ImageDigest: "sha256:b9ff6f23cceb5bde20bb1f79b492b98d71ef7a7ae518ca1b15b26661a11e6a94",
+			ImageRepo:   "docker.io/library/nginx",
+			ImageTag:    "1.27",
+			CniJson:     `{"interfaces":[{"name":"eth0"}]}`,
+			CPUPeriod:   defaultCpuPeriod,
+			CPUShares:   defaultCpuShares,
+			CreatedTime: 1730977804,
+			FullID:      testCrioContainerID,
+			Ip:          "10.88.0.7",
+			Labels: map[string]string{
+				"io.kubernetes.container.name": "nginx",
+				"io.kubernetes.pod.name":       "nginx",
+				"io.kubernetes.pod.namespace":  "default",
+				"io.kubernetes.pod.uid":        "0c1d2e3f",
+				"io.kubernetes.sandbox.id":     testCrioSandboxID,
+			},
+			PodSandboxID:     testCrioSandboxID,
+			PodSandboxLabels: podSandboxLabels,
+			Mounts: []event.Mount{
+				{Source: "/var/lib/kubelet/pods/0c1d2e3f/etc-hosts", Destination: "/etc/hosts", RW: true, Propagation: "private"},
+				{Source: "/mnt/data", Destination: "/data", RW: false, Propagation: "rslave"},
+			},
+			Size: -1,
+		}},
+	}, *evt)
+
+	evt, err = engine.(getter).get(context.Background(), testCrioSandboxID)
+	require.NoError(t, err)
+	require.NotNil(t, evt)
+	assert.True(t, evt.IsPodSandbox)
+	assert.Equal(t, "nginx", evt.Name)
+	assert.Equal(t, "registry.k8s.io/pause", evt.ImageRepo)
+	assert.Equal(t, podSandboxLabels, evt.PodSandboxLabels)
+	assert.Equal(t, "10.88.0.7", evt.Ip)
+
+	// Unknown containers are just missed
+	evt, err = engine.(getter).get(context.Background(), "unknown")
+	assert.NoError(t, err)
+	assert.Nil(t, evt)
+
+	// Short ids are resolved to full ones through the request cgroup
+	cgroup := "/kubepods.slice/kubepods-pod0c1d2e3f.slice/crio-" + testCrioContainerID + ".scope"
+	evt, err = engine.(requestGetter).getRequest(context.Background(), Request{ContainerID: shortContainerID(testCrioContainerID), Cgroup: cgroup})
+	require.NoError(t, err)
+	require.NotNil(t, evt)
+	assert.Equal(t, testCrioContainerID, evt.FullID)
+
+	// Without it, they are missed
+	evt, err = engine.(requestGetter).getRequest(context.Background(), NewRequest(shortContainerID(testCrioContainerID)))
+	assert.NoError(t, err)
+	assert.Nil(t, evt)
+}
+
+func TestCrioEngineInspectStats(t *testing.T) {
+	socket := newCrioStandIn(t)
+	r := stats.NewRegistry()
+	engine, err := newCrioEngine(context.Background(), config.New(nil), nil, r.Engine("crio"), socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = engine.Close() })
+
+	// Containers not run by CRI-O are just missed
+	_, err = engine.(getter).get(context.Background(), testCrioContainerID)
+	require.NoError(t, err)
+	evt, err := engine.(getter).get(context.Background(), "unknown")
+	require.NoError(t, err)
+	assert.Nil(t, evt)
+	assert.Zero(t, r.Snapshot().Engines["crio"].InspectFailures)
+
+	_, err = engine.(getter).get(context.Background(), "broken")
+	assert.Error(t, err)
+	assert.Equal(t, uint64(1), r.Snapshot().Engines["crio"].InspectFailures)
+}
+
+func TestCrioEngineListen(t *testing.T) {
+	socket := newCrioStandIn(t)
+	engine, err := newCrioEngine(context.Background(), config.New(nil), nil, nil, socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = engine.Close() })
+
+	// Containers can only be looked up on demand
+	evts, err := engine.List(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, evts)
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := engine.Listen(ctx, &wg)
+	require.NoError(t, err)
+	cancel()
+	wg.Wait()
+	_, ok := <-ch
+	assert.False(t, ok)
+}
+
+func TestCrioEngineFetcher(t *testing.T) {
+	socket := newCrioStandIn(t)
+	cfg := config.New(nil)
+	engine, err := newCrioEngine(context.Background(), cfg, nil, nil, socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = engine.Close() })
+
+	queue := NewRequestQueue(cfg, nil)
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	f := NewFetcherEngine(ctx, map[EngineID]Engine{{Type: string(typeCrio), Socket: socket}: engine}, queue, cfg, nil, nil)
+	t.Cleanup(func() { _ = f.Close() })
+	ch, err := f.Listen(ctx, &wg)
+	require.NoError(t, err)
+
+	// As detected from a crio-<id>.scope cgroup
+	cgroup := "/kubepods.slice/kubepods-pod0c1d2e3f.slice/crio-" + testCrioContainerID + ".scope"
+	m, ok := MatchCgroup(cgroup)
+	require.True(t, ok)
+	queue.Push(m.Request(cgroup, 4242))
+	select {
+	case evt := <-ch:
+		assert.Equal(t, testCrioContainerID, evt.FullID)
+		assert.Equal(t, typeCrio.ToCTValue(), evt.Type)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the container")
+	}
+}
+
+func TestCrioEngineNotCrio(t *testing.T) {
+	dir, err := os.MkdirTemp("", "crio")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "other.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	_, err = newCrioEngine(context.Background(), config.New(nil), nil, nil, socket)
+	assert.Error(t, err)
+	_, err = newCrioEngine(context.Background(), config.New(nil), nil, nil, "tcp://127.0.0.1:10010")
+	assert.Error(t, err)
+}
@@ -6,11 +6,15 @@ import (
 	"errors"
 	"github.com/FedeDP/container-worker/pkg/config"
 	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/FedeDP/container-worker/pkg/logger"
+	"github.com/FedeDP/container-worker/pkg/stats"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
@@ -27,21 +31,42 @@ func init() {
 
 type dockerEngine struct {
 	*client.Client
+	cfg    *config.Config
+	log    logger.Logger
+	stats  *stats.Engine
 	socket string
 }
 
-func newDockerEngine(_ context.Context, socket string) (Engine, error) {
-	cl, err := client.NewClientWithOpts(client.FromEnv,
-		client.WithAPIVersionNegotiation(),
-		client.WithHost(enforceUnixProtocolIfEmpty(socket)))
+func newDockerEngine(_ context.Context, cfg *config.Config, log logger.Logger, st *stats.Engine, socket string) (Engine, error) {
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if isRemoteSocket(socket) {
+		tlsCfg, err := newTLSConfig(cfg, typeDocker)
+		if err != nil {
+			return nil, err
+		}
+		if tlsCfg != nil {
+			// The client talks https once its transport has a TLS config;
+			// keep the default proxy, dial and idle connections settings.
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = tlsCfg
+			opts = append(opts, client.WithHTTPClient(&http.Client{Transport: transport}))
+		}
+	}
+	// Must follow WithHTTPClient, since it configures the client transport
+	opts = append(opts, client.WithHost(enforceUnixProtocolIfEmpty(socket)))
+	cl, err := client.NewClientWithOpts(opts...)
 	if err != nil {
 		return nil, err
 	}
-	return &dockerEngine{Client: cl, socket: socket}, nil
+	return &dockerEngine{Client: cl, cfg: cfg, log: log, stats: st, socket: socket}, nil
 }
 
 func (dc *dockerEngine) copy(ctx context.Context) (Engine, error) {
-	return newDockerEngine(ctx, dc.socket)
+	return newDockerEngine(ctx, dc.cfg, dc.log, dc.stats, dc.socket)
+}
+
+func (dc *dockerEngine) Close() error {
+	return dc.Client.Close()
 }
 
 type Probe struct {
@@ -72,7 +97,7 @@ func normalizeArg(val string) string {
 }
 
 func parseLivenessReadinessProbe(probe *Probe) *event.Probe {
-	if probe == nil || probe.Exec == nil || probe.Exec.Command == nil {
+	if probe == nil || probe.Exec == nil || len(probe.Exec.Command) == 0 {
 		return nil
 	}
 	p := event.Probe{}
@@ -106,6 +131,9 @@ func parseHealthcheckProbe(hcheck *container.HealthConfig) *event.Probe {
 }
 
 func (dc *dockerEngine) ctrToInfo(ctx context.Context, ctr types.ContainerJSON) event.Info {
+	if ctr.ContainerJSONBase == nil {
+		ctr.ContainerJSONBase = &types.ContainerJSONBase{}
+	}
 	hostCfg := ctr.HostConfig
 	if hostCfg == nil {
 		hostCfg = &container.HostConfig{
@@ -154,8 +182,11 @@ func (dc *dockerEngine) ctrToInfo(ctx context.Context, ctr types.ContainerJSON)
 		cfg = &container.Config{}
 	}
 
-	image, _, err := dc.ImageInspectWithRaw(ctx, ctr.Image)
+	imageCtx, cancel := withRequestTimeout(ctx, dc.cfg, typeDocker)
+	image, _, err := dc.ImageInspectWithRaw(imageCtx, ctr.Image)
+	cancel()
 	if err != nil {
+		dc.log.Debugf("failed to inspect image %s of container %s: %v", ctr.Image, ctr.ID, err)
 		image = types.ImageInspect{}
 	}
 
@@ -206,20 +237,17 @@ func (dc *dockerEngine) ctrToInfo(ctx context.Context, ctr types.ContainerJSON)
 		imageID = strings.Split(img, ":")[1]
 	}
 
-	labels := make(map[string]string)
+	labels := dc.cfg.GetLabelPolicy().Filter(cfg.Labels)
 	var (
 		livenessProbe    *event.Probe = nil
 		readinessProbe   *event.Probe = nil
 		healthcheckProbe *event.Probe = nil
 	)
 	for key, val := range cfg.Labels {
-		if len(val) <= config.GetLabelMaxLen() {
-			labels[key] = val
-		}
 		if key == k8sLastAppliedConfigLabel {
 			var k8sPodInfo k8sPodSpecInfo
 			err = json.Unmarshal([]byte(val), &k8sPodInfo)
-			if err == nil {
+			if err == nil && k8sPodInfo.Spec != nil && len(k8sPodInfo.Spec.Containers) > 0 {
 				if k8sPodInfo.Spec.Containers[0].LivenessProbe != nil {
 					livenessProbe = parseLivenessReadinessProbe(k8sPodInfo.Spec.Containers[0].LivenessProbe)
 				} else if k8sPodInfo.Spec.Containers[0].ReadinessProbe != nil {
@@ -236,7 +264,9 @@ func (dc *dockerEngine) ctrToInfo(ctx context.Context, ctr types.ContainerJSON)
 	if ip == "" {
 		if hostCfg.NetworkMode.IsContainer() {
 			secondaryID := hostCfg.NetworkMode.ConnectedContainer()
-			secondary, _ := dc.ContainerInspect(ctx, secondaryID)
+			secondaryCtx, cancel := withRequestTimeout(ctx, dc.cfg, typeDocker)
+			secondary, _ := dc.ContainerInspect(secondaryCtx, secondaryID)
+			cancel()
 			if secondary.NetworkSettings != nil {
 				ip = secondary.NetworkSettings.IPAddress
 			}
@@ -299,9 +329,28 @@ func (dc *dockerEngine) ctrToInfo(ctx context.Context, ctr types.ContainerJSON)
 	}
 }
 
+// inspect inspects a container, accounting for the request in stats.
+func (dc *dockerEngine) inspect(ctx context.Context, containerId string) (types.ContainerJSON, error) {
+	ctx, cancel := withRequestTimeout(ctx, dc.cfg, typeDocker)
+	defer cancel()
+	start := time.Now()
+	ctrJson, _, err := dc.ContainerInspectWithRaw(ctx, containerId, dc.cfg.GetWithSize())
+	failure := err
+	if errdefs.IsNotFound(err) {
+		// Not a failure: engines are asked for containers run by other engines too
+		failure = nil
+	}
+	dc.stats.Inspected(start, failure)
+	return ctrJson, err
+}
+
 func (dc *dockerEngine) get(ctx context.Context, containerId string) (*event.Event, error) {
-	ctrJson, _, err := dc.ContainerInspectWithRaw(ctx, containerId, config.GetWithSize())
+	ctrJson, err := dc.inspect(ctx, containerId)
+	if errdefs.IsNotFound(err) {
+		return nil, nil
+	}
 	if err != nil {
+		dc.log.Debugf("failed to inspect container %s: %v", containerId, err)
 		return nil, err
 	}
 	return &event.Event{
@@ -311,15 +360,21 @@ func (dc *dockerEngine) get(ctx context.Context, containerId string) (*event.Eve
 }
 
 func (dc *dockerEngine) List(ctx context.Context) ([]event.Event, error) {
-	containers, err := dc.ContainerList(ctx, container.ListOptions{All: true})
+	ctx, cancel := withListTimeout(ctx, dc.cfg, typeDocker)
+	defer cancel()
+	listCtx, listCancel := withRequestTimeout(ctx, dc.cfg, typeDocker)
+	containers, err := dc.ContainerList(listCtx, container.ListOptions{All: true})
+	listCancel()
 	if err != nil {
 		return nil, err
 	}
 
 	evts := make([]event.Event, len(containers))
 	for idx, ctr := range containers {
-		ctrJson, _, err := dc.ContainerInspectWithRaw(ctx, ctr.ID, config.GetWithSize())
+		ctrJson, err := dc.inspect(ctx, ctr.ID)
 		if err != nil {
+			dc.log.Warnf("failed to inspect container %s, using minimum set of infos: %v", ctr.ID, err)
+			dc.stats.Fallback()
 			// Minimum set of infos
 			evts[idx] = event.Event{
 				Info: event.Info{
@@ -334,6 +389,7 @@ func (dc *dockerEngine) List(ctx context.Context) ([]event.Event, error) {
 				},
 				IsCreate: true,
 			}
+			continue
 		}
 		evts[idx] = event.Event{
 			IsCreate: true,
@@ -343,6 +399,36 @@ func (dc *dockerEngine) List(ctx context.Context) ([]event.Event, error) {
 	return evts, nil
 }
 
+func (dc *dockerEngine) msgToEvent(ctx context.Context, msg events.Message) event.Event {
+	err := errors.New("inspect useless on action destroy")
+	ctrJson := types.ContainerJSON{}
+	if msg.Action == events.ActionCreate {
+		ctrJson, err = dc.inspect(ctx, msg.Actor.ID)
+	}
+	if err != nil {
+		if msg.Action == events.ActionCreate {
+			dc.log.Warnf("failed to inspect container %s, using minimum set of infos: %v", msg.Actor.ID, err)
+			dc.stats.Fallback()
+		}
+		// At least send an event with the minimum set of data
+		return event.Event{
+			Info: event.Info{
+				Container: event.Container{
+					Type:   typeDocker.ToCTValue(),
+					ID:     shortContainerID(msg.Actor.ID),
+					FullID: msg.Actor.ID,
+					Image:  msg.Actor.Attributes["image"],
+				},
+			},
+			IsCreate: msg.Action == events.ActionCreate,
+		}
+	}
+	return event.Event{
+		Info:     dc.ctrToInfo(ctx, ctrJson),
+		IsCreate: msg.Action == events.ActionCreate,
+	}
+}
+
 func (dc *dockerEngine) Listen(ctx context.Context, wg *sync.WaitGroup) (<-chan event.Event, error) {
 	outCh := make(chan event.Event)
 
@@ -350,42 +436,53 @@ func (dc *dockerEngine) Listen(ctx context.Context, wg *sync.WaitGroup) (<-chan
 	flts.Add("type", string(events.ContainerEventType))
 	flts.Add("event", string(events.ActionCreate))
 	flts.Add("event", string(events.ActionDestroy))
-	msgs, _ := dc.Events(ctx, events.ListOptions{Filters: flts})
 	wg.Add(1)
 	go func() {
 		defer close(outCh)
 		defer wg.Done()
-		for {
-			select {
-			case <-ctx.Done():
+		defer Recover(dc.log, dc.stats, nil)
+		b := newBackoff()
+		for attempt := 0; ; attempt++ {
+			if attempt > 0 && !b.wait(ctx) {
+				return
+			}
+			// Subscribe before listing, so that no event gets lost in between
+			msgs, errs := dc.Events(ctx, events.ListOptions{Filters: flts})
+			if attempt > 0 {
+				relist(ctx, dc.log, dc, outCh)
+			}
+			h := newStreamHealth(listenHealthyAfter, b, dc.stats)
+			done := dc.consume(ctx, msgs, errs, h, outCh)
+			h.stop()
+			if done {
 				return
-			case msg := <-msgs:
-				err := errors.New("inspect useless on action destroy")
-				ctrJson := types.ContainerJSON{}
-				if msg.Action == events.ActionCreate {
-					ctrJson, _, err = dc.ContainerInspectWithRaw(ctx, msg.Actor.ID, config.GetWithSize())
-				}
-				if err != nil {
-					// At least send an event with the minimum set of data
-					outCh <- event.Event{
-						Info: event.Info{
-							Container: event.Container{
-								Type:   typeDocker.ToCTValue(),
-								ID:     shortContainerID(msg.Actor.ID),
-								FullID: msg.Actor.ID,
-								Image:  msg.Actor.Attributes["image"],
-							},
-						},
-						IsCreate: msg.Action == events.ActionCreate,
-					}
-				} else {
-					outCh <- event.Event{
-						Info:     dc.ctrToInfo(ctx, ctrJson),
-						IsCreate: msg.Action == events.ActionCreate,
-					}
-				}
 			}
 		}
 	}()
 	return outCh, nil
 }
+
+// consume forwards events from msgs to outCh until either the stream
+// reports an error or ctx is done; in the latter case, it returns true.
+func (dc *dockerEngine) consume(ctx context.Context, msgs <-chan events.Message, errs <-chan error, h *streamHealth, outCh chan<- event.Event) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return true
+		case <-h.C():
+			h.healthy()
+		case err := <-errs:
+			if ctx.Err() != nil {
+				return true
+			}
+			// Stream broken, eg: daemon restarted; reconnect.
+			dc.log.Warnf("events stream disconnected: %v", err)
+			dc.stats.SetState(stats.StateReconnecting)
+			return false
+		case msg := <-msgs:
+			if !send(ctx, outCh, dc.msgToEvent(ctx, msg)) {
+				return true
+			}
+		}
+	}
+}
@@ -2,11 +2,15 @@ package container
 
 import (
 	"context"
+	"encoding/json"
+	"github.com/FedeDP/container-worker/pkg/config"
 	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"io"
 	"runtime"
 	"sync"
@@ -20,7 +24,7 @@ func TestDocker(t *testing.T) {
 		t.Skip("Socket "+client.DefaultDockerHost+" mandatory to run docker tests:", err.Error())
 	}
 
-	engine, err := newDockerEngine(context.Background(), client.DefaultDockerHost)
+	engine, err := newDockerEngine(context.Background(), config.New(nil), nil, nil, client.DefaultDockerHost)
 	assert.NoError(t, err)
 
 	if _, _, err = dockerClient.ImageInspectWithRaw(context.Background(), "alpine:3.20.3"); client.IsErrNotFound(err) {
@@ -126,3 +130,25 @@ func TestDocker(t *testing.T) {
 	evt := waitOnChannelOrTimeout(t, listCh)
 	assert.Equal(t, expectedEvent, evt)
 }
+
+// FuzzDockerCtrToInfo checks that malformed inspect responses cannot make the engine panic.
+func FuzzDockerCtrToInfo(f *testing.F) {
+	f.Add([]byte(`{"Id":"ctr","Name":"/k8s_POD_test","Config":{"Labels":{"io.kubernetes.container.last-applied-config":"{\"spec\":{\"containers\":[]}}"}}}`))
+	f.Add([]byte(`{"Config":{"Labels":{"io.kubernetes.container.last-applied-config":"{}"},"Healthcheck":{"Test":["CMD"]}}}`))
+	f.Add([]byte(`{"Config":{"Labels":{"io.kubernetes.container.last-applied-config":"{\"spec\":{\"containers\":[{\"livenessProbe\":{\"exec\":{\"command\":[]}}}]}}"}}}`))
+	f.Add([]byte(`{"HostConfig":{"NetworkMode":"container:"},"NetworkSettings":{"Ports":{"80/tcp":null}}}`))
+
+	// Unreachable daemon: secondary inspects fail fast
+	engine, err := newDockerEngine(context.Background(), config.New(nil), nil, nil, "unix:///nonexistent/docker.sock")
+	require.NoError(f, err)
+	dc := engine.(*dockerEngine)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var ctr types.ContainerJSON
+		if json.Unmarshal(data, &ctr) != nil {
+			t.Skip()
+		}
+		assert.NotPanics(t, func() {
+			dc.ctrToInfo(context.Background(), ctr)
+		})
+	})
+}
@@ -2,12 +2,14 @@ package container
 
 import (
 	"context"
+	"fmt"
 	"github.com/FedeDP/container-worker/pkg/config"
 	"github.com/FedeDP/container-worker/pkg/event"
-	"github.com/fsnotify/fsnotify"
+	"github.com/FedeDP/container-worker/pkg/logger"
+	"github.com/FedeDP/container-worker/pkg/stats"
 	"net/url"
-	"os"
 	"path/filepath"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,6 +22,13 @@ const (
 	//https://github.com/falcosecurity/libs/blob/39c0e0dcb9d1d23e46b13f4963a9a7106db1f650/userspace/libsinsp/container_info.h#L218
 	defaultCpuPeriod = 100000
 	defaultCpuShares = 1024
+	// Bounds of the exponential backoff used by listeners to reconnect to broken event streams
+	listenMinBackoff = 500 * time.Millisecond
+	listenMaxBackoff = 30 * time.Second
+	// How long an events stream must stay up before being deemed healthy
+	listenHealthyAfter = 5 * time.Second
+	// CT_UNKNOWN, see src/container_type.h
+	ctUnknown = 0xffff
 )
 
 type engineType string
@@ -39,24 +48,83 @@ func (t engineType) ToCTValue() int {
 	case typeCrio:
 		return 8
 	default:
-		return 0xffff // unknown
+		return ctUnknown
 	}
 }
 
-type engineGenerator func(context.Context, string) (Engine, error)
+// engineTypesForCT returns the types of the engines able to get a container
+// whose type, as detected by the plugin from its cgroup, is ct; nil if unknown.
+// Types are grouped in tiers: engines of a tier are only asked if the ones of the previous tiers missed it.
+func engineTypesForCT(ct int) [][]engineType {
+	switch ct {
+	case typeDocker.ToCTValue():
+		return [][]engineType{{typeDocker}}
+	case typePodman.ToCTValue():
+		return [][]engineType{{typePodman}}
+	case typeCri.ToCTValue(), typeCrio.ToCTValue():
+		// The plugin detects CRI-O containers as cri ones, and crio is only a fallback
+		return [][]engineType{{typeCri}, {typeCrio}}
+	case typeContainerd.ToCTValue():
+		// Kubernetes containers are run by containerd too
+		return [][]engineType{{typeContainerd, typeCri}}
+	default:
+		return nil
+	}
+}
+
+// isFallbackType tells whether engines of type t are asked for a container only once all the others missed it,
+// unless they match its type; the CRI-O HTTP API misses many infos, eg: env and limits.
+func isFallbackType(t engineType) bool {
+	return t == typeCrio
+}
+
+type engineGenerator func(context.Context, *config.Config, logger.Logger, *stats.Engine, string) (Engine, error)
 type EngineGenerator func(ctx context.Context) (Engine, error)
 
+// EngineID uniquely identifies an engine through its type and socket,
+// since the same socket may be used by multiple engines, eg: containerd and cri.
+type EngineID struct {
+	Type   string
+	Socket string
+}
+
+func (id EngineID) String() string {
+	return id.Type + "@" + id.Socket
+}
+
+// IsRemote tells whether the engine is reached through a tcp:// endpoint rather than a socket file,
+// that cannot be watched for creation and removal.
+func (id EngineID) IsRemote() bool {
+	return isRemoteSocket(id.Socket)
+}
+
+func isRemoteSocket(socket string) bool {
+	return strings.HasPrefix(socket, "tcp://")
+}
+
+// hostSocket returns the socket file path of local sockets, accounting for the HOST_ROOT env variable;
+// remote endpoints are returned as is.
+func hostSocket(hostRoot, socket string) string {
+	if isRemoteSocket(socket) {
+		return socket
+	}
+	socket = strings.TrimPrefix(socket, "unix://")
+	if hostRoot != "" {
+		socket = filepath.Join(hostRoot, socket)
+	}
+	return socket
+}
+
 // Hooked up by each engine through init()
 var engineGenerators = make(map[engineType]engineGenerator)
 
-func Generators() ([]EngineGenerator, *EngineInotifier, error) {
-	generators := make([]EngineGenerator, 0)
-	engineNotifier := EngineInotifier{
-		watcher:           nil,
-		watcherGenerators: make(map[string]EngineGenerator),
-	}
+// Generators returns a generator for each socket enabled in cfg.
+// Generated engines keep reading cfg, thus they honor later reloads,
+// and report through log with their EngineID as prefix.
+func Generators(cfg *config.Config, log logger.Logger, st *stats.Registry) map[EngineID]EngineGenerator {
+	generators := make(map[EngineID]EngineGenerator)
 
-	c := config.Get()
+	c := cfg.Get()
 	for engineName, engineGen := range engineGenerators {
 		eCfg, ok := c.SocketsEngines[string(engineName)]
 		if !ok || !eCfg.Enabled {
@@ -64,38 +132,24 @@ func Generators() ([]EngineGenerator, *EngineInotifier, error) {
 		}
 		// For each specified socket, return a closure to generate its engine
 		for _, socket := range eCfg.Sockets {
-			// Properly account for HOST_ROOT env variable
-			if config.GetHostRoot() != "" {
-				socket = filepath.Join(config.GetHostRoot(), socket)
-			}
-			if _, statErr := os.Stat(socket); os.IsNotExist(statErr) {
-				// Does not exist; emplace back an inotify listener
-				if engineNotifier.watcher == nil {
-					engineNotifier.watcher, _ = fsnotify.NewWatcher()
+			socket = hostSocket(c.HostRoot, socket)
+			id := EngineID{Type: string(engineName), Socket: socket}
+			engineLog := log.WithPrefix(id.String())
+			engineStats := st.Engine(id.String())
+			generators[id] = func(ctx context.Context) (engine Engine, err error) {
+				defer Recover(engineLog, engineStats, &err)
+				engine, err = engineGen(ctx, cfg, engineLog, engineStats, socket)
+				engineStats.SetLastError(err)
+				if err != nil {
+					engineLog.Warnf("failed to connect: %v", err)
+					return nil, err
 				}
-				if engineNotifier.watcher != nil {
-					dir := filepath.Dir(socket)
-					err := engineNotifier.watcher.Add(dir)
-					if err != nil {
-						// Try to attach watcher to parent dir
-						// eg: /run/user for podman, /run/ for crio, and so on
-						dir = filepath.Dir(dir)
-						err = engineNotifier.watcher.Add(dir)
-					}
-					if err == nil {
-						engineNotifier.watcherGenerators[socket] = func(ctx context.Context) (Engine, error) {
-							return engineGen(ctx, socket)
-						}
-					}
-				}
-			} else {
-				generators = append(generators, func(ctx context.Context) (Engine, error) {
-					return engineGen(ctx, socket)
-				})
+				engineLog.Infof("connected")
+				return engine, nil
 			}
 		}
 	}
-	return generators, &engineNotifier, nil
+	return generators
 }
 
 type getter interface {
@@ -103,6 +157,12 @@ type getter interface {
 	get(ctx context.Context, containerId string) (*event.Event, error)
 }
 
+// requestGetter is implemented by getters that need the request hints, eg: its cgroup, to find a container.
+type requestGetter interface {
+	// getRequest returns info about the requested container
+	getRequest(ctx context.Context, req Request) (*event.Event, error)
+}
+
 type copier interface {
 	// copy creates a new Engine with same socket of another.
 	copy(ctx context.Context) (Engine, error)
@@ -113,6 +173,141 @@ type Engine interface {
 	List(ctx context.Context) ([]event.Event, error)
 	// Listen returns a channel where container created/deleted events will be notified
 	Listen(ctx context.Context, wg *sync.WaitGroup) (<-chan event.Event, error)
+	// Close releases the engine client; Listen goroutines are instead stopped by cancelling their context.
+	Close() error
+}
+
+// backoff implements a simple exponential backoff, doubling
+// its duration at each wait() up to max.
+type backoff struct {
+	min time.Duration
+	max time.Duration
+	cur time.Duration
+}
+
+func newBackoff() *backoff {
+	return &backoff{
+		min: listenMinBackoff,
+		max: listenMaxBackoff,
+		cur: listenMinBackoff,
+	}
+}
+
+// wait blocks for the current backoff duration, then doubles it.
+// Returns false if ctx gets cancelled while waiting.
+func (b *backoff) wait(ctx context.Context) bool {
+	timer := time.NewTimer(b.cur)
+	defer timer.Stop()
+	b.cur *= 2
+	if b.cur > b.max {
+		b.cur = b.max
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (b *backoff) reset() {
+	b.cur = b.min
+}
+
+// streamHealth deems an events stream healthy once it stayed up for a while:
+// only then the engine is reported as connected and the backoff gets reset,
+// so that a stream breaking right away neither flaps the state nor reconnects in a tight loop.
+type streamHealth struct {
+	timer *time.Timer
+	b     *backoff
+	st    *stats.Engine
+}
+
+func newStreamHealth(after time.Duration, b *backoff, st *stats.Engine) *streamHealth {
+	return &streamHealth{
+		timer: time.NewTimer(after),
+		b:     b,
+		st:    st,
+	}
+}
+
+// C fires once the stream stayed up long enough; healthy() must then be called.
+func (h *streamHealth) C() <-chan time.Time {
+	return h.timer.C
+}
+
+func (h *streamHealth) healthy() {
+	h.st.SetState(stats.StateConnected)
+	h.b.reset()
+}
+
+func (h *streamHealth) stop() {
+	h.timer.Stop()
+}
+
+// relist lists all containers from the engine and sends a create event for each of them to outCh.
+// It is used by listeners after a reconnection, to avoid missing containers
+// that were created while the events stream was down.
+// Returns true if the engine could be listed.
+func relist(ctx context.Context, log logger.Logger, e Engine, outCh chan<- event.Event) bool {
+	evts, err := e.List(ctx)
+	if err != nil {
+		log.Warnf("failed to list containers after reconnection: %v", err)
+		return false
+	}
+	log.Infof("reconnected, listed %d containers", len(evts))
+	for _, evt := range evts {
+		if !send(ctx, outCh, evt) {
+			return false
+		}
+	}
+	return true
+}
+
+// PanicError is a panic recovered from engine code.
+type PanicError struct {
+	Value any
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("recovered from panic: %v", e.Value)
+}
+
+// Recover recovers a panic of engine code, so that it never crosses into C:
+// the panic is logged, the engine is disabled in st and, if err is not nil,
+// a *PanicError is stored into it. It must be directly deferred.
+func Recover(log logger.Logger, st *stats.Engine, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	log.Errorf("recovered from panic, disabling engine: %v\n%s", r, debug.Stack())
+	st.Panicked()
+	if err != nil {
+		*err = &PanicError{Value: r}
+	}
+}
+
+// send sends evt to outCh, giving up if ctx is done before the event is received.
+// Engines must never block on outCh otherwise, since the receiver
+// is gone once the worker stops. Returns false if evt was not sent.
+func send(ctx context.Context, outCh chan<- event.Event, evt event.Event) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case outCh <- evt:
+		return true
+	}
+}
+
+// withRequestTimeout bounds a single API call to an engine of type t.
+func withRequestTimeout(ctx context.Context, cfg *config.Config, t engineType) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, cfg.GetTimeouts(string(t)).Request)
+}
+
+// withListTimeout bounds a whole listing of an engine of type t.
+func withListTimeout(ctx context.Context, cfg *config.Config, t engineType) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, cfg.GetTimeouts(string(t)).List)
 }
 
 func enforceUnixProtocolIfEmpty(socket string) string {
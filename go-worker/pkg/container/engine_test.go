@@ -1,9 +1,14 @@
 package container
 
 import (
+	"context"
+	"errors"
+	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/FedeDP/container-worker/pkg/stats"
 	"github.com/docker/docker/client"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestEnforceUnixProtocol(t *testing.T) {
@@ -28,6 +33,40 @@ func TestEnforceUnixProtocol(t *testing.T) {
 	}
 }
 
+func TestHostSocket(t *testing.T) {
+	tCases := map[string]struct {
+		hostRoot       string
+		socket         string
+		expectedSocket string
+	}{
+		"Path": {
+			socket:         "/run/docker.sock",
+			expectedSocket: "/run/docker.sock",
+		},
+		"Path with host root": {
+			hostRoot:       "/host",
+			socket:         "/run/docker.sock",
+			expectedSocket: "/host/run/docker.sock",
+		},
+		"Unix URL with host root": {
+			hostRoot:       "/host",
+			socket:         "unix:///run/docker.sock",
+			expectedSocket: "/host/run/docker.sock",
+		},
+		"Remote with host root": {
+			hostRoot:       "/host",
+			socket:         "tcp://127.0.0.1:2376",
+			expectedSocket: "tcp://127.0.0.1:2376",
+		},
+	}
+
+	for name, tc := range tCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedSocket, hostSocket(tc.hostRoot, tc.socket))
+		})
+	}
+}
+
 func TestCountCPUSet(t *testing.T) {
 	tCases := map[string]struct {
 		cpuSetStr           string
@@ -65,3 +104,80 @@ func TestCountCPUSet(t *testing.T) {
 		})
 	}
 }
+
+func TestBackoff(t *testing.T) {
+	b := &backoff{
+		min: time.Millisecond,
+		max: 4 * time.Millisecond,
+		cur: time.Millisecond,
+	}
+	expected := []time.Duration{2 * time.Millisecond, 4 * time.Millisecond, 4 * time.Millisecond}
+	for _, exp := range expected {
+		assert.True(t, b.wait(context.Background()))
+		assert.Equal(t, exp, b.cur)
+	}
+	b.reset()
+	assert.Equal(t, time.Millisecond, b.cur)
+
+	// Cancelled context must stop the wait
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.cur = time.Hour
+	assert.False(t, b.wait(ctx))
+}
+
+func TestStreamHealth(t *testing.T) {
+	dc := &dockerEngine{stats: &stats.Engine{}}
+	dc.stats.SetState(stats.StateReconnecting)
+	b := newBackoff()
+	b.cur = listenMaxBackoff
+
+	// Broken right away: neither connected, nor the backoff reset
+	errs := make(chan error, 1)
+	errs <- errors.New("broken")
+	h := newStreamHealth(time.Hour, b, dc.stats)
+	assert.False(t, dc.consume(context.Background(), nil, errs, h, nil))
+	h.stop()
+	assert.Equal(t, stats.StateReconnecting, dc.stats.State())
+	assert.Equal(t, listenMaxBackoff, b.cur)
+
+	// Up long enough
+	h = newStreamHealth(time.Millisecond, b, dc.stats)
+	done := make(chan bool)
+	go func() {
+		done <- dc.consume(context.Background(), nil, errs, h, nil)
+	}()
+	assert.Eventually(t, func() bool { return dc.stats.State() == stats.StateConnected }, 5*time.Second, time.Millisecond)
+	errs <- errors.New("broken")
+	assert.False(t, <-done)
+	h.stop()
+	assert.Equal(t, listenMinBackoff, b.cur)
+	assert.Equal(t, stats.StateReconnecting, dc.stats.State())
+}
+
+func TestSend(t *testing.T) {
+	outCh := make(chan event.Event, 1)
+	evt := event.Event{IsCreate: true}
+	assert.True(t, send(context.Background(), outCh, evt))
+	assert.Equal(t, evt, <-outCh)
+
+	// Nobody receiving: cancelled context must unblock the send
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	assert.False(t, send(ctx, make(chan event.Event), evt))
+}
+
+func TestRecover(t *testing.T) {
+	st := &stats.Engine{}
+	st.SetState(stats.StateConnected)
+	list := func() (evts []event.Event, err error) {
+		defer Recover(nil, st, &err)
+		var ctrs []event.Event
+		return []event.Event{ctrs[0]}, nil
+	}
+	evts, err := list()
+	assert.Nil(t, evts)
+	var pErr *PanicError
+	assert.ErrorAs(t, err, &pErr)
+	assert.Equal(t, stats.StateDisabled, st.State())
+}
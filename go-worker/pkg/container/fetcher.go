@@ -2,75 +2,352 @@ package container
 
 import (
 	"context"
+	"github.com/FedeDP/container-worker/pkg/config"
 	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/FedeDP/container-worker/pkg/logger"
+	"github.com/FedeDP/container-worker/pkg/stats"
+	"runtime/debug"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /*
-Fetcher is a fake engine that listens on fetcherChan for published containerIDs.
-Everytime a containerID is published on the channel, the fetcher engine loops
-over all enabled engines and tries to get info about the container,
-until it succeeds and publish an event to the output channel.
-FetcherChan requests are published through a CGO exposed API: AskForContainerInfo(), in worker_api.
+Fetcher is a fake engine that listens on a requests queue for published containerIDs.
+Everytime a containerID is published on the queue, the fetcher engine asks
+all enabled engines in parallel for info about the container,
+and publishes the first event it gets to the output channel.
+Requests are served by a bounded pool of lookups, so that a slow engine does not stall other requests;
+requests for a container already being looked up are coalesced, and containers
+not found by any engine are looked up again a few times, since they could still be being created,
+then remembered for a while, not to ask engines again and again.
+Requests are published through a CGO exposed API: AskForContainerInfo(), in worker_api,
+that never blocks: see RequestQueue.
 */
 
-var fetcherChan chan string
+const (
+	// Max number of concurrent lookups
+	fetcherWorkers = 8
+	// How long a container unknown to all engines is not looked up again
+	fetcherNegativeTTL = 30 * time.Second
+)
+
+// FetcherEngine is the fetcher engine, whose set of engines is updated in place,
+// so that neither pending lookups nor the negative cache are lost when engines come and go.
+type FetcherEngine interface {
+	Engine
+	// SetEngines makes the fetcher ask the given engines, copying the new ones and closing the copies of removed ones.
+	SetEngines(ctx context.Context, containerEngines map[EngineID]Engine)
+}
 
-func GetFetcherChan() chan<- string {
-	return fetcherChan
+// fetcherGetter is an engine asked by the fetcher.
+type fetcherGetter struct {
+	// Its type is used to ask first the getters matching the type of requested containers
+	id     EngineID
+	getter getter
+	// Set once it panicked; it is skipped from then on
+	disabled atomic.Bool
 }
 
 type fetcher struct {
-	getters []getter
+	// Guards getters, that are replaced by SetEngines
+	mtx         sync.Mutex
+	getters     []*fetcherGetter
+	queue       *RequestQueue
+	cfg         *config.Config
+	log         logger.Logger
+	stats       *stats.Fetcher
+	workers     int
+	negativeTTL time.Duration
 }
 
-// NewFetcherEngine returns a fetcher engine.
+// lookupResult is the outcome of a lookup, reported by the lookup goroutine to the dispatcher.
+type lookupResult struct {
+	containerId string
+	found       bool
+}
+
+// NewFetcherEngine returns a fetcher engine serving requests pushed to queue.
 // The fetcher engine is responsible to allow us to get() single container
 // trying all container engines enabled.
-func NewFetcherEngine(ctx context.Context, containerEngines []Engine) Engine {
-	f := fetcher{
-		getters: make([]getter, len(containerEngines)),
+func NewFetcherEngine(ctx context.Context, containerEngines map[EngineID]Engine, queue *RequestQueue, cfg *config.Config, log logger.Logger, st *stats.Fetcher) FetcherEngine {
+	f := newFetcher(nil, nil, queue, cfg, log, st)
+	f.SetEngines(ctx, containerEngines)
+	return f
+}
+
+// newFetcher returns a fetcher asking getters, whose types are optional.
+func newFetcher(getters []getter, types []engineType, queue *RequestQueue, cfg *config.Config, log logger.Logger, st *stats.Fetcher) *fetcher {
+	fetcherGetters := make([]*fetcherGetter, len(getters))
+	for i, g := range getters {
+		fetcherGetters[i] = &fetcherGetter{getter: g}
+		if i < len(types) {
+			fetcherGetters[i].id.Type = string(types[i])
+		}
+	}
+	return &fetcher{
+		getters:     fetcherGetters,
+		queue:       queue,
+		cfg:         cfg,
+		log:         log,
+		stats:       st,
+		workers:     fetcherWorkers,
+		negativeTTL: fetcherNegativeTTL,
+	}
+}
+
+func (f *fetcher) SetEngines(ctx context.Context, containerEngines map[EngineID]Engine) {
+	current := make(map[EngineID]*fetcherGetter)
+	for _, g := range f.snapshot() {
+		current[g.id] = g
 	}
-	for i, engine := range containerEngines {
+	getters := make([]*fetcherGetter, 0, len(containerEngines))
+	for id, engine := range containerEngines {
+		if g, ok := current[id]; ok {
+			delete(current, id)
+			getters = append(getters, g)
+			continue
+		}
 		copyEngine, ok := engine.(copier)
 		if !ok {
-			// We need all engines to implement the copier interface to be copied by fetcher.
-			panic("not a copier")
+			// We need engines to implement the copier interface to be copied by fetcher.
+			f.log.Warnf("engine %T cannot be copied, skipping it", engine)
+			continue
+		}
+		e, err := f.copy(ctx, copyEngine)
+		if err != nil {
+			f.log.Warnf("%s: failed to copy engine: %v", id, err)
 		}
-		e, _ := copyEngine.copy(ctx)
 		if e != nil {
 			// No type check since Engine interface extends getter.
-			f.getters[i] = e.(getter)
+			getters = append(getters, &fetcherGetter{id: id, getter: e.(getter)})
 		}
 	}
-	return &f
+	f.mtx.Lock()
+	f.getters = getters
+	f.mtx.Unlock()
+	// Running lookups asking them just miss the container
+	for _, g := range current {
+		_ = g.getter.(Engine).Close()
+	}
+}
+
+// snapshot returns the current getters.
+func (f *fetcher) snapshot() []*fetcherGetter {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.getters
+}
+
+// copy copies an engine, recovering any panic.
+func (f *fetcher) copy(ctx context.Context, c copier) (e Engine, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			f.stats.Panicked()
+			err = &PanicError{Value: r}
+		}
+	}()
+	return c.copy(ctx)
+}
+
+// recoverPanic recovers a panic of the fetcher goroutines, so that it never crosses into C.
+// It must be directly deferred.
+func (f *fetcher) recoverPanic() {
+	if r := recover(); r != nil {
+		f.log.Errorf("recovered from panic: %v\n%s", r, debug.Stack())
+		f.stats.Panicked()
+	}
+}
+
+// get gets the requested container from g, recovering any panic.
+func (f *fetcher) get(ctx context.Context, g getter, req Request) (evt *event.Event, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			f.log.Errorf("%T panicked getting container %s: %v\n%s", g, req.ContainerID, r, debug.Stack())
+			f.stats.Panicked()
+			err = &PanicError{Value: r}
+		}
+	}()
+	if rg, ok := g.(requestGetter); ok {
+		return rg.getRequest(ctx, req)
+	}
+	return g.get(ctx, req.ContainerID)
 }
 
 func (f *fetcher) List(_ context.Context) ([]event.Event, error) {
 	panic("do not call")
 }
 
+// Close closes all the engines copied by the fetcher.
+func (f *fetcher) Close() error {
+	for _, g := range f.snapshot() {
+		_ = g.getter.(Engine).Close()
+	}
+	return nil
+}
+
+// pendingLookup is a container being looked up, or waiting to be looked up again.
+type pendingLookup struct {
+	req Request
+	// Number of completed lookups
+	attempts int
+	running  bool
+	// When the next lookup is due, if not running
+	retryAt time.Time
+	// Set when a listener engine delivered the container while it was being looked up
+	delivered bool
+}
+
+// Listen starts the dispatcher goroutine, that owns the pending lookups and the negative cache,
+// and starts up to f.workers lookups at a time; requests are left in the queue meanwhile,
+// so that it is the queue bounding the pending ones.
+// A container not found is looked up again as per the configured retry schedule,
+// unless a listener engine delivers it in the meantime; in the end, a NotFound event is sent for it,
+// as well as for any request of it while it is in the negative cache.
 func (f *fetcher) Listen(ctx context.Context, wg *sync.WaitGroup) (<-chan event.Event, error) {
 	outCh := make(chan event.Event)
+	doneCh := make(chan lookupResult)
 	wg.Add(1)
-	fetcherChan = make(chan string)
 	go func() {
+		// Lookups are waited for before closing outCh, since they send to it
+		var lookupsWg sync.WaitGroup
+		pending := make(map[string]*pendingLookup)
 		defer func() {
+			lookupsWg.Wait()
 			close(outCh)
-			close(fetcherChan)
-			fetcherChan = nil
+			// Let the next fetcher, if any, complete the pending lookups
+			var left []Request
+			for _, p := range pending {
+				if !p.delivered {
+					left = append(left, p.req)
+				}
+			}
+			f.queue.requeue(left)
 			wg.Done()
 		}()
+		// Recovered first, so that outCh still gets closed
+		defer f.recoverPanic()
+
+		// Containers not found, with the time they can be looked up again
+		negative := make(map[string]time.Time)
+		running := 0
+		start := func(p *pendingLookup) {
+			p.running = true
+			running++
+			lookupsWg.Add(1)
+			go func() {
+				defer lookupsWg.Done()
+				defer f.recoverPanic()
+				f.lookup(ctx, p.req, outCh, doneCh)
+			}()
+		}
+		// Sent in background, not to stall the dispatcher; the requester
+		// forgets the container once notified, and can ask for it again.
+		notFound := func(containerId string) {
+			lookupsWg.Add(1)
+			go func() {
+				defer lookupsWg.Done()
+				defer f.recoverPanic()
+				send(ctx, outCh, notFoundEvent(containerId))
+			}()
+		}
+
+		retryTimer := time.NewTimer(time.Hour)
+		retryTimer.Stop()
+		defer retryTimer.Stop()
+		pruneTicker := time.NewTicker(f.negativeTTL)
+		defer pruneTicker.Stop()
 		for {
+			for _, containerId := range f.queue.TakeDelivered() {
+				p, ok := pending[containerId]
+				if !ok {
+					continue
+				}
+				if p.running {
+					// Not retried once done
+					p.delivered = true
+					continue
+				}
+				delete(pending, containerId)
+				f.stats.Requested(true)
+			}
+
+			// Retries first, since they were requested before queued containers
+			now := time.Now()
+			var nextRetry time.Time
+			for _, p := range pending {
+				switch {
+				case p.running:
+				case p.retryAt.After(now):
+					if nextRetry.IsZero() || p.retryAt.Before(nextRetry) {
+						nextRetry = p.retryAt
+					}
+				case running < f.workers:
+					start(p)
+				}
+			}
+
+			for running < f.workers {
+				req, ok := f.queue.Pop()
+				if !ok {
+					break
+				}
+				containerId := req.ContainerID
+				if _, ok := pending[containerId]; ok {
+					f.stats.Coalesced()
+					continue
+				}
+				if expiry, ok := negative[containerId]; ok {
+					if time.Now().Before(expiry) {
+						f.stats.NegativeHit()
+						notFound(containerId)
+						continue
+					}
+					delete(negative, containerId)
+				}
+				p := &pendingLookup{req: req}
+				pending[containerId] = p
+				start(p)
+			}
+
+			// A nil channel is never selected
+			var retryC <-chan time.Time
+			if !nextRetry.IsZero() {
+				retryTimer.Reset(time.Until(nextRetry))
+				retryC = retryTimer.C
+			}
+
 			select {
 			case <-ctx.Done():
 				return
-			case containerId := <-fetcherChan:
-				for _, e := range f.getters {
-					evt, _ := e.get(ctx, containerId)
-					if evt != nil {
-						outCh <- *evt
-						break
+			case <-f.queue.Ready():
+			case <-retryC:
+			case res := <-doneCh:
+				running--
+				p := pending[res.containerId]
+				p.running = false
+				p.attempts++
+				retries := f.cfg.GetFetcherRetries()
+				switch {
+				case res.found || p.delivered:
+					delete(pending, res.containerId)
+					f.stats.Requested(true)
+				case p.attempts <= len(retries):
+					// Likely still being created
+					f.stats.Retried()
+					p.retryAt = time.Now().Add(retries[p.attempts-1])
+				default:
+					delete(pending, res.containerId)
+					f.stats.Requested(false)
+					f.log.Debugf("container %s not found by any engine", res.containerId)
+					negative[res.containerId] = time.Now().Add(f.negativeTTL)
+					notFound(res.containerId)
+				}
+			case now := <-pruneTicker.C:
+				for containerId, expiry := range negative {
+					if now.After(expiry) {
+						delete(negative, containerId)
 					}
 				}
 			}
@@ -78,3 +355,103 @@ func (f *fetcher) Listen(ctx context.Context, wg *sync.WaitGroup) (<-chan event.
 	}()
 	return outCh, nil
 }
+
+func notFoundEvent(containerId string) event.Event {
+	return event.Event{Info: event.Info{Container: event.Container{ID: containerId}}, NotFound: true}
+}
+
+// lookup asks the getters for the requested container, sending the first event it gets to outCh;
+// the outcome is then reported to doneCh, once all getters returned.
+// Getters matching the requested container type are asked first, tier by tier, and the others only if they miss it;
+// fallback ones last.
+func (f *fetcher) lookup(ctx context.Context, req Request, outCh chan<- event.Event, doneCh chan<- lookupResult) {
+	hinted := engineTypesForCT(req.Type)
+	preferred := make([][]*fetcherGetter, len(hinted))
+	var others, fallbacks []*fetcherGetter
+	for _, g := range f.snapshot() {
+		tier := slices.IndexFunc(hinted, func(types []engineType) bool {
+			return slices.Contains(types, engineType(g.id.Type))
+		})
+		switch {
+		case tier >= 0:
+			preferred[tier] = append(preferred[tier], g)
+		case isFallbackType(engineType(g.id.Type)):
+			fallbacks = append(fallbacks, g)
+		default:
+			others = append(others, g)
+		}
+	}
+
+	found, asked := false, false
+	for _, getters := range preferred {
+		if len(getters) == 0 {
+			continue
+		}
+		asked = true
+		if found = f.race(ctx, getters, req, outCh); found {
+			break
+		}
+	}
+	if asked && !found {
+		f.stats.HintMissed()
+		f.log.Debugf("container %s (%s, pid %d) not found by %v engines, asking the others",
+			req.ContainerID, req.Cgroup, req.Pid, hinted)
+	}
+	if !found {
+		found = f.race(ctx, others, req, outCh)
+	}
+	if !found && len(fallbacks) > 0 {
+		found = f.race(ctx, fallbacks, req, outCh)
+	}
+
+	select {
+	case <-ctx.Done():
+	case doneCh <- lookupResult{containerId: req.ContainerID, found: found}:
+	}
+}
+
+// race asks getters in parallel for the requested container, sending the first event it gets to outCh.
+// It returns once all getters returned.
+func (f *fetcher) race(ctx context.Context, getters []*fetcherGetter, req Request, outCh chan<- event.Event) bool {
+	lCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Buffered, so that losing getters never block
+	evtCh := make(chan *event.Event, len(getters))
+	var gettersWg sync.WaitGroup
+	for _, g := range getters {
+		if g.disabled.Load() {
+			continue
+		}
+		gettersWg.Add(1)
+		go func() {
+			defer gettersWg.Done()
+			evt, err := f.get(lCtx, g.getter, req)
+			if _, ok := err.(*PanicError); ok {
+				g.disabled.Store(true)
+			}
+			if evt != nil {
+				evt.Source = g.id.String()
+			}
+			evtCh <- evt
+		}()
+	}
+	go func() {
+		gettersWg.Wait()
+		close(evtCh)
+	}()
+
+	found := false
+	for evt := range evtCh {
+		if evt != nil && !found {
+			found = true
+			// Stop the slower getters
+			cancel()
+			if !send(ctx, outCh, *evt) {
+				break
+			}
+		}
+	}
+	gettersWg.Wait()
+	return found
+}
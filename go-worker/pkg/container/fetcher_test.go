@@ -0,0 +1,451 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"github.com/FedeDP/container-worker/pkg/config"
+	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/FedeDP/container-worker/pkg/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeGetter struct{}
+
+func (fakeGetter) get(_ context.Context, containerId string) (*event.Event, error) {
+	return &event.Event{Info: event.Info{Container: event.Container{FullID: containerId}}, IsCreate: true}, nil
+}
+
+func TestFetcherStopsWhileSending(t *testing.T) {
+	cfg := config.New(nil)
+	queue := NewRequestQueue(cfg, nil)
+	f := newFetcher([]getter{fakeGetter{}}, nil, queue, cfg, nil, nil)
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	outCh, err := f.Listen(ctx, &wg)
+	require.NoError(t, err)
+
+	queue.Push(NewRequest("ctr1"))
+	evt := <-outCh
+	assert.Equal(t, "ctr1", evt.FullID)
+
+	// Nobody receives the second event anymore, eg: the worker is stopping
+	queue.Push(NewRequest("ctr2"))
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetcher blocked sending after its context was cancelled")
+	}
+}
+
+type panickingGetter struct {
+	calls atomic.Int32
+}
+
+func (p *panickingGetter) get(_ context.Context, _ string) (*event.Event, error) {
+	p.calls.Add(1)
+	panic("malformed response")
+}
+
+func TestFetcherRecoversGetterPanic(t *testing.T) {
+	bad := &panickingGetter{}
+	st := &stats.Fetcher{}
+	cfg := config.New(nil)
+	queue := NewRequestQueue(cfg, st)
+	f := newFetcher([]getter{bad, fakeGetter{}}, nil, queue, cfg, nil, st)
+	// A single lookup at a time: the panicking getter returned before the next lookup
+	f.workers = 1
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	outCh, err := f.Listen(ctx, &wg)
+	require.NoError(t, err)
+
+	// Panicking getter is skipped, and never asked again
+	for _, id := range []string{"ctr1", "ctr2"} {
+		queue.Push(NewRequest(id))
+		evt := <-outCh
+		assert.Equal(t, id, evt.FullID)
+	}
+	assert.Equal(t, int32(1), bad.calls.Load())
+}
+
+// slowGetter blocks until released, then finds the container if found is set.
+type slowGetter struct {
+	release chan struct{}
+	found   bool
+	calls   atomic.Int32
+}
+
+func newSlowGetter(found bool) *slowGetter {
+	return &slowGetter{release: make(chan struct{}), found: found}
+}
+
+func (s *slowGetter) get(ctx context.Context, containerId string) (*event.Event, error) {
+	s.calls.Add(1)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.release:
+	}
+	if !s.found {
+		return nil, nil
+	}
+	return fakeGetter{}.get(ctx, containerId)
+}
+
+func listenFetcher(t *testing.T, f *fetcher) <-chan event.Event {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	outCh, err := f.Listen(ctx, &wg)
+	require.NoError(t, err)
+	return outCh
+}
+
+func waitFetcherEvent(t *testing.T, outCh <-chan event.Event) event.Event {
+	select {
+	case evt := <-outCh:
+		return evt
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for fetcher event")
+	}
+	return event.Event{}
+}
+
+func TestFetcherRecoversDispatcherPanic(t *testing.T) {
+	r := stats.NewRegistry()
+	queue := NewRequestQueue(config.New(nil), r.Fetcher())
+	// No config, thus the dispatcher panics once the lookup is done
+	f := newFetcher([]getter{fakeGetter{}}, nil, queue, nil, nil, r.Fetcher())
+	outCh := listenFetcher(t, f)
+
+	queue.Push(NewRequest("ctr"))
+	evt := waitFetcherEvent(t, outCh)
+	assert.Equal(t, "ctr", evt.FullID)
+	// The fetcher stops, but the panic does not cross the goroutine
+	select {
+	case _, ok := <-outCh:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the fetcher to stop")
+	}
+	assert.Equal(t, uint64(1), r.Snapshot().Fetcher.Panics)
+}
+
+func TestFetcherRacesGetters(t *testing.T) {
+	cfg := config.New(nil)
+	queue := NewRequestQueue(cfg, nil)
+	slow := newSlowGetter(true)
+	f := newFetcher([]getter{slow, fakeGetter{}}, nil, queue, cfg, nil, nil)
+	outCh := listenFetcher(t, f)
+
+	// The fast getter wins, without waiting for the slow one
+	queue.Push(NewRequest("ctr"))
+	assert.Equal(t, "ctr", waitFetcherEvent(t, outCh).FullID)
+}
+
+func TestFetcherCoalescesRequests(t *testing.T) {
+	r := stats.NewRegistry()
+	cfg := config.New(nil)
+	queue := NewRequestQueue(cfg, r.Fetcher())
+	slow := newSlowGetter(true)
+	f := newFetcher([]getter{slow}, nil, queue, cfg, nil, r.Fetcher())
+	outCh := listenFetcher(t, f)
+
+	for i := 0; i < 3; i++ {
+		queue.Push(NewRequest("ctr"))
+	}
+	close(slow.release)
+	assert.Equal(t, "ctr", waitFetcherEvent(t, outCh).FullID)
+	select {
+	case evt := <-outCh:
+		t.Fatalf("unexpected event for %s", evt.FullID)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, int32(1), slow.calls.Load())
+	assert.Eventually(t, func() bool {
+		s := r.Snapshot().Fetcher
+		return s.Requests == 3 && s.Coalesced == 2 && s.Hits == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestFetcherNegativeCache(t *testing.T) {
+	r := stats.NewRegistry()
+	cfg := config.New(nil)
+	require.NoError(t, cfg.Load(`{"fetcher":{"retry_schedule_ms":[]}}`))
+	queue := NewRequestQueue(cfg, r.Fetcher())
+	miss := newSlowGetter(false)
+	close(miss.release)
+	f := newFetcher([]getter{miss}, nil, queue, cfg, nil, r.Fetcher())
+	f.negativeTTL = 200 * time.Millisecond
+	outCh := listenFetcher(t, f)
+
+	queue.Push(NewRequest("ctr"))
+	evt := waitFetcherEvent(t, outCh)
+	assert.True(t, evt.NotFound)
+	assert.Equal(t, uint64(1), r.Snapshot().Fetcher.Misses)
+
+	// Unknown container is not looked up again until the TTL expires,
+	// but the request is still answered, so that it can be asked again
+	queue.Push(NewRequest("ctr"))
+	evt = waitFetcherEvent(t, outCh)
+	assert.True(t, evt.NotFound)
+	assert.Equal(t, "ctr", evt.ID)
+	assert.Equal(t, uint64(1), r.Snapshot().Fetcher.NegativeCacheHits)
+	assert.Equal(t, int32(1), miss.calls.Load())
+
+	time.Sleep(f.negativeTTL)
+	queue.Push(NewRequest("ctr"))
+	assert.Eventually(t, func() bool {
+		return miss.calls.Load() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// copyEngine is an engine asking its getter, counting its copies and closures.
+type copyEngine struct {
+	getter
+	copies atomic.Int32
+	closed atomic.Int32
+}
+
+func (c *copyEngine) copy(_ context.Context) (Engine, error) {
+	c.copies.Add(1)
+	return c, nil
+}
+
+func (c *copyEngine) List(_ context.Context) ([]event.Event, error) {
+	return nil, nil
+}
+
+func (c *copyEngine) Listen(_ context.Context, _ *sync.WaitGroup) (<-chan event.Event, error) {
+	return nil, nil
+}
+
+func (c *copyEngine) Close() error {
+	c.closed.Add(1)
+	return nil
+}
+
+func TestFetcherSetEngines(t *testing.T) {
+	r := stats.NewRegistry()
+	cfg := config.New(nil)
+	require.NoError(t, cfg.Load(`{"fetcher":{"retry_schedule_ms":[]}}`))
+	queue := NewRequestQueue(cfg, r.Fetcher())
+	miss := newSlowGetter(false)
+	close(miss.release)
+	docker := &copyEngine{getter: miss}
+	dockerID := EngineID{Type: string(typeDocker), Socket: "/docker.sock"}
+	f := NewFetcherEngine(context.Background(), map[EngineID]Engine{dockerID: docker}, queue, cfg, nil, r.Fetcher())
+	outCh := listenFetcher(t, f.(*fetcher))
+
+	queue.Push(NewRequest("ctr"))
+	assert.True(t, waitFetcherEvent(t, outCh).NotFound)
+
+	// Running engines are not copied again, and the negative cache is kept
+	podman := &copyEngine{getter: fakeGetter{}}
+	podmanID := EngineID{Type: string(typePodman), Socket: "/podman.sock"}
+	f.SetEngines(context.Background(), map[EngineID]Engine{dockerID: docker, podmanID: podman})
+	assert.Equal(t, int32(1), docker.copies.Load())
+	assert.Equal(t, int32(1), podman.copies.Load())
+	queue.Push(NewRequest("ctr"))
+	assert.True(t, waitFetcherEvent(t, outCh).NotFound)
+	assert.Equal(t, uint64(1), r.Snapshot().Fetcher.NegativeCacheHits)
+
+	// Removed engines are closed
+	f.SetEngines(context.Background(), map[EngineID]Engine{podmanID: podman})
+	assert.Equal(t, int32(1), docker.closed.Load())
+	assert.Zero(t, podman.closed.Load())
+	queue.Push(NewRequest("ctr2"))
+	evt := waitFetcherEvent(t, outCh)
+	assert.Equal(t, "ctr2", evt.FullID)
+	// Tagged with the engine that found it
+	assert.Equal(t, podmanID.String(), evt.Source)
+	assert.Equal(t, int32(1), miss.calls.Load())
+}
+
+func TestFetcherBoundsLookups(t *testing.T) {
+	cfg := config.New(nil)
+	queue := NewRequestQueue(cfg, nil)
+	slow := newSlowGetter(true)
+	f := newFetcher([]getter{slow}, nil, queue, cfg, nil, nil)
+	f.workers = 2
+	outCh := listenFetcher(t, f)
+
+	for i := 0; i < 5; i++ {
+		queue.Push(NewRequest(fmt.Sprintf("ctr%d", i)))
+	}
+	// Only 2 lookups run at a time; the others are queued
+	assert.Eventually(t, func() bool {
+		return slow.calls.Load() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(2), slow.calls.Load())
+
+	close(slow.release)
+	found := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		found[waitFetcherEvent(t, outCh).FullID] = true
+	}
+	assert.Len(t, found, 5)
+}
+
+// lateGetter finds a container starting from its found-th lookup, like one still being created.
+type lateGetter struct {
+	found int32
+	calls atomic.Int32
+}
+
+func (l *lateGetter) get(ctx context.Context, containerId string) (*event.Event, error) {
+	if l.calls.Add(1) < l.found {
+		return nil, nil
+	}
+	return fakeGetter{}.get(ctx, containerId)
+}
+
+func TestFetcherRetries(t *testing.T) {
+	r := stats.NewRegistry()
+	cfg := config.New(nil)
+	require.NoError(t, cfg.Load(`{"fetcher":{"retry_schedule_ms":[10,10,10]}}`))
+	queue := NewRequestQueue(cfg, r.Fetcher())
+	late := &lateGetter{found: 3}
+	f := newFetcher([]getter{late}, nil, queue, cfg, nil, r.Fetcher())
+	outCh := listenFetcher(t, f)
+
+	queue.Push(NewRequest("ctr"))
+	evt := waitFetcherEvent(t, outCh)
+	assert.Equal(t, "ctr", evt.FullID)
+	assert.False(t, evt.NotFound)
+	assert.Equal(t, int32(3), late.calls.Load())
+	assert.Eventually(t, func() bool {
+		s := r.Snapshot().Fetcher
+		return s.Requests == 1 && s.Hits == 1 && s.Retries == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestFetcherNotFound(t *testing.T) {
+	r := stats.NewRegistry()
+	cfg := config.New(nil)
+	require.NoError(t, cfg.Load(`{"fetcher":{"retry_schedule_ms":[10,20]}}`))
+	queue := NewRequestQueue(cfg, r.Fetcher())
+	late := &lateGetter{found: 100}
+	f := newFetcher([]getter{late}, nil, queue, cfg, nil, r.Fetcher())
+	outCh := listenFetcher(t, f)
+
+	// Given up after all the retries
+	queue.Push(NewRequest("ctr"))
+	evt := waitFetcherEvent(t, outCh)
+	assert.True(t, evt.NotFound)
+	assert.Equal(t, "ctr", evt.ID)
+	assert.Equal(t, int32(3), late.calls.Load())
+	s := r.Snapshot().Fetcher
+	assert.Equal(t, uint64(1), s.Misses)
+	assert.Equal(t, uint64(2), s.Retries)
+}
+
+func TestFetcherStopsRetryingDelivered(t *testing.T) {
+	r := stats.NewRegistry()
+	cfg := config.New(nil)
+	require.NoError(t, cfg.Load(`{"fetcher":{"retry_schedule_ms":[200,200]}}`))
+	queue := NewRequestQueue(cfg, r.Fetcher())
+	late := &lateGetter{found: 100}
+	f := newFetcher([]getter{late}, nil, queue, cfg, nil, r.Fetcher())
+	outCh := listenFetcher(t, f)
+
+	queue.Push(NewRequest("ctr"))
+	assert.Eventually(t, func() bool {
+		return r.Snapshot().Fetcher.Retries == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A listener engine sent the container while waiting for the retry
+	queue.Delivered("ctr")
+	assert.Eventually(t, func() bool {
+		return r.Snapshot().Fetcher.Hits == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	select {
+	case evt := <-outCh:
+		t.Fatalf("unexpected event for %s", evt.ID)
+	case <-time.After(300 * time.Millisecond):
+	}
+	assert.Equal(t, int32(1), late.calls.Load())
+}
+
+func TestFetcherTypeHint(t *testing.T) {
+	r := stats.NewRegistry()
+	cfg := config.New(nil)
+	require.NoError(t, cfg.Load(`{"fetcher":{"retry_schedule_ms":[]}}`))
+	queue := NewRequestQueue(cfg, r.Fetcher())
+	docker := &lateGetter{found: 100}
+	podman := &lateGetter{found: 1}
+	f := newFetcher([]getter{docker, podman}, []engineType{typeDocker, typePodman}, queue, cfg, nil, r.Fetcher())
+	outCh := listenFetcher(t, f)
+
+	// Only the hinted engine is asked
+	queue.Push(Request{ContainerID: "ctr1", Type: typePodman.ToCTValue()})
+	assert.Equal(t, "ctr1", waitFetcherEvent(t, outCh).FullID)
+	assert.Zero(t, docker.calls.Load())
+
+	// Others are asked once the hinted engine missed it
+	queue.Push(Request{ContainerID: "ctr2", Type: typeDocker.ToCTValue(), Cgroup: "/docker/ctr2", Pid: 42})
+	assert.Equal(t, "ctr2", waitFetcherEvent(t, outCh).FullID)
+	assert.Equal(t, int32(1), docker.calls.Load())
+	assert.Equal(t, int32(2), podman.calls.Load())
+
+	// Without hint, all engines are asked
+	queue.Push(NewRequest("ctr3"))
+	assert.Equal(t, "ctr3", waitFetcherEvent(t, outCh).FullID)
+	assert.Eventually(t, func() bool {
+		return docker.calls.Load() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint64(1), r.Snapshot().Fetcher.HintMisses)
+}
+
+func TestFetcherTypeHintTiers(t *testing.T) {
+	for name, tc := range map[string]struct {
+		ct           int
+		criFound     int32
+		expectedCrio int32
+	}{
+		"Found by cri":                 {ct: typeCri.ToCTValue(), criFound: 1, expectedCrio: 0},
+		"Missed by cri first":          {ct: typeCri.ToCTValue(), criFound: 100, expectedCrio: 1},
+		"Crio hint missed by cri":      {ct: typeCrio.ToCTValue(), criFound: 100, expectedCrio: 1},
+		"No hint, found by cri":        {ct: ctUnknown, criFound: 1, expectedCrio: 0},
+		"No hint, missed by the other": {ct: ctUnknown, criFound: 100, expectedCrio: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := stats.NewRegistry()
+			cfg := config.New(nil)
+			require.NoError(t, cfg.Load(`{"fetcher":{"retry_schedule_ms":[]}}`))
+			queue := NewRequestQueue(cfg, r.Fetcher())
+			cri := &lateGetter{found: tc.criFound}
+			crio := &lateGetter{found: 1}
+			f := newFetcher([]getter{crio, cri}, []engineType{typeCrio, typeCri}, queue, cfg, nil, r.Fetcher())
+			outCh := listenFetcher(t, f)
+
+			// CRI-O containers are only got through crio if cri misses them
+			queue.Push(Request{ContainerID: "ctr", Type: tc.ct})
+			assert.Equal(t, "ctr", waitFetcherEvent(t, outCh).FullID)
+			assert.Equal(t, int32(1), cri.calls.Load())
+			assert.Equal(t, tc.expectedCrio, crio.calls.Load())
+			assert.Zero(t, r.Snapshot().Fetcher.HintMisses)
+		})
+	}
+}
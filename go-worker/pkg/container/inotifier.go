@@ -2,15 +2,77 @@ package container
 
 import (
 	"context"
+	"github.com/FedeDP/container-worker/pkg/logger"
 	"github.com/fsnotify/fsnotify"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
+// EngineInotifier watches engines sockets: it generates engines once their socket gets created,
+// and notifies when the socket of a running engine gets removed.
 type EngineInotifier struct {
-	watcher           *fsnotify.Watcher
-	watcherGenerators map[string]EngineGenerator
+	watcher *fsnotify.Watcher
+	// Engines waiting for their socket to be created
+	pending map[EngineID]EngineGenerator
+	// Running engines, whose socket is watched for removal
+	running map[EngineID]EngineGenerator
+	log     logger.Logger
+}
+
+func NewEngineInotifier(log logger.Logger) *EngineInotifier {
+	return &EngineInotifier{
+		log:     log,
+		pending: make(map[EngineID]EngineGenerator),
+		running: make(map[EngineID]EngineGenerator),
+	}
+}
+
+// WatchCreation waits for the engine socket to be created, to then generate the engine.
+func (e *EngineInotifier) WatchCreation(id EngineID, generator EngineGenerator) {
+	delete(e.running, id)
+	if e.addWatch(id.Socket) {
+		e.log.Infof("%s: waiting for socket to be created", id)
+		e.pending[id] = generator
+	}
+}
+
+// WatchRemoval watches the socket of a running engine, to notify its removal.
+func (e *EngineInotifier) WatchRemoval(id EngineID, generator EngineGenerator) {
+	delete(e.pending, id)
+	if e.addWatch(id.Socket) {
+		e.running[id] = generator
+	}
+}
+
+// Forget stops tracking the engine; watches are kept since other sockets may rely on them.
+func (e *EngineInotifier) Forget(id EngineID) {
+	delete(e.pending, id)
+	delete(e.running, id)
+}
+
+func (e *EngineInotifier) addWatch(socket string) bool {
+	if e.watcher == nil {
+		var err error
+		e.watcher, err = fsnotify.NewWatcher()
+		if err != nil {
+			e.log.Errorf("failed to create inotify watcher: %v", err)
+			return false
+		}
+	}
+	dir := filepath.Dir(socket)
+	err := e.watcher.Add(dir)
+	if err != nil {
+		// Try to attach watcher to parent dir
+		// eg: /run/user for podman, /run/ for crio, and so on
+		dir = filepath.Dir(dir)
+		err = e.watcher.Add(dir)
+	}
+	if err != nil {
+		e.log.Warnf("failed to watch socket %s: %v", socket, err)
+		return false
+	}
+	return true
 }
 
 func (e *EngineInotifier) Listen() <-chan fsnotify.Event {
@@ -20,38 +82,79 @@ func (e *EngineInotifier) Listen() <-chan fsnotify.Event {
 	return e.watcher.Events
 }
 
-func (e *EngineInotifier) Process(ctx context.Context, val interface{}) Engine {
-	ev, _ := val.(fsnotify.Event)
-	if cb, ok := e.watcherGenerators[ev.Name]; ok {
-		_ = e.watcher.Remove(filepath.Dir(ev.Name))
-		engine, _ := cb(ctx)
-		return engine
-	} else {
-		// If the new created path is a folder, check if
-		// it is a subpath of any watcherGenerator socket,
-		// and eventually add a new watch, removing the old one
-		fileInfo, err := os.Stat(ev.Name)
-		if err != nil || !fileInfo.IsDir() {
-			return nil
+// Process handles an inotify event, returning the engines generated for newly created sockets
+// and the IDs of the running engines whose socket got removed.
+// Removed engines are automatically re-armed to wait for their socket to reappear.
+func (e *EngineInotifier) Process(ctx context.Context, ev fsnotify.Event) (map[EngineID]Engine, []EngineID) {
+	if ev.Has(fsnotify.Create) {
+		return e.processCreate(ctx, ev.Name), nil
+	}
+	if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+		return nil, e.processRemove(ev.Name)
+	}
+	return nil, nil
+}
+
+func (e *EngineInotifier) processCreate(ctx context.Context, path string) map[EngineID]Engine {
+	engines := make(map[EngineID]Engine)
+	for id, generator := range e.pending {
+		if id.Socket == path {
+			e.generate(ctx, id, generator, engines)
 		}
-		for socket, cb := range e.watcherGenerators {
-			if strings.HasPrefix(socket, ev.Name) {
-				// Remove old watch
-				_ = e.watcher.Remove(filepath.Dir(ev.Name))
-				// It may happen that the actual socket has already been created.
-				// Check it and if it is not created yet, add a new inotify watcher.
-				if _, statErr := os.Stat(socket); os.IsNotExist(statErr) {
-					// Add new watch
-					_ = e.watcher.Add(ev.Name)
-					break
-				} else {
-					engine, _ := cb(ctx)
-					return engine
-				}
+	}
+	if len(engines) > 0 {
+		return engines
+	}
+
+	// If the new created path is a folder, check if
+	// it is a subpath of any pending socket,
+	// and eventually add a new watch.
+	// Old watches are kept since other sockets may rely on them.
+	fileInfo, err := os.Stat(path)
+	if err != nil || !fileInfo.IsDir() {
+		return nil
+	}
+	for id, generator := range e.pending {
+		if strings.HasPrefix(id.Socket, path+string(filepath.Separator)) {
+			// It may happen that the actual socket has already been created.
+			// Check it and if it is not created yet, add a new inotify watcher.
+			if _, statErr := os.Stat(id.Socket); os.IsNotExist(statErr) {
+				_ = e.watcher.Add(path)
+			} else {
+				e.generate(ctx, id, generator, engines)
 			}
 		}
 	}
-	return nil
+	return engines
+}
+
+func (e *EngineInotifier) generate(ctx context.Context, id EngineID, generator EngineGenerator, engines map[EngineID]Engine) {
+	engine, err := generator(ctx)
+	if err != nil {
+		// Keep waiting for the socket to be created again
+		return
+	}
+	engines[id] = engine
+	e.WatchRemoval(id, generator)
+}
+
+func (e *EngineInotifier) processRemove(path string) []EngineID {
+	removed := make([]EngineID, 0)
+	for id, generator := range e.running {
+		if id.Socket == path {
+			e.log.Infof("%s: socket removed", id)
+			removed = append(removed, id)
+			e.WatchCreation(id, generator)
+		}
+	}
+	// Inotify drops watches on removed folders;
+	// watch again any pending socket living under the removed folder.
+	for id := range e.pending {
+		if strings.HasPrefix(id.Socket, path+string(filepath.Separator)) {
+			e.addWatch(id.Socket)
+		}
+	}
+	return removed
 }
 
 func (e *EngineInotifier) Close() {
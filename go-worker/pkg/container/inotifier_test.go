@@ -0,0 +1,76 @@
+package container
+
+import (
+	"context"
+	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeEngine struct{}
+
+func (f *fakeEngine) List(_ context.Context) ([]event.Event, error) {
+	return nil, nil
+}
+
+func (f *fakeEngine) Listen(_ context.Context, _ *sync.WaitGroup) (<-chan event.Event, error) {
+	return nil, nil
+}
+
+func (f *fakeEngine) Close() error {
+	return nil
+}
+
+// waitInotifierEvent waits for an inotify event on path
+func waitInotifierEvent(t *testing.T, inotifier *EngineInotifier, path string) fsnotify.Event {
+	for {
+		select {
+		case ev := <-inotifier.Listen():
+			if ev.Name == path {
+				return ev
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for inotify event on", path)
+		}
+	}
+}
+
+func TestInotifier(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "docker.sock")
+	id := EngineID{Type: string(typeDocker), Socket: socket}
+
+	inotifier := NewEngineInotifier(nil)
+	t.Cleanup(inotifier.Close)
+	inotifier.WatchCreation(id, func(_ context.Context) (Engine, error) {
+		return &fakeEngine{}, nil
+	})
+	require.NotNil(t, inotifier.Listen())
+
+	// Socket creation generates the engine
+	require.NoError(t, os.WriteFile(socket, nil, 0o600))
+	ev := waitInotifierEvent(t, inotifier, socket)
+	engines, removed := inotifier.Process(context.Background(), ev)
+	assert.Empty(t, removed)
+	assert.Len(t, engines, 1)
+	assert.Contains(t, engines, id)
+
+	// Socket removal tears down the engine and re-arms the watch
+	require.NoError(t, os.Remove(socket))
+	ev = waitInotifierEvent(t, inotifier, socket)
+	engines, removed = inotifier.Process(context.Background(), ev)
+	assert.Empty(t, engines)
+	assert.Equal(t, []EngineID{id}, removed)
+
+	// Socket re-creation generates the engine again
+	require.NoError(t, os.WriteFile(socket, nil, 0o600))
+	ev = waitInotifierEvent(t, inotifier, socket)
+	engines, _ = inotifier.Process(context.Background(), ev)
+	assert.Contains(t, engines, id)
+}
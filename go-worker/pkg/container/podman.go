@@ -8,6 +8,8 @@ import (
 	"errors"
 	"github.com/FedeDP/container-worker/pkg/config"
 	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/FedeDP/container-worker/pkg/logger"
+	"github.com/FedeDP/container-worker/pkg/stats"
 	"github.com/containers/podman/v5/libpod/define"
 	"github.com/containers/podman/v5/pkg/bindings"
 	"github.com/containers/podman/v5/pkg/bindings/containers"
@@ -15,9 +17,11 @@ import (
 	"github.com/containers/podman/v5/pkg/domain/entities/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/events"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const typePodman engineType = "podman"
@@ -27,20 +31,43 @@ func init() {
 }
 
 type podmanEngine struct {
-	pCtx   context.Context
-	socket string
+	pCtx    context.Context
+	pCancel context.CancelFunc
+	cfg     *config.Config
+	log     logger.Logger
+	stats   *stats.Engine
+	socket  string
 }
 
-func newPodmanEngine(ctx context.Context, socket string) (Engine, error) {
+func newPodmanEngine(ctx context.Context, cfg *config.Config, log logger.Logger, st *stats.Engine, socket string) (Engine, error) {
+	// Podman bindings bind the connection to a context;
+	// cancelling it is the only way to release the connection.
+	if isRemoteSocket(socket) && cfg.GetTLS(string(typePodman)) != nil {
+		return nil, errors.New("tls is not supported by podman bindings, use plain tcp or podman docker API through the docker engine")
+	}
+	ctx, cancel := context.WithCancel(ctx)
 	conn, err := bindings.NewConnection(ctx, enforceUnixProtocolIfEmpty(socket))
 	if err != nil {
+		cancel()
 		return nil, err
 	}
-	return &podmanEngine{pCtx: conn, socket: socket}, nil
+	return &podmanEngine{pCtx: conn, pCancel: cancel, cfg: cfg, log: log, stats: st, socket: socket}, nil
 }
 
 func (pc *podmanEngine) copy(ctx context.Context) (Engine, error) {
-	return newPodmanEngine(ctx, pc.socket)
+	return newPodmanEngine(ctx, pc.cfg, pc.log, pc.stats, pc.socket)
+}
+
+func (pc *podmanEngine) Close() error {
+	pc.pCancel()
+	// Podman bindings do not expose any close API;
+	// just release idle connections of the underlying http client.
+	conn, err := bindings.GetClient(pc.pCtx)
+	if err != nil {
+		return err
+	}
+	conn.Client.CloseIdleConnections()
+	return nil
 }
 
 func (pc *podmanEngine) ctrToInfo(ctr *define.InspectContainerData) event.Info {
@@ -100,20 +127,17 @@ func (pc *podmanEngine) ctrToInfo(ctr *define.InspectContainerData) event.Info {
 		imageTag = imageRepoTag[1]
 	}
 
-	labels := make(map[string]string)
+	labels := pc.cfg.GetLabelPolicy().Filter(cfg.Labels)
 	var (
 		livenessProbe    *event.Probe = nil
 		readinessProbe   *event.Probe = nil
 		healthcheckProbe *event.Probe = nil
 	)
 	for key, val := range cfg.Labels {
-		if len(val) <= config.GetLabelMaxLen() {
-			labels[key] = val
-		}
 		if key == k8sLastAppliedConfigLabel {
 			var k8sPodInfo k8sPodSpecInfo
 			err := json.Unmarshal([]byte(val), &k8sPodInfo)
-			if err == nil {
+			if err == nil && k8sPodInfo.Spec != nil && len(k8sPodInfo.Spec.Containers) > 0 {
 				if k8sPodInfo.Spec.Containers[0].LivenessProbe != nil {
 					livenessProbe = parseLivenessReadinessProbe(k8sPodInfo.Spec.Containers[0].LivenessProbe)
 				} else if k8sPodInfo.Spec.Containers[0].ReadinessProbe != nil {
@@ -188,10 +212,36 @@ func (pc *podmanEngine) ctrToInfo(ctr *define.InspectContainerData) event.Info {
 	}
 }
 
+// inspect inspects a container, accounting for the request in stats.
+// ctx must be derived from the podman connection context.
+func (pc *podmanEngine) inspect(ctx context.Context, containerId string) (*define.InspectContainerData, error) {
+	ctx, cancel := withRequestTimeout(ctx, pc.cfg, typePodman)
+	defer cancel()
+	size := pc.cfg.GetWithSize()
+	start := time.Now()
+	ctrInfo, err := containers.Inspect(ctx, containerId, &containers.InspectOptions{Size: &size})
+	failure := err
+	if isPodmanNotFound(err) {
+		// Not a failure: engines are asked for containers run by other engines too
+		failure = nil
+	}
+	pc.stats.Inspected(start, failure)
+	return ctrInfo, err
+}
+
+// isPodmanNotFound tells whether err is the API response for a missing container.
+func isPodmanNotFound(err error) bool {
+	code, _ := bindings.CheckResponseCode(err)
+	return code == http.StatusNotFound
+}
+
 func (pc *podmanEngine) get(_ context.Context, containerId string) (*event.Event, error) {
-	size := config.GetWithSize()
-	ctrInfo, err := containers.Inspect(pc.pCtx, containerId, &containers.InspectOptions{Size: &size})
+	ctrInfo, err := pc.inspect(pc.pCtx, containerId)
+	if isPodmanNotFound(err) {
+		return nil, nil
+	}
 	if err != nil {
+		pc.log.Debugf("failed to inspect container %s: %v", containerId, err)
 		return nil, err
 	}
 	return &event.Event{
@@ -203,14 +253,20 @@ func (pc *podmanEngine) get(_ context.Context, containerId string) (*event.Event
 func (pc *podmanEngine) List(_ context.Context) ([]event.Event, error) {
 	evts := make([]event.Event, 0)
 	all := true
-	size := config.GetWithSize()
-	cList, err := containers.List(pc.pCtx, &containers.ListOptions{All: &all})
+	// Podman bindings need the connection context
+	ctx, cancel := withListTimeout(pc.pCtx, pc.cfg, typePodman)
+	defer cancel()
+	listCtx, listCancel := withRequestTimeout(ctx, pc.cfg, typePodman)
+	cList, err := containers.List(listCtx, &containers.ListOptions{All: &all})
+	listCancel()
 	if err != nil {
 		return nil, err
 	}
 	for _, c := range cList {
-		ctrInfo, err := containers.Inspect(pc.pCtx, c.ID, &containers.InspectOptions{Size: &size})
+		ctrInfo, err := pc.inspect(ctx, c.ID)
 		if err != nil {
+			pc.log.Warnf("failed to inspect container %s, using minimum set of infos: %v", c.ID, err)
+			pc.stats.Fallback()
 			evts = append(evts, event.Event{
 				Info: event.Info{
 					Container: event.Container{
@@ -235,6 +291,36 @@ func (pc *podmanEngine) List(_ context.Context) ([]event.Event, error) {
 	return evts, nil
 }
 
+func (pc *podmanEngine) evToEvent(ev types.Event) event.Event {
+	err := errors.New("inspect useless on action destroy")
+	ctr := &define.InspectContainerData{}
+	if ev.Action == events.ActionCreate {
+		ctr, err = pc.inspect(pc.pCtx, ev.Actor.ID)
+	}
+	if err != nil {
+		if ev.Action == events.ActionCreate {
+			pc.log.Warnf("failed to inspect container %s, using minimum set of infos: %v", ev.Actor.ID, err)
+			pc.stats.Fallback()
+		}
+		// At least send an event with the minimal set of data
+		return event.Event{
+			Info: event.Info{
+				Container: event.Container{
+					Type:   typePodman.ToCTValue(),
+					ID:     shortContainerID(ev.Actor.ID),
+					FullID: ev.Actor.ID,
+					Image:  ev.Actor.Attributes["image"],
+				},
+			},
+			IsCreate: ev.Action == events.ActionCreate,
+		}
+	}
+	return event.Event{
+		Info:     pc.ctrToInfo(ctr),
+		IsCreate: ev.Action == events.ActionCreate,
+	}
+}
+
 func (pc *podmanEngine) Listen(ctx context.Context, wg *sync.WaitGroup) (<-chan event.Event, error) {
 	stream := true
 	filters := map[string][]string{
@@ -244,58 +330,77 @@ func (pc *podmanEngine) Listen(ctx context.Context, wg *sync.WaitGroup) (<-chan
 			string(events.ActionRemove),
 		},
 	}
-	evChn := make(chan types.Event)
-	cancelChan := make(chan bool)
-	wg.Add(1)
-	// producers
-	go func(ch chan types.Event) {
-		defer wg.Done()
-		_ = system.Events(pc.pCtx, ch, cancelChan, &system.EventsOptions{
-			Filters: filters,
-			Stream:  &stream,
-		})
-	}(evChn)
 
 	outCh := make(chan event.Event)
 	wg.Add(1)
 	go func() {
 		defer close(outCh)
-		defer close(cancelChan)
 		defer wg.Done()
-		size := config.GetWithSize()
-		// Blocking: convert all events from podman to json strings
-		// and send them to the main loop until the channel is closed
-		for {
-			select {
-			case <-ctx.Done():
+		defer Recover(pc.log, pc.stats, nil)
+		b := newBackoff()
+		for attempt := 0; ; attempt++ {
+			if attempt > 0 && !b.wait(ctx) {
 				return
-			case ev := <-evChn:
-				err := errors.New("inspect useless on action destroy")
-				ctr := &define.InspectContainerData{}
-				if ev.Action == events.ActionCreate {
-					ctr, err = containers.Inspect(pc.pCtx, ev.Actor.ID, &containers.InspectOptions{Size: &size})
-				}
-				if err != nil {
-					// At least send an event with the minimal set of data
-					outCh <- event.Event{
-						Info: event.Info{
-							Container: event.Container{
-								Type:   typePodman.ToCTValue(),
-								ID:     shortContainerID(ev.Actor.ID),
-								FullID: ev.Actor.ID,
-								Image:  ev.Actor.Attributes["image"],
-							},
-						},
-						IsCreate: ev.Action == events.ActionCreate,
-					}
-				} else {
-					outCh <- event.Event{
-						Info:     pc.ctrToInfo(ctr),
-						IsCreate: ev.Action == events.ActionCreate,
-					}
+			}
+			// system.Events() closes evChn once the stream ends,
+			// thus a new channel is needed for each connection.
+			evChn := make(chan types.Event)
+			cancelChan := make(chan bool)
+			err := system.Events(pc.pCtx, evChn, cancelChan, &system.EventsOptions{
+				Filters: filters,
+				Stream:  &stream,
+			})
+			if err != nil {
+				pc.log.Warnf("failed to subscribe to events: %v", err)
+				pc.stats.SetState(stats.StateReconnecting)
+				close(cancelChan)
+				continue
+			}
+			// Subscribe before listing, so that no event gets lost in between
+			if attempt > 0 {
+				relist(ctx, pc.log, pc, outCh)
+			}
+			// Blocking: convert all events from podman to json strings
+			// and send them to the main loop until the channel is closed
+			h := newStreamHealth(listenHealthyAfter, b, pc.stats)
+			done := pc.consume(ctx, evChn, h, outCh)
+			h.stop()
+			close(cancelChan)
+			// Drain any pending event so that the bindings producer can exit
+			go func() {
+				for range evChn {
 				}
+			}()
+			if done {
+				return
 			}
 		}
 	}()
 	return outCh, nil
 }
+
+// consume forwards events from evChn to outCh until either the stream
+// gets closed or ctx is done; in the latter case, it returns true.
+func (pc *podmanEngine) consume(ctx context.Context, evChn <-chan types.Event, h *streamHealth, outCh chan<- event.Event) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return true
+		case <-h.C():
+			h.healthy()
+		case ev, ok := <-evChn:
+			if !ok {
+				if ctx.Err() != nil {
+					return true
+				}
+				// Stream broken, eg: daemon restarted; reconnect.
+				pc.log.Warnf("events stream disconnected")
+				pc.stats.SetState(stats.StateReconnecting)
+				return false
+			}
+			if !send(ctx, outCh, pc.evToEvent(ev)) {
+				return true
+			}
+		}
+	}
+}
@@ -4,9 +4,12 @@ package container
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/FedeDP/container-worker/pkg/config"
 	"github.com/FedeDP/container-worker/pkg/event"
 	"github.com/containers/image/v5/manifest"
+	"github.com/containers/podman/v5/libpod/define"
 	"github.com/containers/podman/v5/pkg/bindings"
 	"github.com/containers/podman/v5/pkg/bindings/containers"
 	"github.com/containers/podman/v5/pkg/bindings/images"
@@ -51,7 +54,7 @@ func TestPodman(t *testing.T) {
 		assert.NoError(t, err)
 	}
 
-	engine, err := newPodmanEngine(context.Background(), podmanSocket)
+	engine, err := newPodmanEngine(context.Background(), config.New(nil), nil, nil, podmanSocket)
 	assert.NoError(t, err)
 
 	privileged := true
@@ -165,3 +168,21 @@ func TestPodman(t *testing.T) {
 	evt := waitOnChannelOrTimeout(t, listCh)
 	assert.Equal(t, expectedEvent, evt)
 }
+
+// FuzzPodmanCtrToInfo checks that malformed inspect responses cannot make the engine panic.
+func FuzzPodmanCtrToInfo(f *testing.F) {
+	f.Add([]byte(`{"Id":"ctr","ImageName":"alpine","Config":{"Labels":{"io.kubernetes.container.last-applied-config":"{\"spec\":{\"containers\":[]}}"}}}`))
+	f.Add([]byte(`{"Config":{"Labels":{"io.kubernetes.container.last-applied-config":"{}"},"Healthcheck":{"Test":["CMD"]}}}`))
+	f.Add([]byte(`{"ImageName":"docker.io/library/alpine:3.20@sha256:","HostConfig":{"CpusetCpus":"1-"}}`))
+
+	pc := &podmanEngine{cfg: config.New(nil)}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var ctr define.InspectContainerData
+		if json.Unmarshal(data, &ctr) != nil {
+			t.Skip()
+		}
+		assert.NotPanics(t, func() {
+			pc.ctrToInfo(&ctr)
+		})
+	})
+}
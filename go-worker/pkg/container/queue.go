@@ -0,0 +1,241 @@
+package container
+
+import (
+	"github.com/FedeDP/container-worker/pkg/config"
+	"github.com/FedeDP/container-worker/pkg/stats"
+	"slices"
+	"sync"
+)
+
+// Request asks the fetcher engine for a container.
+// Besides the container id, it carries what the plugin detected from the cgroup of the process
+// running in the container, if anything.
+type Request struct {
+	ContainerID string
+	// Container type, as a CT_ value (see src/container_type.h); ctUnknown if not known.
+	// Engines able to handle it are asked first.
+	Type   int
+	Cgroup string
+	Pid    int64
+}
+
+// NewRequest returns a request for containerId, without any hint.
+func NewRequest(containerId string) Request {
+	return Request{ContainerID: containerId, Type: ctUnknown}
+}
+
+// RequestQueue is the bounded queue of requests to be served by the fetcher engine.
+// Push never blocks, since it is called by the event processing thread:
+// when the queue is full, a request is dropped as per the configured overflow policy,
+// and its container reported through TakeDropped, so that it can be asked again.
+// The queue is owned by the worker, so that it outlives fetcher restarts.
+type RequestQueue struct {
+	mtx  sync.Mutex
+	reqs []Request
+	// Set of queued container ids, not to queue the same container twice
+	queued map[string]struct{}
+	// Containers delivered by listener engines, not to retry their lookup
+	delivered map[string]struct{}
+	// Containers whose request got dropped, to be reported as not found
+	dropped map[string]struct{}
+	closed  bool
+	// Signaled when a request is pushed
+	readyCh chan struct{}
+	// Signaled when a request is dropped
+	droppedCh chan struct{}
+	cfg       *config.Config
+	stats     *stats.Fetcher
+}
+
+// NewRequestQueue returns an empty queue, bounded as per cfg.
+func NewRequestQueue(cfg *config.Config, st *stats.Fetcher) *RequestQueue {
+	return &RequestQueue{
+		queued:    make(map[string]struct{}),
+		delivered: make(map[string]struct{}),
+		dropped:   make(map[string]struct{}),
+		readyCh:   make(chan struct{}, 1),
+		droppedCh: make(chan struct{}, 1),
+		cfg:       cfg,
+		stats:     st,
+	}
+}
+
+// Push queues req, unless a request for the same container is already queued:
+// in that case, its hints are only used if the queued one has none.
+// It is a no-op on a nil or closed queue.
+func (q *RequestQueue) Push(req Request) {
+	if q == nil {
+		return
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.closed {
+		return
+	}
+	if _, ok := q.queued[req.ContainerID]; ok {
+		q.stats.Coalesced()
+		if req.Type != ctUnknown {
+			i := slices.IndexFunc(q.reqs, func(r Request) bool {
+				return r.ContainerID == req.ContainerID
+			})
+			if q.reqs[i].Type == ctUnknown {
+				q.reqs[i] = req
+			}
+		}
+		return
+	}
+	size, policy := q.cfg.GetFetcherQueue()
+	// Loop since the queue size could have been reduced by a config reload
+	for len(q.reqs) >= size {
+		if policy == config.DropNewest {
+			q.drop(req.ContainerID)
+			return
+		}
+		q.drop(q.reqs[0].ContainerID)
+		delete(q.queued, q.reqs[0].ContainerID)
+		q.reqs = q.reqs[1:]
+	}
+	q.reqs = append(q.reqs, req)
+	q.queued[req.ContainerID] = struct{}{}
+	q.signal()
+}
+
+func (q *RequestQueue) signal() {
+	select {
+	case q.readyCh <- struct{}{}:
+	default:
+		// Already signaled
+	}
+}
+
+// drop accounts for the dropped request of containerId, to be reported by TakeDropped.
+func (q *RequestQueue) drop(containerId string) {
+	q.stats.Dropped()
+	q.dropped[containerId] = struct{}{}
+	select {
+	case q.droppedCh <- struct{}{}:
+	default:
+		// Already signaled
+	}
+}
+
+// TakeDropped returns, and forgets, the containers whose request got dropped since the last call.
+func (q *RequestQueue) TakeDropped() []string {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if len(q.dropped) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(q.dropped))
+	for id := range q.dropped {
+		ids = append(ids, id)
+	}
+	clear(q.dropped)
+	return ids
+}
+
+// Dropped returns a channel that is signaled after requests are dropped;
+// like Ready, a single signal can stand for many of them.
+func (q *RequestQueue) Dropped() <-chan struct{} {
+	return q.droppedCh
+}
+
+// Delivered tells that containerId was sent by a listener engine:
+// a queued request for it is dropped, and the fetcher stops retrying its lookup.
+func (q *RequestQueue) Delivered(containerId string) {
+	if q == nil {
+		return
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.closed {
+		return
+	}
+	if _, ok := q.queued[containerId]; ok {
+		delete(q.queued, containerId)
+		q.reqs = slices.DeleteFunc(q.reqs, func(r Request) bool {
+			return r.ContainerID == containerId
+		})
+		q.stats.Requested(true)
+		return
+	}
+	// The fetcher drains them as soon as it is signaled
+	q.delivered[containerId] = struct{}{}
+	q.signal()
+}
+
+// TakeDelivered returns, and forgets, the containers delivered since the last call.
+func (q *RequestQueue) TakeDelivered() []string {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if len(q.delivered) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(q.delivered))
+	for id := range q.delivered {
+		ids = append(ids, id)
+	}
+	clear(q.delivered)
+	return ids
+}
+
+// requeue queues again, ahead of other requests, the lookups a stopping fetcher did not complete,
+// so that they are served by the next fetcher.
+func (q *RequestQueue) requeue(reqs []Request) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.closed {
+		return
+	}
+	var left []Request
+	for _, req := range reqs {
+		if _, ok := q.queued[req.ContainerID]; !ok {
+			q.queued[req.ContainerID] = struct{}{}
+			left = append(left, req)
+		}
+	}
+	if len(left) > 0 {
+		q.reqs = append(left, q.reqs...)
+		q.signal()
+	}
+}
+
+// Pop returns the oldest queued request, if any.
+func (q *RequestQueue) Pop() (Request, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if len(q.reqs) == 0 {
+		return Request{}, false
+	}
+	req := q.reqs[0]
+	q.reqs = q.reqs[1:]
+	delete(q.queued, req.ContainerID)
+	return req, true
+}
+
+// Ready returns a channel that is signaled after requests are pushed.
+// A single signal can stand for many requests, thus Pop should be called until it returns false.
+func (q *RequestQueue) Ready() <-chan struct{} {
+	return q.readyCh
+}
+
+// Len returns the number of queued requests.
+func (q *RequestQueue) Len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return len(q.reqs)
+}
+
+// Close drops all queued requests and makes any further Push a no-op.
+func (q *RequestQueue) Close() {
+	if q == nil {
+		return
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.closed = true
+	q.reqs = nil
+	clear(q.queued)
+	clear(q.delivered)
+	clear(q.dropped)
+}
@@ -0,0 +1,146 @@
+package container
+
+import (
+	"context"
+	"github.com/FedeDP/container-worker/pkg/config"
+	"github.com/FedeDP/container-worker/pkg/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func popAll(q *RequestQueue) []string {
+	var ids []string
+	for {
+		req, ok := q.Pop()
+		if !ok {
+			return ids
+		}
+		ids = append(ids, req.ContainerID)
+	}
+}
+
+func TestRequestQueueOverflow(t *testing.T) {
+	tCases := map[string]struct {
+		policy   string
+		expected []string
+		dropped  string
+	}{
+		"drop oldest": {policy: "drop_oldest", expected: []string{"ctr2", "ctr3"}, dropped: "ctr1"},
+		"drop newest": {policy: "drop_newest", expected: []string{"ctr1", "ctr2"}, dropped: "ctr3"},
+	}
+	for name, tc := range tCases {
+		t.Run(name, func(t *testing.T) {
+			cfg := config.New(nil)
+			require.NoError(t, cfg.Load(`{"fetcher":{"queue_size":2,"overflow_policy":"`+tc.policy+`"}}`))
+			r := stats.NewRegistry()
+			q := NewRequestQueue(cfg, r.Fetcher())
+			for _, id := range []string{"ctr1", "ctr2", "ctr2", "ctr3"} {
+				q.Push(NewRequest(id))
+			}
+			assert.Equal(t, tc.expected, popAll(q))
+			s := r.Snapshot().Fetcher
+			assert.Equal(t, uint64(1), s.Coalesced)
+			assert.Equal(t, uint64(1), s.Dropped)
+			// Dropped requests are reported, once
+			select {
+			case <-q.Dropped():
+			default:
+				t.Fatal("dropped request not signaled")
+			}
+			assert.Equal(t, []string{tc.dropped}, q.TakeDropped())
+			assert.Empty(t, q.TakeDropped())
+		})
+	}
+}
+
+func TestRequestQueueShrink(t *testing.T) {
+	cfg := config.New(nil)
+	q := NewRequestQueue(cfg, nil)
+	for _, id := range []string{"ctr1", "ctr2", "ctr3"} {
+		q.Push(NewRequest(id))
+	}
+	require.NoError(t, cfg.Load(`{"fetcher":{"queue_size":1}}`))
+	q.Push(NewRequest("ctr4"))
+	assert.Equal(t, []string{"ctr4"}, popAll(q))
+}
+
+func TestRequestQueueClosed(t *testing.T) {
+	q := NewRequestQueue(config.New(nil), nil)
+	q.Push(NewRequest("ctr1"))
+	<-q.Ready()
+	q.Close()
+	q.Push(NewRequest("ctr2"))
+	assert.Zero(t, q.Len())
+	select {
+	case <-q.Ready():
+		t.Fatal("closed queue signaled a request")
+	default:
+	}
+
+	// Worker not started yet
+	var nilQueue *RequestQueue
+	nilQueue.Push(NewRequest("ctr"))
+	nilQueue.Close()
+}
+
+func TestFetcherServesEarlyRequests(t *testing.T) {
+	// Requests queued before the fetcher starts listening, eg: during a restart
+	cfg := config.New(nil)
+	queue := NewRequestQueue(cfg, nil)
+	queue.Push(NewRequest("ctr"))
+	f := newFetcher([]getter{fakeGetter{}}, nil, queue, cfg, nil, nil)
+	outCh := listenFetcher(t, f)
+	assert.Equal(t, "ctr", waitFetcherEvent(t, outCh).FullID)
+}
+
+func TestRequestQueueDelivered(t *testing.T) {
+	r := stats.NewRegistry()
+	q := NewRequestQueue(config.New(nil), r.Fetcher())
+	q.Push(NewRequest("ctr1"))
+	q.Push(NewRequest("ctr2"))
+
+	// Queued request is dropped, the other one is left to the fetcher
+	q.Delivered("ctr1")
+	q.Delivered("ctr3")
+	assert.Equal(t, []string{"ctr2"}, popAll(q))
+	assert.Equal(t, []string{"ctr3"}, q.TakeDelivered())
+	assert.Empty(t, q.TakeDelivered())
+	assert.Equal(t, uint64(1), r.Snapshot().Fetcher.Hits)
+}
+
+func TestFetcherRequeuesOnStop(t *testing.T) {
+	cfg := config.New(nil)
+	queue := NewRequestQueue(cfg, nil)
+	slow := newSlowGetter(true)
+	f := newFetcher([]getter{slow}, nil, queue, cfg, nil, nil)
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := f.Listen(ctx, &wg)
+	require.NoError(t, err)
+	queue.Push(NewRequest("ctr"))
+	assert.Eventually(t, func() bool {
+		return slow.calls.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Eg: the fetcher is restarted
+	cancel()
+	wg.Wait()
+	assert.Equal(t, []string{"ctr"}, popAll(queue))
+}
+
+func TestRequestQueueMergesHints(t *testing.T) {
+	q := NewRequestQueue(config.New(nil), nil)
+	hinted := Request{ContainerID: "ctr", Type: typeDocker.ToCTValue(), Pid: 42}
+	q.Push(NewRequest("ctr"))
+	q.Push(hinted)
+	q.Push(NewRequest("ctr"))
+
+	req, ok := q.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, hinted, req)
+	assert.Zero(t, q.Len())
+}
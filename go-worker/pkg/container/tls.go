@@ -0,0 +1,44 @@
+package container
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/FedeDP/container-worker/pkg/config"
+	"os"
+	"path/filepath"
+)
+
+// newTLSConfig returns the TLS client config for the tcp:// sockets of engine t, or nil if not configured.
+// Certificate files are read below the host root, like sockets.
+func newTLSConfig(cfg *config.Config, t engineType) (*tls.Config, error) {
+	tlsCfg := cfg.GetTLS(string(t))
+	if tlsCfg == nil {
+		return nil, nil
+	}
+	hostPath := func(path string) string {
+		return filepath.Join(cfg.GetHostRoot(), path)
+	}
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: tlsCfg.ServerName,
+	}
+	if tlsCfg.CAFile != "" {
+		pem, err := os.ReadFile(hostPath(tlsCfg.CAFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA: %w", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA %s", tlsCfg.CAFile)
+		}
+	}
+	if tlsCfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(hostPath(tlsCfg.CertFile), hostPath(tlsCfg.KeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
@@ -0,0 +1,176 @@
+package container
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/FedeDP/container-worker/pkg/config"
+	"github.com/FedeDP/container-worker/pkg/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate, signed by parent if not nil, along with its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, parent *testCert, tmpl *x509.Certificate) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and its key as PEM files in dir, returning their paths.
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	certPath := filepath.Join(dir, name+".pem")
+	keyPath := filepath.Join(dir, name+"-key.pem")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600))
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return certPath, keyPath
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// newDockerTLSStub starts a docker API stub requiring mutual TLS, serving a single container.
+// It returns its tcp:// socket, and the paths of the CA and of a client certificate.
+func newDockerTLSStub(t *testing.T) (socket, caPath, certPath, keyPath string) {
+	ca := newTestCert(t, nil, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	server := newTestCert(t, ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "docker.local"},
+		DNSNames:    []string{"docker.local"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	client := newTestCert(t, ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "worker"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	dir := t.TempDir()
+	caPath, _ = ca.write(t, dir, "ca")
+	certPath, keyPath = client.write(t, dir, "client")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_ping", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Api-Version", "1.45")
+		_, _ = w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/v1.45/containers/json", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode([]map[string]any{{
+			"Id":      testCgroupID,
+			"Image":   "alpine",
+			"ImageID": "sha256:aaaa",
+			"Created": time.Now().Unix(),
+		}})
+	})
+	mux.HandleFunc("/v1.45/containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"Id":      r.PathValue("id"),
+			"Name":    "/tls",
+			"Image":   "sha256:aaaa",
+			"Created": time.Now().Format(time.RFC3339Nano),
+			"Config":  map[string]any{"Image": "alpine"},
+			"State":   map[string]any{"Running": true},
+		})
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	srv := httptest.NewUnstartedServer(mux)
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return "tcp://" + strings.TrimPrefix(srv.URL, "https://"), caPath, certPath, keyPath
+}
+
+func TestRemoteDockerTLS(t *testing.T) {
+	socket, caPath, certPath, keyPath := newDockerTLSStub(t)
+	tCases := map[string]struct {
+		tls           string
+		expectedError bool
+	}{
+		"Mutual TLS": {
+			tls: fmt.Sprintf(`{"ca_file": %q, "cert_file": %q, "key_file": %q, "server_name": "docker.local"}`, caPath, certPath, keyPath),
+		},
+		"Without server name": {
+			// The certificate is not valid for the socket IP
+			tls:           fmt.Sprintf(`{"ca_file": %q, "cert_file": %q, "key_file": %q}`, caPath, certPath, keyPath),
+			expectedError: true,
+		},
+		"Without client certificate": {
+			tls:           fmt.Sprintf(`{"ca_file": %q, "server_name": "docker.local"}`, caPath),
+			expectedError: true,
+		},
+	}
+
+	for name, tc := range tCases {
+		t.Run(name, func(t *testing.T) {
+			cfg := config.New(nil)
+			require.NoError(t, cfg.Load(fmt.Sprintf(`{"engines": {"docker": {"enabled": true, "sockets": [%q], "tls": %s}}}`, socket, tc.tls)))
+			engine, err := newDockerEngine(context.Background(), cfg, nil, stats.NewRegistry().Engine("docker"), socket)
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = engine.Close() })
+
+			evts, err := engine.List(context.Background())
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, evts, 1)
+			assert.Equal(t, testCgroupID[:shortIDLength], evts[0].ID)
+			assert.Equal(t, "tls", evts[0].Name)
+		})
+	}
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	cfg := config.New(nil)
+	require.NoError(t, cfg.Load(`{"engines": {"docker": {"tls": {"ca_file": "/missing/ca.pem"}}}}`))
+	_, err := newTLSConfig(cfg, typeDocker)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Not configured
+	tlsCfg, err := newTLSConfig(cfg, typePodman)
+	assert.NoError(t, err)
+	assert.Nil(t, tlsCfg)
+}
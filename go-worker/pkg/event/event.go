@@ -56,6 +56,7 @@ type Container struct {
 	HealthcheckProbe *Probe            `json:"Healthcheck,omitempty"`
 	LivenessProbe    *Probe            `json:"LivenessProbe,omitempty"`
 	ReadinessProbe   *Probe            `json:"ReadinessProbe,omitempty"`
+	Namespace        string            `json:"namespace"` // containerd only
 }
 
 // Info struct wraps Container because we need the `container` struct in the json for backward compatibility.
@@ -118,10 +119,29 @@ type Info struct {
 type Event struct {
 	Info
 	IsCreate bool
+	// Only sent by the fetcher engine, once no engine found the requested container (ie: Info.ID)
+	NotFound bool
+	// Engine that found the container, as "type@socket"; only set by the fetcher engine
+	Source string
+}
+
+// EnvFilter filters the env of a container before it is serialized, eg: redacting secrets.
+type EnvFilter interface {
+	// FilterEnv returns the env to be serialized, without modifying env
+	FilterEnv(env []string) []string
 }
 
 func (i *Info) String() string {
-	str, err := json.Marshal(i)
+	return i.StringWith(nil)
+}
+
+// StringWith serializes i, with its env filtered by f if not nil; i is left untouched.
+func (i *Info) StringWith(f EnvFilter) string {
+	info := *i
+	if f != nil {
+		info.Env = f.FilterEnv(i.Env)
+	}
+	str, err := json.Marshal(&info)
 	if err != nil {
 		return ""
 	}
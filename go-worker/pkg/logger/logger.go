@@ -0,0 +1,56 @@
+package logger
+
+import "fmt"
+
+// Severity mirrors the ss_plugin_log_severity values of the plugin API,
+// so that it can be passed as is to the plugin logger.
+type Severity uint8
+
+const (
+	SeverityFatal Severity = iota + 1
+	SeverityCritical
+	SeverityError
+	SeverityWarning
+	SeverityNotice
+	SeverityInfo
+	SeverityDebug
+	SeverityTrace
+)
+
+// Logger reports a message with its severity.
+// A nil Logger discards all messages.
+// It may be called concurrently by multiple goroutines.
+type Logger func(sev Severity, msg string)
+
+func (l Logger) Logf(sev Severity, format string, args ...any) {
+	if l == nil {
+		return
+	}
+	l(sev, fmt.Sprintf(format, args...))
+}
+
+func (l Logger) Errorf(format string, args ...any) {
+	l.Logf(SeverityError, format, args...)
+}
+
+func (l Logger) Warnf(format string, args ...any) {
+	l.Logf(SeverityWarning, format, args...)
+}
+
+func (l Logger) Infof(format string, args ...any) {
+	l.Logf(SeverityInfo, format, args...)
+}
+
+func (l Logger) Debugf(format string, args ...any) {
+	l.Logf(SeverityDebug, format, args...)
+}
+
+// WithPrefix returns a Logger prepending prefix to all messages.
+func (l Logger) WithPrefix(prefix string) Logger {
+	if l == nil {
+		return nil
+	}
+	return func(sev Severity, msg string) {
+		l(sev, prefix+": "+msg)
+	}
+}
@@ -0,0 +1,29 @@
+package logger
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var (
+		sevs []Severity
+		msgs []string
+	)
+	log := Logger(func(sev Severity, msg string) {
+		sevs = append(sevs, sev)
+		msgs = append(msgs, msg)
+	})
+
+	log.Errorf("failed: %d", 1)
+	log.WithPrefix("docker@/var/run/docker.sock").Debugf("connected")
+	assert.Equal(t, []Severity{SeverityError, SeverityDebug}, sevs)
+	assert.Equal(t, []string{"failed: 1", "docker@/var/run/docker.sock: connected"}, msgs)
+
+	// A nil logger discards everything
+	var nilLog Logger
+	assert.NotPanics(t, func() {
+		nilLog.Warnf("discarded")
+		nilLog.WithPrefix("prefix").Infof("discarded")
+	})
+}
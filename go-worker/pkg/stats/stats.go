@@ -0,0 +1,398 @@
+package stats
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// State is the connection state of an engine.
+type State int32
+
+const (
+	// StateWaiting means the engine socket does not exist (yet).
+	StateWaiting State = iota
+	StateConnected
+	// StateReconnecting means the events stream broke and the engine is trying to reconnect.
+	StateReconnecting
+	// StateDisconnected means the engine stopped listening for events.
+	StateDisconnected
+	// StateDisabled means the engine got stopped for good after a panic; it is never left.
+	StateDisabled
+)
+
+func (s State) String() string {
+	switch s {
+	case StateWaiting:
+		return "waiting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateDisconnected:
+		return "disconnected"
+	case StateDisabled:
+		return "disabled"
+	default:
+		return "unknown"
+	}
+}
+
+// Number of most recent inspect latencies used to compute the p99
+const latencyWindow = 1024
+
+// Engine holds the counters of a single engine.
+// All methods are safe to be called concurrently.
+type Engine struct {
+	state           atomic.Int32
+	eventsReceived  atomic.Uint64
+	creates         atomic.Uint64
+	deletes         atomic.Uint64
+	inspectFailures atomic.Uint64
+	fallbacks       atomic.Uint64
+	filtered        atomic.Uint64
+	panics          atomic.Uint64
+	lastError       atomic.Pointer[string]
+
+	latencyMtx   sync.Mutex
+	inspects     uint64
+	latencySum   time.Duration
+	latencies    [latencyWindow]time.Duration
+	latenciesIdx int
+}
+
+// SetState updates the connection state, unless the engine is disabled;
+// a nil Engine is a no-op, like all other methods.
+func (e *Engine) SetState(state State) {
+	if e == nil {
+		return
+	}
+	for {
+		cur := e.state.Load()
+		if State(cur) == StateDisabled || e.state.CompareAndSwap(cur, int32(state)) {
+			return
+		}
+	}
+}
+
+// State returns the connection state; a nil Engine is always waiting.
+func (e *Engine) State() State {
+	if e == nil {
+		return StateWaiting
+	}
+	return State(e.state.Load())
+}
+
+// SetLastError records err as the last connection error; nil clears it, once connected.
+func (e *Engine) SetLastError(err error) {
+	if e == nil {
+		return
+	}
+	if err == nil {
+		e.lastError.Store(nil)
+		return
+	}
+	msg := err.Error()
+	e.lastError.Store(&msg)
+}
+
+// LastError returns the last connection error, if any.
+func (e *Engine) LastError() string {
+	if e == nil {
+		return ""
+	}
+	if msg := e.lastError.Load(); msg != nil {
+		return *msg
+	}
+	return ""
+}
+
+// Panicked accounts for a panic recovered from the engine code, disabling the engine.
+func (e *Engine) Panicked() {
+	if e == nil {
+		return
+	}
+	e.panics.Add(1)
+	e.state.Store(int32(StateDisabled))
+}
+
+// EventReceived accounts for an event received from the engine events stream.
+func (e *Engine) EventReceived() {
+	if e == nil {
+		return
+	}
+	e.eventsReceived.Add(1)
+}
+
+// Emitted accounts for an event sent to the plugin.
+func (e *Engine) Emitted(isCreate bool) {
+	if e == nil {
+		return
+	}
+	if isCreate {
+		e.creates.Add(1)
+	} else {
+		e.deletes.Add(1)
+	}
+}
+
+// Filtered accounts for a container not announced, since excluded by filters.
+func (e *Engine) Filtered() {
+	if e == nil {
+		return
+	}
+	e.filtered.Add(1)
+}
+
+// Fallback accounts for an event sent with the minimum set of infos.
+func (e *Engine) Fallback() {
+	if e == nil {
+		return
+	}
+	e.fallbacks.Add(1)
+}
+
+// Inspected accounts for an inspect request started at start, failed if err is not nil;
+// requests for containers the engine does not run are not failures.
+func (e *Engine) Inspected(start time.Time, err error) {
+	if e == nil {
+		return
+	}
+	if err != nil {
+		e.inspectFailures.Add(1)
+	}
+	latency := time.Since(start)
+	e.latencyMtx.Lock()
+	defer e.latencyMtx.Unlock()
+	e.inspects++
+	e.latencySum += latency
+	e.latencies[e.latenciesIdx] = latency
+	e.latenciesIdx = (e.latenciesIdx + 1) % latencyWindow
+}
+
+// EngineSnapshot is the JSON representation of Engine.
+type EngineSnapshot struct {
+	State               string `json:"state"`
+	EventsReceived      uint64 `json:"events_received"`
+	Creates             uint64 `json:"creates"`
+	Deletes             uint64 `json:"deletes"`
+	InspectFailures     uint64 `json:"inspect_failures"`
+	Fallbacks           uint64 `json:"fallbacks"`
+	Filtered            uint64 `json:"filtered"`
+	Panics              uint64 `json:"panics"`
+	InspectLatencyAvgUs int64  `json:"inspect_latency_avg_us"`
+	InspectLatencyP99Us int64  `json:"inspect_latency_p99_us"`
+	LastError           string `json:"last_error,omitempty"`
+}
+
+func (e *Engine) snapshot() EngineSnapshot {
+	s := EngineSnapshot{
+		State:           State(e.state.Load()).String(),
+		EventsReceived:  e.eventsReceived.Load(),
+		Creates:         e.creates.Load(),
+		Deletes:         e.deletes.Load(),
+		InspectFailures: e.inspectFailures.Load(),
+		Fallbacks:       e.fallbacks.Load(),
+		Filtered:        e.filtered.Load(),
+		Panics:          e.panics.Load(),
+		LastError:       e.LastError(),
+	}
+
+	e.latencyMtx.Lock()
+	defer e.latencyMtx.Unlock()
+	if e.inspects == 0 {
+		return s
+	}
+	s.InspectLatencyAvgUs = (e.latencySum / time.Duration(e.inspects)).Microseconds()
+	n := min(e.inspects, latencyWindow)
+	window := slices.Clone(e.latencies[:n])
+	slices.Sort(window)
+	// Nearest-rank percentile
+	s.InspectLatencyP99Us = window[(n*99+99)/100-1].Microseconds()
+	return s
+}
+
+// Fetcher holds the counters of the fetcher engine.
+type Fetcher struct {
+	requests     atomic.Uint64
+	hits         atomic.Uint64
+	misses       atomic.Uint64
+	coalesced    atomic.Uint64
+	negativeHits atomic.Uint64
+	dropped      atomic.Uint64
+	retries      atomic.Uint64
+	hintMisses   atomic.Uint64
+	panics       atomic.Uint64
+}
+
+// Requested accounts for a fetcher request looked up, found or not by any engine.
+func (f *Fetcher) Requested(found bool) {
+	if f == nil {
+		return
+	}
+	f.requests.Add(1)
+	if found {
+		f.hits.Add(1)
+	} else {
+		f.misses.Add(1)
+	}
+}
+
+// Coalesced accounts for a fetcher request joining a lookup already in progress.
+func (f *Fetcher) Coalesced() {
+	if f == nil {
+		return
+	}
+	f.requests.Add(1)
+	f.coalesced.Add(1)
+}
+
+// NegativeHit accounts for a fetcher request for a container recently not found, thus not looked up.
+func (f *Fetcher) NegativeHit() {
+	if f == nil {
+		return
+	}
+	f.requests.Add(1)
+	f.misses.Add(1)
+	f.negativeHits.Add(1)
+}
+
+// Dropped accounts for a fetcher request dropped since the requests queue was full.
+func (f *Fetcher) Dropped() {
+	if f == nil {
+		return
+	}
+	f.requests.Add(1)
+	f.dropped.Add(1)
+}
+
+// Retried accounts for a container not found by any engine, that is going to be looked up again.
+func (f *Fetcher) Retried() {
+	if f == nil {
+		return
+	}
+	f.retries.Add(1)
+}
+
+// HintMissed accounts for a container not found by the engines matching its type, as hinted by the request.
+func (f *Fetcher) HintMissed() {
+	if f == nil {
+		return
+	}
+	f.hintMisses.Add(1)
+}
+
+// Panicked accounts for a panic recovered while getting a container from an engine, or from the fetcher itself.
+func (f *Fetcher) Panicked() {
+	if f == nil {
+		return
+	}
+	f.panics.Add(1)
+}
+
+// FetcherSnapshot is the JSON representation of Fetcher.
+type FetcherSnapshot struct {
+	Requests          uint64 `json:"requests"`
+	Hits              uint64 `json:"hits"`
+	Misses            uint64 `json:"misses"`
+	Coalesced         uint64 `json:"coalesced"`
+	NegativeCacheHits uint64 `json:"negative_cache_hits"`
+	Dropped           uint64 `json:"dropped"`
+	Retries           uint64 `json:"retries"`
+	HintMisses        uint64 `json:"hint_misses"`
+	Panics            uint64 `json:"panics"`
+}
+
+// Registry holds the stats of a worker; engines are keyed by their EngineID string.
+type Registry struct {
+	mtx     sync.Mutex
+	engines map[string]*Engine
+	fetcher Fetcher
+	// Panics recovered outside of any engine code
+	panics atomic.Uint64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{engines: make(map[string]*Engine)}
+}
+
+// Engine returns the stats of the engine identified by id, creating them if needed.
+// Stats are kept when an engine gets restarted, so that counters are not reset.
+// A nil Registry returns nil stats, that discard everything.
+func (r *Registry) Engine(id string) *Engine {
+	if r == nil {
+		return nil
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	e, ok := r.engines[id]
+	if !ok {
+		e = &Engine{}
+		r.engines[id] = e
+	}
+	return e
+}
+
+// Remove drops the stats of an engine that is not configured anymore.
+func (r *Registry) Remove(id string) {
+	if r == nil {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	delete(r.engines, id)
+}
+
+func (r *Registry) Fetcher() *Fetcher {
+	if r == nil {
+		return nil
+	}
+	return &r.fetcher
+}
+
+// Panicked accounts for a panic recovered from the worker itself.
+func (r *Registry) Panicked() {
+	if r == nil {
+		return
+	}
+	r.panics.Add(1)
+}
+
+// Snapshot is the JSON representation of Registry.
+type Snapshot struct {
+	Engines map[string]EngineSnapshot `json:"engines"`
+	Fetcher FetcherSnapshot           `json:"fetcher"`
+	Panics  uint64                    `json:"panics"`
+}
+
+func (r *Registry) Snapshot() Snapshot {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	s := Snapshot{
+		Engines: make(map[string]EngineSnapshot, len(r.engines)),
+		Fetcher: FetcherSnapshot{
+			Requests:          r.fetcher.requests.Load(),
+			Hits:              r.fetcher.hits.Load(),
+			Misses:            r.fetcher.misses.Load(),
+			Coalesced:         r.fetcher.coalesced.Load(),
+			NegativeCacheHits: r.fetcher.negativeHits.Load(),
+			Dropped:           r.fetcher.dropped.Load(),
+			Retries:           r.fetcher.retries.Load(),
+			HintMisses:        r.fetcher.hintMisses.Load(),
+			Panics:            r.fetcher.panics.Load(),
+		},
+		Panics: r.panics.Load(),
+	}
+	for id, e := range r.engines {
+		s.Engines[id] = e.snapshot()
+	}
+	return s
+}
+
+func (r *Registry) JSON() string {
+	// Cannot fail: Snapshot only holds plain types
+	data, _ := json.Marshal(r.Snapshot())
+	return string(data)
+}
@@ -0,0 +1,89 @@
+package stats
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestEngineStats(t *testing.T) {
+	r := NewRegistry()
+	e := r.Engine("docker@/var/run/docker.sock")
+	assert.Same(t, e, r.Engine("docker@/var/run/docker.sock"))
+
+	e.SetState(StateConnected)
+	e.EventReceived()
+	e.Emitted(true)
+	e.Emitted(true)
+	e.Emitted(false)
+	e.Fallback()
+	e.Filtered()
+	e.SetLastError(errors.New("connection refused"))
+	// 99 fast inspects and a slow failing one
+	for i := 0; i < 99; i++ {
+		e.Inspected(time.Now(), nil)
+	}
+	e.Inspected(time.Now().Add(-time.Second), errors.New("timeout"))
+	r.Fetcher().Requested(true)
+	r.Fetcher().Requested(false)
+	r.Fetcher().Coalesced()
+	r.Fetcher().NegativeHit()
+	r.Fetcher().Dropped()
+	r.Fetcher().Retried()
+	r.Fetcher().HintMissed()
+
+	var snapshot Snapshot
+	require.NoError(t, json.Unmarshal([]byte(r.JSON()), &snapshot))
+	s := snapshot.Engines["docker@/var/run/docker.sock"]
+	assert.Equal(t, "connected", s.State)
+	assert.Equal(t, uint64(1), s.EventsReceived)
+	assert.Equal(t, uint64(2), s.Creates)
+	assert.Equal(t, uint64(1), s.Deletes)
+	assert.Equal(t, uint64(1), s.InspectFailures)
+	assert.Equal(t, uint64(1), s.Fallbacks)
+	assert.Equal(t, uint64(1), s.Filtered)
+	assert.Equal(t, "connection refused", s.LastError)
+	assert.GreaterOrEqual(t, s.InspectLatencyAvgUs, int64(10000))
+	// Nearest-rank p99 of 100 samples is the 99th one, ie: a fast inspect
+	assert.Less(t, s.InspectLatencyP99Us, int64(1000000))
+	assert.Equal(t, FetcherSnapshot{Requests: 5, Hits: 1, Misses: 2, Coalesced: 1, NegativeCacheHits: 1, Dropped: 1, Retries: 1, HintMisses: 1}, snapshot.Fetcher)
+
+	// Cleared once connected
+	e.SetLastError(nil)
+	assert.Empty(t, r.Snapshot().Engines["docker@/var/run/docker.sock"].LastError)
+
+	r.Remove("docker@/var/run/docker.sock")
+	assert.Empty(t, r.Snapshot().Engines)
+}
+
+func TestPanicStats(t *testing.T) {
+	r := NewRegistry()
+	e := r.Engine("docker@/var/run/docker.sock")
+	e.SetState(StateConnected)
+	e.Panicked()
+	// Disabled is final
+	e.SetState(StateConnected)
+	assert.Equal(t, StateDisabled, e.State())
+	r.Fetcher().Panicked()
+	r.Panicked()
+
+	s := r.Snapshot()
+	assert.Equal(t, "disabled", s.Engines["docker@/var/run/docker.sock"].State)
+	assert.Equal(t, uint64(1), s.Engines["docker@/var/run/docker.sock"].Panics)
+	assert.Equal(t, uint64(1), s.Fetcher.Panics)
+	assert.Equal(t, uint64(1), s.Panics)
+}
+
+func TestNilStats(t *testing.T) {
+	var r *Registry
+	assert.NotPanics(t, func() {
+		r.Engine("docker@/var/run/docker.sock").Inspected(time.Now(), nil)
+		r.Fetcher().Requested(true)
+		r.Engine("docker@/var/run/docker.sock").Panicked()
+		r.Panicked()
+		r.Remove("docker@/var/run/docker.sock")
+	})
+}
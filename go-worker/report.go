@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/FedeDP/container-worker/pkg/config"
+	"github.com/FedeDP/container-worker/pkg/container"
+	"slices"
+	"strings"
+)
+
+// Engine statuses reported at startup
+const (
+	// Socket exists; the engine is being connected in background
+	engineStatusConnecting    = "connecting"
+	engineStatusMissingSocket = "missing_socket"
+	// Socket exists but refused the connection; the engine waits for it to be created again
+	engineStatusFailed = "failed"
+)
+
+type configError struct {
+	Key   string `json:"key,omitempty"`
+	Error string `json:"error"`
+}
+
+type engineStatus struct {
+	Engine string `json:"engine"`
+	Socket string `json:"socket"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newEngineStatus(id container.EngineID, status string, err error) engineStatus {
+	s := engineStatus{Engine: id.Type, Socket: id.Socket, Status: status}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+// startupReport describes the outcome of StartWorker.
+// Engines are connected in background, thus later connection failures are only
+// reported through the last_error of engine stats; engines waiting for their socket
+// or whose socket refused the connection make the worker run in degraded mode.
+type startupReport struct {
+	ConfigErrors []configError  `json:"config_errors,omitempty"`
+	Engines      []engineStatus `json:"engines"`
+	Running      bool           `json:"running"`
+	Degraded     bool           `json:"degraded"`
+}
+
+func newStartupReport(cfgErr error, engines []engineStatus) startupReport {
+	report := startupReport{
+		Engines: make([]engineStatus, 0, len(engines)),
+		Running: cfgErr == nil,
+	}
+	report.Engines = append(report.Engines, engines...)
+	// Engines are started in random order
+	slices.SortFunc(report.Engines, func(a, b engineStatus) int {
+		return strings.Compare(a.Engine+a.Socket, b.Engine+b.Socket)
+	})
+	if cfgErr != nil {
+		var keyErrs config.Errors
+		if errors.As(cfgErr, &keyErrs) {
+			for _, keyErr := range keyErrs {
+				report.ConfigErrors = append(report.ConfigErrors, configError{Key: keyErr.Key, Error: keyErr.Err.Error()})
+			}
+		} else {
+			report.ConfigErrors = append(report.ConfigErrors, configError{Error: cfgErr.Error()})
+		}
+	}
+	for _, e := range engines {
+		if e.Status == engineStatusMissingSocket || e.Status == engineStatusFailed {
+			report.Degraded = true
+		}
+	}
+	return report
+}
+
+func (r startupReport) String() string {
+	// Cannot fail: startupReport only holds plain types
+	data, _ := json.Marshal(r)
+	return string(data)
+}
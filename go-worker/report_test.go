@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/FedeDP/container-worker/pkg/config"
+	"github.com/FedeDP/container-worker/pkg/container"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestStartupReportConfigError(t *testing.T) {
+	err := config.New(nil).Load(`{"engines": {"docker": {"enabled": "yes"}}}`)
+	require.Error(t, err)
+
+	report := newStartupReport(err, nil)
+	assert.False(t, report.Running)
+	require.Len(t, report.ConfigErrors, 1)
+	assert.Equal(t, "engines.docker.enabled", report.ConfigErrors[0].Key)
+
+	// All invalid keys are reported
+	err = config.New(nil).Load(`{"label_max_len": -1, "engines": {"docker": {"socket": []}}}`)
+	require.Error(t, err)
+	report = newStartupReport(err, nil)
+	require.Len(t, report.ConfigErrors, 2)
+	assert.Equal(t, "engines.docker.socket", report.ConfigErrors[0].Key)
+	assert.Equal(t, "label_max_len", report.ConfigErrors[1].Key)
+
+	// Syntax errors cannot be attributed to any key
+	err = config.New(nil).Load(`{"engines":`)
+	require.Error(t, err)
+	report = newStartupReport(err, nil)
+	require.Len(t, report.ConfigErrors, 1)
+	assert.Empty(t, report.ConfigErrors[0].Key)
+}
+
+func TestStartupReportMissingSockets(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "docker.sock")
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := config.New(nil)
+	w := newWorker(func(string, bool) {}, nil, nil, nil, cfg, &wg)
+	t.Cleanup(func() {
+		cancel()
+		w.mux.close()
+		w.inotifier.Close()
+		wg.Wait()
+	})
+
+	require.NoError(t, cfg.Load(fmt.Sprintf(`{"engines": {"docker": {"enabled": true, "sockets": [%q]}}}`, socket)))
+	report := newStartupReport(nil, w.applyConfig(ctx))
+	assert.True(t, report.Running)
+	assert.True(t, report.Degraded)
+	require.Len(t, report.Engines, 1)
+	assert.Equal(t, engineStatus{
+		Engine: "docker",
+		Socket: socket,
+		Status: engineStatusMissingSocket,
+		Error:  report.Engines[0].Error,
+	}, report.Engines[0])
+
+	// The report is valid json
+	var decoded map[string]any
+	require.NoError(t, json.Unmarshal([]byte(report.String()), &decoded))
+	assert.Equal(t, true, decoded["degraded"])
+}
+
+func TestStartupReportFailedEngines(t *testing.T) {
+	dir := t.TempDir()
+	// Stale socket of a stopped daemon
+	socket := filepath.Join(dir, "docker.sock")
+	require.NoError(t, os.WriteFile(socket, nil, 0o600))
+
+	w, ctx := newTestWorker(t, func(string, bool) {}, nil)
+	require.NoError(t, w.cfg.Load(fmt.Sprintf(`{"engines": {"docker": {"enabled": true, "sockets": [%q]}}}`, socket)))
+	report := newStartupReport(nil, w.applyConfig(ctx))
+	assert.True(t, report.Running)
+	assert.True(t, report.Degraded)
+	require.Len(t, report.Engines, 1)
+	assert.Equal(t, engineStatusFailed, report.Engines[0].Status)
+	assert.NotEmpty(t, report.Engines[0].Error)
+
+	// The reason is kept in the engine stats too
+	id := container.EngineID{Type: "docker", Socket: socket}
+	assert.Equal(t, report.Engines[0].Error, w.stats.Snapshot().Engines[id.String()].LastError)
+	assert.NotContains(t, w.starting, id)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"github.com/FedeDP/container-worker/pkg/container"
+	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/FedeDP/container-worker/pkg/logger"
+	"github.com/FedeDP/container-worker/pkg/stats"
+	"time"
+)
+
+// trackedContainer is a container announced through the async callback.
+type trackedContainer struct {
+	// Minimum set of infos needed to emit a delete event
+	info event.Container
+	// Last time the container was announced as created or deleted
+	ts time.Time
+	// Deleted containers are kept as tombstones until next resync,
+	// to avoid re-creating them if the resync listing raced with their deletion.
+	deleted bool
+	// Excluded containers are tracked but never announced,
+	// so that neither resyncs nor their delete events announce them.
+	excluded bool
+}
+
+// tracker tracks, per engine, the containers announced through the async callback.
+type tracker map[container.EngineID]map[string]*trackedContainer
+
+func (t tracker) track(id container.EngineID, evt event.Event) {
+	t.add(id, evt, false)
+}
+
+// exclude tracks a container excluded by filters.
+func (t tracker) exclude(id container.EngineID, evt event.Event) {
+	t.add(id, evt, true)
+}
+
+// isExcluded tells whether the container with the given full id was excluded by filters.
+func (t tracker) isExcluded(id container.EngineID, fullID string) bool {
+	tracked, ok := t[id][fullID]
+	return ok && tracked.excluded
+}
+
+// isAnnouncedBy tells whether the engine announced the container with the given full id, and not its deletion.
+func (t tracker) isAnnouncedBy(id container.EngineID, fullID string) bool {
+	tracked, ok := t[id][fullID]
+	return ok && !tracked.excluded && !tracked.deleted
+}
+
+// isAnnounced tells whether any engine announced the container with the given full id, and not its deletion.
+func (t tracker) isAnnounced(fullID string) bool {
+	for id := range t {
+		if t.isAnnouncedBy(id, fullID) {
+			return true
+		}
+	}
+	return false
+}
+
+// tombstone marks the container deleted by evt as such for all the engines that announced it.
+func (t tracker) tombstone(evt event.Event) {
+	for id := range t {
+		if t.isAnnouncedBy(id, evt.FullID) {
+			t.add(id, evt, false)
+		}
+	}
+}
+
+func (t tracker) add(id container.EngineID, evt event.Event, excluded bool) {
+	ctrs, ok := t[id]
+	if !ok {
+		ctrs = make(map[string]*trackedContainer)
+		t[id] = ctrs
+	}
+	ctrs[evt.FullID] = &trackedContainer{
+		info: event.Container{
+			Type:   evt.Type,
+			ID:     evt.ID,
+			FullID: evt.FullID,
+			Image:  evt.Image,
+		},
+		ts:       time.Now(),
+		deleted:  !evt.IsCreate,
+		excluded: excluded,
+	}
+}
+
+// forget drops all containers tracked for an engine.
+func (t tracker) forget(id container.EngineID) {
+	delete(t, id)
+}
+
+// forgetExcluded drops all containers excluded by filters,
+// so that next resync filters them again, eg: after filters changed.
+func (t tracker) forgetExcluded() {
+	for _, ctrs := range t {
+		for fullID, tracked := range ctrs {
+			if tracked.excluded {
+				delete(ctrs, fullID)
+			}
+		}
+	}
+}
+
+// resyncResult holds the containers listed from an engine by a resync.
+type resyncResult struct {
+	id        container.EngineID
+	startTime time.Time
+	evts      []event.Event
+}
+
+// listForResync lists all the given engines and sends the results to resultsCh,
+// unless done gets closed in the meantime, ie: the loop reading resultsCh exited.
+// It is meant to be run in its own goroutine, not to stall the worker loop.
+// Engines panicking while listed get disabled in st.
+func listForResync(ctx context.Context, done <-chan struct{}, log logger.Logger, st *stats.Registry, engines map[container.EngineID]container.Engine, resultsCh chan<- []resyncResult) {
+	results := make([]resyncResult, 0, len(engines))
+	for id, engine := range engines {
+		startTime := time.Now()
+		evts, err := safeList(ctx, log, st, id, engine)
+		if err != nil {
+			// Engine not reachable; we don't know anything about its containers.
+			log.Debugf("%s: skipping resync, failed to list containers: %v", id, err)
+			continue
+		}
+		results = append(results, resyncResult{id: id, startTime: startTime, evts: evts})
+	}
+	select {
+	case <-ctx.Done():
+	case <-done:
+	case resultsCh <- results:
+	}
+}
+
+// diff compares the listed containers against the tracked ones for an engine,
+// returning synthetic create events for missing containers
+// and delete events for containers that no longer exist.
+// Containers announced after the listing started are skipped, since the listing may not reflect them.
+func (t tracker) diff(res resyncResult) []event.Event {
+	evts := make([]event.Event, 0)
+	ctrs := t[res.id]
+	listed := make(map[string]struct{}, len(res.evts))
+	for _, evt := range res.evts {
+		listed[evt.FullID] = struct{}{}
+		tracked, ok := ctrs[evt.FullID]
+		if ok && (!tracked.deleted || tracked.ts.After(res.startTime)) {
+			continue
+		}
+		evts = append(evts, evt)
+	}
+	for fullID, tracked := range ctrs {
+		if tracked.deleted {
+			if tracked.ts.Before(res.startTime) {
+				// Prune old tombstones
+				delete(ctrs, fullID)
+			}
+			continue
+		}
+		if _, ok := listed[fullID]; !ok && tracked.ts.Before(res.startTime) {
+			evts = append(evts, event.Event{
+				Info:     event.Info{Container: tracked.info},
+				IsCreate: false,
+			})
+		}
+	}
+	return evts
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"github.com/FedeDP/container-worker/pkg/container"
+	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func testEvent(fullID string, isCreate bool) event.Event {
+	return event.Event{
+		Info: event.Info{
+			Container: event.Container{
+				ID:     fullID,
+				FullID: fullID,
+				Image:  "alpine:3.20.3",
+			},
+		},
+		IsCreate: isCreate,
+	}
+}
+
+func TestTrackerDiff(t *testing.T) {
+	id := container.EngineID{Type: "docker", Socket: "/var/run/docker.sock"}
+	tracked := make(tracker)
+	tracked.track(id, testEvent("running", true))
+	tracked.track(id, testEvent("vanished", true))
+	tracked.track(id, testEvent("deleted", true))
+	tracked.track(id, testEvent("deleted", false))
+
+	time.Sleep(time.Millisecond)
+	startTime := time.Now()
+	time.Sleep(time.Millisecond)
+	// Announced after the listing started: must not be deleted
+	tracked.track(id, testEvent("late", true))
+
+	evts := tracked.diff(resyncResult{
+		id:        id,
+		startTime: startTime,
+		evts: []event.Event{
+			testEvent("running", true),
+			testEvent("missed", true),
+		},
+	})
+	assert.ElementsMatch(t, []event.Event{
+		testEvent("missed", true),
+		testEvent("vanished", false),
+	}, evts)
+	// Old tombstones get pruned
+	assert.NotContains(t, tracked[id], "deleted")
+}
+
+func TestTrackerDiffRacingDelete(t *testing.T) {
+	id := container.EngineID{Type: "docker", Socket: "/var/run/docker.sock"}
+	tracked := make(tracker)
+	startTime := time.Now()
+	time.Sleep(time.Millisecond)
+	// Deleted while the listing was running: the listing still reports it
+	tracked.track(id, testEvent("racing", true))
+	tracked.track(id, testEvent("racing", false))
+
+	evts := tracked.diff(resyncResult{
+		id:        id,
+		startTime: startTime,
+		evts:      []event.Event{testEvent("racing", true)},
+	})
+	assert.Empty(t, evts)
+	// Tombstone is kept until next resync
+	assert.Contains(t, tracked[id], "racing")
+}
+
+func TestListForResyncLoopExited(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+	returned := make(chan struct{})
+	go func() {
+		// Nobody reads the results anymore
+		listForResync(context.Background(), done, nil, nil, nil, make(chan []resyncResult))
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("resync blocked after the loop exited")
+	}
+}
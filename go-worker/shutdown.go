@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Max time StopWorker waits for the worker goroutines to exit, when no deadline is given
+const defaultStopTimeout = 5 * time.Second
+
+// cGate guards calls into C callbacks, allowing to guarantee that no callback
+// runs once the worker is stopped, even if some goroutine outlived the stop deadline.
+type cGate struct {
+	mu     sync.RWMutex
+	closed bool
+}
+
+// enter returns whether C callbacks can be called; if so, exit must be called afterwards.
+func (g *cGate) enter() bool {
+	g.mu.RLock()
+	if g.closed {
+		g.mu.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (g *cGate) exit() {
+	g.mu.RUnlock()
+}
+
+// close waits for running callbacks to return and prevents any further one.
+func (g *cGate) close() {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+}
+
+// stop cancels the worker context and waits up to timeout for all its goroutines to exit.
+// Whatever the outcome, no C callback is called once stop returns.
+// Returns false if some goroutine did not exit in time; they are left behind.
+func (p *PluginCtx) stop(timeout time.Duration) bool {
+	if p.fetchQueue != nil {
+		p.fetchQueue.Close()
+	}
+	p.ctxCancel()
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	stopped := true
+	select {
+	case <-done:
+	case <-timer.C:
+		p.log.Errorf("timed out after %v waiting for the worker to stop, leaving it behind", timeout)
+		stopped = false
+	}
+	p.gate.close()
+	return stopped
+}
+
+// abort stops a worker whose startup failed midway, releasing w if not nil.
+// Returns false if some goroutine did not exit in time, like stop.
+func (p *PluginCtx) abort(w *worker) bool {
+	p.ctxCancel()
+	if w != nil && p.reloadCh == nil {
+		// Worker goroutine not running, thus not releasing the engines on its own
+		w.fetchQueue.Close()
+		w.shutdown()
+	}
+	return p.stop(defaultStopTimeout)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/FedeDP/container-worker/pkg/config"
+	"github.com/FedeDP/container-worker/pkg/container"
+	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// floodEngine sends events as fast as they are received, until its Listen context is done.
+type floodEngine struct {
+	fakeEngine
+	prefix string
+}
+
+func (f *floodEngine) Listen(ctx context.Context, wg *sync.WaitGroup) (<-chan event.Event, error) {
+	outCh := make(chan event.Event)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(outCh)
+		for i := 0; ; i++ {
+			select {
+			case <-ctx.Done():
+				return
+			case outCh <- testEvent(fmt.Sprintf("%s_%d", f.prefix, i), true):
+			}
+		}
+	}()
+	return outCh, nil
+}
+
+// newTestPluginCtx returns a PluginCtx whose callback is gated like the one built by StartWorker,
+// counting the events it receives.
+func newTestPluginCtx(t *testing.T) (*PluginCtx, *worker, context.Context, *atomic.Int64) {
+	p := &PluginCtx{}
+	var ctx context.Context
+	ctx, p.ctxCancel = context.WithCancel(context.Background())
+	var received atomic.Int64
+	cb := func(string, bool) {
+		if !p.gate.enter() {
+			return
+		}
+		defer p.gate.exit()
+		received.Add(1)
+	}
+	w := newWorker(cb, nil, nil, nil, config.New(nil), &p.wg)
+	t.Cleanup(func() {
+		p.ctxCancel()
+	})
+	return p, w, ctx, &received
+}
+
+func startFakeEngine(t *testing.T, w *worker, ctx context.Context, name string, generator container.EngineGenerator) {
+	socket := filepath.Join(t.TempDir(), name+".sock")
+	listenSocket(t, socket)
+	w.startEngine(ctx, container.EngineID{Type: "docker", Socket: socket}, generator)
+}
+
+func TestStopUnderLoad(t *testing.T) {
+	p, w, ctx, received := newTestPluginCtx(t)
+	engines := make([]*floodEngine, 16)
+	for i := range engines {
+		engines[i] = &floodEngine{prefix: fmt.Sprintf("engine%d", i)}
+		engine := engines[i]
+		startFakeEngine(t, w, ctx, engine.prefix, func(_ context.Context) (container.Engine, error) {
+			return engine, nil
+		})
+	}
+	p.run(ctx, w)
+	assert.Eventually(t, func() bool {
+		return received.Load() > 1000
+	}, 5*time.Second, 10*time.Millisecond)
+
+	start := time.Now()
+	assert.True(t, p.stop(5*time.Second))
+	assert.Less(t, time.Since(start), time.Second)
+	for _, engine := range engines {
+		assert.True(t, engine.closed.Load())
+	}
+
+	// No callback once stopped
+	last := received.Load()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, last, received.Load())
+}
+
+func TestStopWhileConnecting(t *testing.T) {
+	p, w, ctx, _ := newTestPluginCtx(t)
+	unblock := make(chan struct{})
+	t.Cleanup(func() { close(unblock) })
+	// Engine ignoring ctx while connecting
+	startFakeEngine(t, w, ctx, "hung", func(_ context.Context) (container.Engine, error) {
+		<-unblock
+		return &fakeEngine{}, nil
+	})
+	p.run(ctx, w)
+
+	start := time.Now()
+	assert.True(t, p.stop(5*time.Second))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestStopWhileReloading(t *testing.T) {
+	p, w, ctx, _ := newTestPluginCtx(t)
+	p.run(ctx, w)
+
+	// Requests racing with stop must not block forever
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-p.ctx.Done():
+			case p.reloadCh <- struct{}{}:
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			p.fetchQueue.Push(container.NewRequest("ctr"))
+		}()
+	}
+	assert.True(t, p.stop(5*time.Second))
+	wg.Wait()
+}
+
+func TestStopDeadline(t *testing.T) {
+	p, w, ctx, received := newTestPluginCtx(t)
+	p.run(ctx, w)
+
+	// Goroutine not honoring ctx, that calls the callback once released
+	release := make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		<-release
+		w.cb("{}", true)
+	}()
+
+	start := time.Now()
+	assert.False(t, p.stop(100*time.Millisecond))
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// The lingering goroutine cannot reach the callback anymore
+	close(release)
+	p.wg.Wait()
+	assert.Zero(t, received.Load())
+}
+
+func TestFetchAfterStop(t *testing.T) {
+	p, w, ctx, _ := newTestPluginCtx(t)
+	// Not started yet
+	AskForContainerInfo(nil, nil)
+	p.run(ctx, w)
+	assert.True(t, p.stop(5*time.Second))
+
+	// Requests never block, and are discarded
+	p.fetchQueue.Push(container.NewRequest("ctr"))
+	assert.Zero(t, w.fetchQueue.Len())
+}
+
+func TestAbortStartup(t *testing.T) {
+	p, w, ctx, _ := newTestPluginCtx(t)
+	// Engines and fetcher started, but not the worker goroutine
+	startFakeEngine(t, w, ctx, "connecting", func(_ context.Context) (container.Engine, error) {
+		return &fakeEngine{}, nil
+	})
+	w.startEngine(ctx, container.EngineID{Type: "docker", Socket: filepath.Join(t.TempDir(), "missing.sock")}, nil)
+	w.updateFetcher(ctx)
+	require.Contains(t, w.listeners, fetcherID)
+
+	start := time.Now()
+	assert.True(t, p.abort(w))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Empty(t, w.listeners)
+}
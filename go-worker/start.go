@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/FedeDP/container-worker/pkg/container"
+	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/FedeDP/container-worker/pkg/stats"
+	"time"
+)
+
+var errConnectTimeout = errors.New("timed out connecting to the engine")
+
+// Delay before connecting again to a remote engine, that has no socket file to be watched
+const remoteRetryDelay = 5 * time.Second
+
+// pendingStart tracks an engine being started in background,
+// allowing to discard its outcome if the engine gets stopped in the meantime.
+type pendingStart struct {
+	// Cancels the context the engine is generated with, thus the engine itself,
+	// since some engines (eg: podman) bind their connection to it;
+	// only called if the start is aborted or fails, or once the engine is stopped.
+	cancel context.CancelFunc
+}
+
+// engineStart is the outcome of a background engine startup.
+type engineStart struct {
+	id        container.EngineID
+	generator container.EngineGenerator
+	pending   *pendingStart
+	engine    container.Engine
+	// Set if the engine could not be generated
+	err  error
+	evts []event.Event
+	// Set if the initial listing failed
+	listErr error
+}
+
+// generateWithTimeout generates an engine, giving up after timeout.
+// Since not all engines honor ctx while connecting, the generator
+// is left running in background and its engine is closed once generated.
+func generateWithTimeout(ctx context.Context, generator container.EngineGenerator, timeout time.Duration) (container.Engine, error) {
+	type result struct {
+		engine container.Engine
+		err    error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		engine, err := generator(ctx)
+		resCh <- result{engine: engine, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-resCh:
+		return res.engine, res.err
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+	go func() {
+		if res := <-resCh; res.engine != nil {
+			_ = res.engine.Close()
+		}
+	}()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, errConnectTimeout
+}
+
+// connectEngine connects to the engine and lists its containers in background, after delay;
+// the outcome is sent to the worker loop through startedCh.
+func (w *worker) connectEngine(ctx context.Context, id container.EngineID, generator container.EngineGenerator, delay time.Duration) {
+	eCtx, cancel := context.WithCancel(ctx)
+	p := &pendingStart{cancel: cancel}
+	w.starting[id] = p
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer w.recoverPanic()
+		if delay > 0 {
+			select {
+			case <-eCtx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+		res := engineStart{id: id, generator: generator, pending: p}
+		res.engine, res.err = generateWithTimeout(eCtx, generator, w.cfg.GetTimeouts(id.Type).Connect)
+		if res.err == nil {
+			// Engines bound their listing through the configured list timeout
+			res.evts, res.listErr = safeList(eCtx, w.log, w.stats, id, res.engine)
+		}
+		select {
+		case <-eCtx.Done():
+			if res.engine != nil {
+				_ = res.engine.Close()
+			}
+		case w.startedCh <- res:
+		}
+	}()
+}
+
+// onEngineStarted handles the outcome of a background engine startup.
+func (w *worker) onEngineStarted(ctx context.Context, res engineStart) {
+	if p, ok := w.starting[res.id]; !ok || p != res.pending {
+		// Engine stopped (and maybe started again) in the meantime
+		if res.engine != nil {
+			_ = res.engine.Close()
+		}
+		return
+	}
+	delete(w.starting, res.id)
+
+	if w.stats.Engine(res.id.String()).State() == stats.StateDisabled {
+		// Panicked while starting
+		if res.engine != nil {
+			_ = res.engine.Close()
+		}
+		res.pending.cancel()
+		w.disableEngine(ctx, res.id)
+		return
+	}
+	if res.err != nil {
+		res.pending.cancel()
+		w.stats.Engine(res.id.String()).SetLastError(res.err)
+		if errors.Is(res.err, errConnectTimeout) {
+			w.log.Warnf("%s: %v", res.id, res.err)
+		}
+		if res.id.IsRemote() {
+			w.connectEngine(ctx, res.id, res.generator, remoteRetryDelay)
+			return
+		}
+		// Wait for the socket to be created again, eg: stale socket of a stopped daemon
+		w.inotifier.WatchCreation(res.id, res.generator)
+		return
+	}
+	if !res.id.IsRemote() {
+		w.inotifier.WatchRemoval(res.id, res.generator)
+	}
+	if res.listErr != nil {
+		w.log.Warnf("%s: failed to list containers: %v", res.id, res.listErr)
+	}
+	for _, evt := range res.evts {
+		w.notify(res.id, evt)
+	}
+	if w.addListener(ctx, res.id, res.engine) != nil {
+		res.pending.cancel()
+		return
+	}
+	// The engine context lives as long as the engine
+	w.listeners[res.id].release = res.pending.cancel
+	w.updateFetcher(ctx)
+	if res.listErr == nil && w.onSynced != nil {
+		// All pre-existing containers have been delivered
+		w.onSynced(res.id)
+	}
+}
+
+// cancelStart stops a background engine startup, if any.
+func (w *worker) cancelStart(id container.EngineID) {
+	if p, ok := w.starting[id]; ok {
+		p.cancel()
+		delete(w.starting, id)
+	}
+}
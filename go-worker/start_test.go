@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"github.com/FedeDP/container-worker/pkg/config"
+	"github.com/FedeDP/container-worker/pkg/container"
+	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeEngine struct {
+	evts   []event.Event
+	closed atomic.Bool
+}
+
+func (f *fakeEngine) List(_ context.Context) ([]event.Event, error) {
+	return f.evts, nil
+}
+
+func (f *fakeEngine) Listen(ctx context.Context, wg *sync.WaitGroup) (<-chan event.Event, error) {
+	outCh := make(chan event.Event)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(outCh)
+		<-ctx.Done()
+	}()
+	return outCh, nil
+}
+
+func (f *fakeEngine) Close() error {
+	f.closed.Store(true)
+	return nil
+}
+
+// listenSocket makes socket accept connections, like the one of a running engine.
+func listenSocket(t *testing.T, socket string) {
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+}
+
+func newTestWorker(t *testing.T, cb asyncCb, onSynced func(container.EngineID)) (*worker, context.Context) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	w := newWorker(cb, onSynced, nil, nil, config.New(nil), &wg)
+	t.Cleanup(func() {
+		cancel()
+		for id := range w.listeners {
+			w.removeListener(id)
+		}
+		w.mux.close()
+		w.inotifier.Close()
+		wg.Wait()
+	})
+	return w, ctx
+}
+
+func waitEngineStart(t *testing.T, w *worker) engineStart {
+	select {
+	case res := <-w.startedCh:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for engine startup")
+	}
+	return engineStart{}
+}
+
+func TestStartEngineAsync(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listenSocket(t, socket)
+	id := container.EngineID{Type: "docker", Socket: socket}
+
+	var (
+		notified []string
+		synced   []container.EngineID
+	)
+	w, ctx := newTestWorker(t, func(json string, _ bool) {
+		notified = append(notified, json)
+	}, func(id container.EngineID) {
+		synced = append(synced, id)
+	})
+
+	// A slow engine does not block startEngine
+	unblock := make(chan struct{})
+	engine := &fakeEngine{evts: []event.Event{testEvent("ctr1", true), testEvent("ctr2", true)}}
+	status := w.startEngine(ctx, id, func(_ context.Context) (container.Engine, error) {
+		<-unblock
+		return engine, nil
+	})
+	assert.Equal(t, engineStatusConnecting, status.Status)
+	assert.Empty(t, notified)
+
+	close(unblock)
+	w.onEngineStarted(ctx, waitEngineStart(t, w))
+	assert.Len(t, notified, 2)
+	assert.Equal(t, []container.EngineID{id}, synced)
+	assert.Contains(t, w.listeners, id)
+	assert.Empty(t, w.starting)
+}
+
+func TestStartEngineConnectTimeout(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listenSocket(t, socket)
+	id := container.EngineID{Type: "docker", Socket: socket}
+
+	synced := false
+	w, ctx := newTestWorker(t, func(string, bool) {}, func(container.EngineID) {
+		synced = true
+	})
+	require.NoError(t, w.cfg.Load(`{"engines": {"docker": {"connect_timeout_ms": 50}}}`))
+
+	unblock := make(chan struct{})
+	engine := &fakeEngine{}
+	w.startEngine(ctx, id, func(_ context.Context) (container.Engine, error) {
+		<-unblock
+		return engine, nil
+	})
+	res := waitEngineStart(t, w)
+	assert.ErrorIs(t, res.err, errConnectTimeout)
+	w.onEngineStarted(ctx, res)
+	assert.False(t, synced)
+	assert.NotContains(t, w.listeners, id)
+
+	// The engine eventually generated by the hung generator gets closed
+	close(unblock)
+	assert.Eventually(t, engine.closed.Load, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStartEngineStoppedMeanwhile(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listenSocket(t, socket)
+	id := container.EngineID{Type: "docker", Socket: socket}
+
+	w, ctx := newTestWorker(t, func(string, bool) {}, nil)
+	engine := &fakeEngine{}
+	unblock := make(chan struct{})
+	w.startEngine(ctx, id, func(_ context.Context) (container.Engine, error) {
+		<-unblock
+		return engine, nil
+	})
+	w.stopEngine(id)
+	close(unblock)
+	// The outcome is discarded and the engine closed
+	assert.Eventually(t, engine.closed.Load, 5*time.Second, 10*time.Millisecond)
+	assert.NotContains(t, w.listeners, id)
+}
+
+// newPodmanStandIn serves the podman API on a unix socket, with a single running container, returning the socket path.
+func newPodmanStandIn(t *testing.T, fullID string) string {
+	// Unix socket paths are short
+	dir, err := os.MkdirTemp("", "podman")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "podman.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Libpod-API-Version", "5.0.0")
+		w.Header().Set("Content-Type", "application/json")
+		switch path := r.URL.Path; {
+		case strings.HasSuffix(path, "/_ping"):
+			_, _ = w.Write([]byte("OK"))
+		case strings.HasSuffix(path, "/libpod/containers/json"):
+			_, _ = w.Write([]byte(`[{"Id": "` + fullID + `", "Image": "alpine:3.20.3"}]`))
+		case strings.HasSuffix(path, "/libpod/containers/"+fullID+"/json"):
+			_, _ = w.Write([]byte(`{"Id": "` + fullID + `", "Name": "alpine", "ImageName": "alpine:3.20.3", "Config": {}, "HostConfig": {}}`))
+		case strings.HasSuffix(path, "/libpod/events"):
+			// Stream no events until the client goes away
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return socket
+}
+
+func TestStartEnginePodman(t *testing.T) {
+	const fullID = "3e7a1c0f9b2d4e6f8a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f"
+	socket := newPodmanStandIn(t, fullID)
+	w, ctx := newTestWorker(t, func(string, bool) {}, nil)
+	require.NoError(t, w.cfg.Load(`{"engines": {"podman": {"enabled": true, "sockets": ["`+socket+`"]}}}`))
+	id := container.EngineID{Type: "podman", Socket: socket}
+	generator, ok := container.Generators(w.cfg, w.log, w.stats)[id]
+	if !ok {
+		t.Skip("podman engine not supported")
+	}
+
+	w.startEngine(ctx, id, generator)
+	res := waitEngineStart(t, w)
+	require.NoError(t, res.err)
+	require.NoError(t, res.listErr)
+	w.onEngineStarted(ctx, res)
+	require.Contains(t, w.listeners, id)
+
+	// The podman connection outlives the engine startup
+	evts, err := w.listeners[id].engine.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, evts, 1)
+	assert.Equal(t, fullID, evts[0].FullID)
+	assert.Equal(t, "alpine", evts[0].Name)
+}
@@ -2,86 +2,431 @@ package main
 
 /*
 #include <stdbool.h>
+#include <stdint.h>
 #include <stdlib.h>
 typedef void (*async_cb)(const char *json, bool added);
+typedef void (*log_cb)(const char *msg, uint8_t sev);
+typedef void (*sync_cb)(const char *engine);
+typedef void (*not_found_cb)(const char *container_id);
 extern void makeCallback(const char *json, bool added, async_cb cb) {
 	cb(json, added);
 }
+extern void makeSyncCallback(const char *engine, sync_cb cb) {
+	cb(engine);
+}
+extern void makeNotFoundCallback(const char *container_id, not_found_cb cb) {
+	cb(container_id);
+}
+extern void makeLogCallback(const char *msg, uint8_t sev, log_cb cb) {
+	cb(msg, sev);
+}
 */
 import "C"
 
 import (
 	"context"
+	"github.com/FedeDP/container-worker/pkg/config"
 	"github.com/FedeDP/container-worker/pkg/container"
 	"github.com/FedeDP/container-worker/pkg/event"
-	"reflect"
+	"github.com/FedeDP/container-worker/pkg/logger"
+	"github.com/FedeDP/container-worker/pkg/stats"
+	"net"
+	"os"
 	"sync"
-)
-
-const (
-	ctxDoneIdx   = 0
-	inotifierIdx = 1
+	"time"
 )
 
 type asyncCb func(string, bool)
 
-func workerLoop(ctx context.Context, cb asyncCb, containerEngines []container.Engine, inotifier *container.EngineInotifier, wg *sync.WaitGroup) {
-	var evt event.Event
-
-	// We need to use a reflect.SelectCase here since
-	// we will need to select a variable number of channels
-	cases := make([]reflect.SelectCase, 0)
-
-	// Emplace back case for `ctx.Done` channel
-	cases = append(cases, reflect.SelectCase{
-		Dir:  reflect.SelectRecv,
-		Chan: reflect.ValueOf(ctx.Done()),
-	})
-
-	// Emplace back case for inotifier channel if needed
-	inotifierCh := inotifier.Listen()
-	if inotifierCh != nil {
-		cases = append(cases, reflect.SelectCase{
-			Dir:  reflect.SelectRecv,
-			Chan: reflect.ValueOf(inotifierCh),
-		})
-	}
-
-	// Emplace back cases for each container engine listener
-	for _, engine := range containerEngines {
-		ch, err := engine.Listen(ctx, wg)
-		if err != nil {
-			continue
+// fetcherID identifies the fetcher engine
+var fetcherID = container.EngineID{Type: "fetcher"}
+
+// listener holds a running engine together with the means to stop its Listen goroutines.
+type listener struct {
+	engine container.Engine
+	cancel context.CancelFunc
+	ch     <-chan event.Event
+	// Cancels the context the engine was generated with, if owned by the listener
+	release context.CancelFunc
+}
+
+func startListener(ctx context.Context, engine container.Engine, wg *sync.WaitGroup) (*listener, error) {
+	lCtx, cancel := context.WithCancel(ctx)
+	ch, err := engine.Listen(lCtx, wg)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &listener{engine: engine, cancel: cancel, ch: ch}, nil
+}
+
+// stop stops the Listen goroutines and closes the engine client.
+func (l *listener) stop() {
+	l.cancel()
+	// Drain the channel so that any blocked sender can exit
+	go func() {
+		for range l.ch {
+		}
+	}()
+	_ = l.engine.Close()
+	if l.release != nil {
+		l.release()
+	}
+}
+
+// worker owns the state of running engines; apart from initialization,
+// it must only be accessed by the worker goroutine, ie: loop().
+type worker struct {
+	cb         asyncCb
+	log        logger.Logger
+	cfg        *config.Config
+	stats      *stats.Registry
+	wg         *sync.WaitGroup
+	mux        *multiplexer
+	listeners  map[container.EngineID]*listener
+	generators map[container.EngineID]container.EngineGenerator
+	inotifier  *container.EngineInotifier
+	tracked    tracker
+	// Signaled to apply a reloaded configuration
+	reloadCh chan struct{}
+	// Requests for the fetcher engine; kept across fetcher restarts
+	fetchQueue *container.RequestQueue
+	// Engines being connected in background, and their outcomes
+	starting  map[container.EngineID]*pendingStart
+	startedCh chan engineStart
+	// Engines stopped for good after a panic
+	disabled map[container.EngineID]struct{}
+	// Called once all pre-existing containers of an engine have been notified; may be nil
+	onSynced func(container.EngineID)
+	// Called once the fetcher gave up looking up a requested container; may be nil
+	onNotFound func(string)
+}
+
+func newWorker(cb asyncCb, onSynced func(container.EngineID), onNotFound func(string), log logger.Logger, cfg *config.Config, wg *sync.WaitGroup) *worker {
+	st := stats.NewRegistry()
+	return &worker{
+		cb:         cb,
+		onSynced:   onSynced,
+		onNotFound: onNotFound,
+		log:        log,
+		cfg:        cfg,
+		stats:      st,
+		wg:         wg,
+		mux:        newMultiplexer(),
+		listeners:  make(map[container.EngineID]*listener),
+		generators: make(map[container.EngineID]container.EngineGenerator),
+		inotifier:  container.NewEngineInotifier(log),
+		tracked:    make(tracker),
+		reloadCh:   make(chan struct{}),
+		fetchQueue: container.NewRequestQueue(cfg, st.Fetcher()),
+		// Unbuffered: background startups bail out on ctx cancellation
+		starting:  make(map[container.EngineID]*pendingStart),
+		startedCh: make(chan engineStart),
+		disabled:  make(map[container.EngineID]struct{}),
+	}
+}
+
+func (w *worker) notify(id container.EngineID, evt event.Event) {
+	if evt.NotFound {
+		if w.onNotFound != nil {
+			w.onNotFound(evt.ID)
+		}
+		return
+	}
+	if id == fetcherID {
+		// Tracked as announced by the engine that found it, so that resyncs neither announce it again
+		// nor miss its removal; not tracked at all if that engine is gone in the meantime
+		id = w.engineOf(evt.Source)
+	} else {
+		if w.filtered(id, evt) {
+			return
+		}
+		w.stats.Engine(id.String()).Emitted(evt.IsCreate)
+		if evt.IsCreate {
+			// Requests can use either the short or the full id
+			w.fetchQueue.Delivered(evt.ID)
+			w.fetchQueue.Delivered(evt.FullID)
+		}
+	}
+	if id != (container.EngineID{}) {
+		w.tracked.track(id, evt)
+	}
+	w.cb(evt.StringWith(w.cfg.GetEnvPolicy()), evt.IsCreate)
+}
+
+// engineOf returns the running engine whose id is source, or a zero id if none.
+func (w *worker) engineOf(source string) container.EngineID {
+	for id := range w.listeners {
+		if id != fetcherID && id.String() == source {
+			return id
+		}
+	}
+	return container.EngineID{}
+}
+
+// filtered tells whether evt, sent by a listener, concerns a container excluded by filters;
+// such containers are not announced, but the fetcher can still look them up on demand,
+// in which case their deletion is announced too.
+func (w *worker) filtered(id container.EngineID, evt event.Event) bool {
+	if !evt.IsCreate {
+		if !w.tracked.isExcluded(id, evt.FullID) {
+			return false
+		}
+		if w.tracked.isAnnounced(evt.FullID) {
+			// Looked up on demand; forward the deletion, and leave it to no other engine
+			w.tracked.tombstone(evt)
+			return false
 		}
-		cases = append(cases, reflect.SelectCase{
-			Dir:  reflect.SelectRecv,
-			Chan: reflect.ValueOf(ch),
-		})
+		// Leave a tombstone, like announced containers
+		w.tracked.exclude(id, evt)
+		return true
 	}
+	if w.cfg.GetFilterPolicy().Announces(id.Type, &evt.Container) {
+		return false
+	}
+	if w.tracked.isAnnouncedBy(id, evt.FullID) {
+		// Already looked up on demand; keep tracking it as announced, not to miss its deletion
+		return true
+	}
+	w.tracked.exclude(id, evt)
+	w.stats.Engine(id.String()).Filtered()
+	return true
+}
+
+func (w *worker) addListener(ctx context.Context, id container.EngineID, engine container.Engine) error {
+	l, err := startListener(ctx, engine, w.wg)
+	if err != nil {
+		w.log.Errorf("%s: failed to listen for events: %v", id, err)
+		_ = engine.Close()
+		return err
+	}
+	w.listeners[id] = l
+	w.mux.add(id, l.ch)
+	return nil
+}
+
+func (w *worker) removeListener(id container.EngineID) {
+	l, ok := w.listeners[id]
+	if !ok {
+		return
+	}
+	w.mux.remove(id)
+	l.stop()
+	delete(w.listeners, id)
+}
+
+// startEngine connects to the engine in background if its socket exists,
+// announcing all its pre-existing containers, otherwise waits for the socket to be created.
+// Remote engines are always connected, and connected again until they can be reached.
+// It never blocks on the engine; the returned status only tells whether the socket exists.
+func (w *worker) startEngine(ctx context.Context, id container.EngineID, generator container.EngineGenerator) engineStatus {
+	st := w.stats.Engine(id.String())
+	st.SetState(stats.StateWaiting)
+	if _, statErr := os.Stat(id.Socket); !id.IsRemote() && os.IsNotExist(statErr) {
+		// Does not exist; emplace back an inotify listener
+		w.inotifier.WatchCreation(id, generator)
+		return newEngineStatus(id, engineStatusMissingSocket, statErr)
+	}
+	if err := probeSocket(id, w.cfg.GetTimeouts(id.Type).Connect); err != nil {
+		// Eg: stale socket of a stopped daemon, or missing permissions
+		w.log.Warnf("%s: failed to connect: %v", id, err)
+		st.SetLastError(err)
+		w.inotifier.WatchCreation(id, generator)
+		return newEngineStatus(id, engineStatusFailed, err)
+	}
+	w.connectEngine(ctx, id, generator, 0)
+	return newEngineStatus(id, engineStatusConnecting, nil)
+}
+
+// probeSocket tells whether a local socket accepts connections; since unix sockets
+// accept or refuse them right away, it never blocks. Remote sockets are not probed.
+func probeSocket(id container.EngineID, timeout time.Duration) error {
+	if id.IsRemote() {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", id.Socket, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// stopEngine stops a running engine or the wait for its socket.
+func (w *worker) stopEngine(id container.EngineID) {
+	w.log.Infof("%s: stopping engine", id)
+	w.cancelStart(id)
+	w.removeListener(id)
+	w.inotifier.Forget(id)
+	w.tracked.forget(id)
+	w.stats.Remove(id.String())
+	delete(w.disabled, id)
+}
+
+// applyConfig starts newly enabled engines and stops disabled ones,
+// diffing the current configuration against the running engines.
+// It returns the status of the newly started engines.
+func (w *worker) applyConfig(ctx context.Context) []engineStatus {
+	var started []engineStatus
+	generators := container.Generators(w.cfg, w.log, w.stats)
+	for id := range w.generators {
+		if _, ok := generators[id]; !ok {
+			w.stopEngine(id)
+		}
+	}
+	for id, generator := range generators {
+		if _, ok := w.generators[id]; !ok {
+			started = append(started, w.startEngine(ctx, id, generator))
+		}
+	}
+	w.generators = generators
+	// Filters may have changed
+	w.tracked.forgetExcluded()
+	w.updateFetcher(ctx)
+	return started
+}
+
+// updateFetcher makes the fetcher engine get containers from all currently running engines,
+// starting it if not running yet.
+func (w *worker) updateFetcher(ctx context.Context) {
+	engines := make(map[container.EngineID]container.Engine, len(w.listeners))
+	for id, l := range w.listeners {
+		if id != fetcherID {
+			engines[id] = l.engine
+		}
+	}
+	if l, ok := w.listeners[fetcherID]; ok {
+		// Updated in place, not to lose its pending lookups and negative cache
+		l.engine.(container.FetcherEngine).SetEngines(ctx, engines)
+		return
+	}
+	// Always append the dummy engine that is required to
+	// be able to fetch container infos on the fly given other enabled engines.
+	_ = w.addListener(ctx, fetcherID, container.NewFetcherEngine(ctx, engines, w.fetchQueue, w.cfg, w.log.WithPrefix(fetcherID.Type), w.stats.Fetcher()))
+}
+
+// shutdown stops all the engines; the worker context must be done already.
+func (w *worker) shutdown() {
+	for id := range w.listeners {
+		w.removeListener(id)
+	}
+	w.mux.close()
+	w.inotifier.Close()
+}
+
+// resyncTicker returns a ticker for the configured resync interval, if enabled.
+func (w *worker) resyncTicker() (*time.Ticker, <-chan time.Time) {
+	if interval := w.cfg.GetResyncInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		return ticker, ticker.C
+	}
+	// A nil channel is never selected
+	return nil, nil
+}
+
+func (w *worker) loop(ctx context.Context) {
+	ticker, resyncTick := w.resyncTicker()
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	// Both are tied to this run of the loop: resyncs still running once it exits,
+	// eg: after a panic, must not block sending to a channel nobody reads anymore.
+	resyncResultsCh := make(chan []resyncResult)
+	loopDone := make(chan struct{})
+	defer close(loopDone)
+	resyncing := false
 
 	for {
-		chosen, val, _ := reflect.Select(cases)
-		if chosen == ctxDoneIdx {
-			// ctx.Done!
-			break
-		} else if inotifierCh != nil && chosen == inotifierIdx {
-			// inotifier!
-			engine := inotifier.Process(ctx, val.Interface())
-			if engine != nil {
-				ch, err := engine.Listen(ctx, wg)
-				if err != nil {
+		select {
+		case <-ctx.Done():
+			w.shutdown()
+			return
+		case res := <-w.startedCh:
+			w.onEngineStarted(ctx, res)
+		case <-w.fetchQueue.Dropped():
+			// Like containers not found, so that they can be asked again
+			for _, containerId := range w.fetchQueue.TakeDropped() {
+				if w.onNotFound != nil {
+					w.onNotFound(containerId)
+				}
+			}
+		case <-w.reloadCh:
+			w.applyConfig(ctx)
+			// Resync interval may have changed too
+			if ticker != nil {
+				ticker.Stop()
+			}
+			ticker, resyncTick = w.resyncTicker()
+		case ev := <-w.inotifier.Listen():
+			engines, removed := w.inotifier.Process(ctx, ev)
+			for _, id := range removed {
+				w.removeListener(id)
+				w.stats.Engine(id.String()).SetState(stats.StateWaiting)
+			}
+			for id, engine := range engines {
+				_ = w.addListener(ctx, id, engine)
+			}
+			if len(engines) > 0 || len(removed) > 0 {
+				w.updateFetcher(ctx)
+			}
+			w.disablePanicked(ctx)
+		case <-resyncTick:
+			if resyncing {
+				// Previous resync still running
+				continue
+			}
+			resyncing = true
+			engines := make(map[container.EngineID]container.Engine)
+			for id, l := range w.listeners {
+				if id != fetcherID {
+					engines[id] = l.engine
+				}
+			}
+			w.wg.Add(1)
+			go func() {
+				defer w.wg.Done()
+				defer w.recoverPanic()
+				listForResync(ctx, loopDone, w.log, w.stats, engines, resyncResultsCh)
+			}()
+		case results := <-resyncResultsCh:
+			resyncing = false
+			for _, res := range results {
+				if _, ok := w.listeners[res.id]; !ok {
+					// Engine removed in the meantime
 					continue
 				}
-				cases = append(cases, reflect.SelectCase{
-					Dir:  reflect.SelectRecv,
-					Chan: reflect.ValueOf(ch),
-				})
+				for _, evt := range w.tracked.diff(res) {
+					w.notify(res.id, evt)
+				}
+			}
+			w.disablePanicked(ctx)
+		case sEvt := <-w.mux.events():
+			if !w.mux.isCurrent(sEvt) {
+				// Source removed in the meantime
+				continue
+			}
+			if sEvt.closed && sEvt.source == fetcherID {
+				// Recovered from a panic; start a new one, that takes over its pending requests
+				w.removeListener(fetcherID)
+				if ctx.Err() == nil {
+					w.updateFetcher(ctx)
+				}
+				continue
+			}
+			if sEvt.closed {
+				// Listener is gone, but keep the engine around
+				// since it can still be listed by resync.
+				w.log.Warnf("%s: stopped listening for events", sEvt.source)
+				w.stats.Engine(sEvt.source.String()).SetState(stats.StateDisconnected)
+				w.mux.remove(sEvt.source)
+				w.disablePanicked(ctx)
+				continue
 			}
-		} else {
-			evt, _ = val.Interface().(event.Event)
-			cb(evt.String(), evt.IsCreate)
+			if sEvt.source != fetcherID {
+				w.stats.Engine(sEvt.source.String()).EventReceived()
+			}
+			w.notify(sEvt.source, sEvt.Event)
 		}
 	}
-
-	inotifier.Close()
 }
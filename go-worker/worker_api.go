@@ -2,43 +2,87 @@ package main
 
 /*
 #include <stdbool.h>
+#include <stdint.h>
+#include <stdlib.h>
 typedef const char cchar_t;
 typedef void (*async_cb)(const char *json, bool added);
+typedef void (*log_cb)(const char *msg, uint8_t sev);
+typedef void (*sync_cb)(const char *engine);
+typedef void (*not_found_cb)(const char *container_id);
 void makeCallback(const char *json, bool added, async_cb cb);
+void makeLogCallback(const char *msg, uint8_t sev, log_cb cb);
+void makeSyncCallback(const char *engine, sync_cb cb);
+void makeNotFoundCallback(const char *container_id, not_found_cb cb);
 */
 import "C"
 
 import (
 	"context"
+	"errors"
 	"github.com/FedeDP/container-worker/pkg/config"
 	"github.com/FedeDP/container-worker/pkg/container"
+	"github.com/FedeDP/container-worker/pkg/logger"
+	"github.com/FedeDP/container-worker/pkg/stats"
 	"github.com/falcosecurity/plugin-sdk-go/pkg/ptr"
 	"runtime"
 	"runtime/cgo"
+	"runtime/debug"
 	"sync"
+	"time"
 	"unsafe"
 )
 
 type PluginCtx struct {
-	wg           sync.WaitGroup
-	ctxCancel    context.CancelFunc
+	wg         sync.WaitGroup
+	ctx        context.Context
+	ctxCancel  context.CancelFunc
+	cfg        *config.Config
+	reloadCh   chan<- struct{}
+	fetchQueue *container.RequestQueue
+	stats      *stats.Registry
+	log        logger.Logger
+	// Guards C callbacks against being called after StopWorker
+	gate         cGate
 	stringBuffer ptr.StringBuffer
-	pinner       runtime.Pinner
+	// Holds the last GetWorkerStats result; guarded by statsMtx
+	statsBuffer ptr.StringBuffer
+	statsMtx    sync.Mutex
+	pinner      runtime.Pinner
 }
 
+// StartWorker starts a worker sending container events through cb;
+// logCb, if not NULL, receives log messages with their ss_plugin_log_severity.
+// Engines are connected in background: syncCb, if not NULL, receives the "type@socket"
+// of each engine once all its pre-existing containers have been sent through cb.
+// notFoundCb, if not NULL, receives the containerId asked through AskForContainerInfo
+// once no engine found it, even after retrying, or once its request got dropped
+// since too many were pending.
+// If report is not NULL, it is set to a JSON document describing invalid config keys,
+// the status of each engine and whether the worker runs in degraded mode;
+// the caller owns the string and must free() it.
+// NULL is returned when the worker could not be started.
+//
 //export StartWorker
-func StartWorker(cb C.async_cb, initCfg *C.cchar_t) unsafe.Pointer {
+func StartWorker(cb C.async_cb, logCb C.log_cb, syncCb C.sync_cb, notFoundCb C.not_found_cb, initCfg *C.cchar_t, report **C.char) unsafe.Pointer {
 	var (
 		pluginCtx PluginCtx
 		ctx       context.Context
+		w         *worker
 	)
 	ctx, pluginCtx.ctxCancel = context.WithCancel(context.Background())
+	defer func() {
+		if r := recover(); r != nil {
+			pluginCtx.log.Errorf("StartWorker: recovered from panic: %v\n%s", r, debug.Stack())
+			pluginCtx.abort(w)
+		}
+	}()
 
 	// See https://github.com/enobufs/go-calls-c-pointer/blob/master/counter_api.go
 	goCb := func(containerJson string, added bool) {
-		if containerJson == "" {
+		if containerJson == "" || !pluginCtx.gate.enter() {
 			return
 		}
+		defer pluginCtx.gate.exit()
 		// Go cannot call C-function pointers. Instead, use
 		// a C-function to have it call the function pointer.
 		pluginCtx.stringBuffer.Write(containerJson)
@@ -47,64 +91,248 @@ func StartWorker(cb C.async_cb, initCfg *C.cchar_t) unsafe.Pointer {
 		C.makeCallback(cStr, cbool, cb)
 	}
 
-	err := config.Load(ptr.GoString(unsafe.Pointer(initCfg)))
-	if err != nil {
-		return nil
+	var goLog logger.Logger
+	if logCb != nil {
+		// Called concurrently by multiple goroutines, thus use a new C string for each message
+		goLog = func(sev logger.Severity, msg string) {
+			if !pluginCtx.gate.enter() {
+				return
+			}
+			defer pluginCtx.gate.exit()
+			cStr := C.CString(msg)
+			defer C.free(unsafe.Pointer(cStr))
+			C.makeLogCallback(cStr, C.uint8_t(sev), logCb)
+		}
 	}
 
-	generators, inotifier, err := container.Generators()
-	if err != nil {
-		return nil
+	var goSync func(container.EngineID)
+	if syncCb != nil {
+		goSync = func(id container.EngineID) {
+			if !pluginCtx.gate.enter() {
+				return
+			}
+			defer pluginCtx.gate.exit()
+			cStr := C.CString(id.String())
+			defer C.free(unsafe.Pointer(cStr))
+			C.makeSyncCallback(cStr, syncCb)
+		}
 	}
 
-	containerEngines := make([]container.Engine, 0)
-	for _, generator := range generators {
-		engine, err := generator(ctx)
-		if err != nil {
-			continue
-		}
-		containerEngines = append(containerEngines, engine)
-		// List all pre-existing containers and run `goCb` on all of them
-		containers, err := engine.List(ctx)
-		if err == nil {
-			for _, ctr := range containers {
-				goCb(ctr.String(), true)
+	var goNotFound func(string)
+	if notFoundCb != nil {
+		goNotFound = func(containerId string) {
+			if !pluginCtx.gate.enter() {
+				return
 			}
+			defer pluginCtx.gate.exit()
+			cStr := C.CString(containerId)
+			defer C.free(unsafe.Pointer(cStr))
+			C.makeNotFoundCallback(cStr, notFoundCb)
 		}
 	}
-	// Always append the dummy engine that is required to
-	// be able to fetch container infos on the fly given other enabled engines.
-	containerEngines = append(containerEngines, container.NewFetcherEngine(ctx, containerEngines))
 
-	// Start worker goroutine
-	pluginCtx.wg.Add(1)
-	go func() {
-		defer pluginCtx.wg.Done()
-		workerLoop(ctx, goCb, containerEngines, inotifier, &pluginCtx.wg)
-	}()
+	pluginCtx.log = goLog
+	pluginCtx.cfg = config.New(goLog)
+	err := pluginCtx.cfg.Load(ptr.GoString(unsafe.Pointer(initCfg)))
+	if err != nil {
+		pluginCtx.ctxCancel()
+		writeReport(report, newStartupReport(err, nil))
+		return nil
+	}
+
+	w = newWorker(goCb, goSync, goNotFound, goLog, pluginCtx.cfg, &pluginCtx.wg)
+	started := w.applyConfig(ctx)
+	writeReport(report, newStartupReport(nil, started))
+	pluginCtx.run(ctx, w)
 	h := cgo.NewHandle(&pluginCtx)
 	pluginCtx.pinner.Pin(&h)
 	return unsafe.Pointer(&h)
 }
 
+// run starts the worker goroutine and exposes the worker channels to the API.
+func (p *PluginCtx) run(ctx context.Context, w *worker) {
+	p.ctx = ctx
+	p.reloadCh = w.reloadCh
+	p.fetchQueue = w.fetchQueue
+	p.stats = w.stats
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		w.run(ctx)
+	}()
+}
+
+// recoverAPI recovers a panic of an exported function, since it must never cross into C;
+// the function then returns zero values. It must be directly deferred.
+func recoverAPI(api string, pCtx unsafe.Pointer) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if pluginCtx := pluginCtxOf(pCtx); pluginCtx != nil {
+		pluginCtx.log.Errorf("%s: recovered from panic: %v\n%s", api, r, debug.Stack())
+		pluginCtx.stats.Panicked()
+	}
+}
+
+// pluginCtxOf returns the PluginCtx of pCtx, or nil if pCtx is not a valid handle.
+func pluginCtxOf(pCtx unsafe.Pointer) (pluginCtx *PluginCtx) {
+	if pCtx == nil {
+		return nil
+	}
+	defer func() {
+		_ = recover()
+	}()
+	return (*cgo.Handle)(pCtx).Value().(*PluginCtx)
+}
+
+// writeReport passes the startup report to the caller, if requested.
+func writeReport(report **C.char, r startupReport) {
+	if report == nil {
+		return
+	}
+	*report = C.CString(r.String())
+}
+
+// StopWorker stops the worker, waiting up to timeoutMs milliseconds (or a default if 0)
+// for all its goroutines to exit; no callback is called once it returns.
+// It returns false if the deadline expired, in which case the lingering goroutines
+// are left behind, but the worker resources are released anyway.
+//
 //export StopWorker
-func StopWorker(pCtx unsafe.Pointer) {
+func StopWorker(pCtx unsafe.Pointer, timeoutMs C.uint32_t) C.bool {
+	defer recoverAPI("StopWorker", pCtx)
 	h := (*cgo.Handle)(pCtx)
 	pluginCtx := h.Value().(*PluginCtx)
 
-	pluginCtx.ctxCancel()
-	pluginCtx.wg.Wait()
+	timeout := defaultStopTimeout
+	if timeoutMs > 0 {
+		timeout = time.Duration(timeoutMs) * time.Millisecond
+	}
+	stopped := pluginCtx.stop(timeout)
 	pluginCtx.stringBuffer.Free()
+	pluginCtx.statsBuffer.Free()
 
 	pluginCtx.pinner.Unpin()
 	h.Delete()
+	return C.bool(stopped)
 }
 
+// ReloadWorkerConfig applies a new init config to a running worker, without restarting it:
+// newly enabled engines and sockets are started, removed ones are stopped,
+// and options like `label_max_len` and `with_size` are applied to subsequent events.
+//
+//export ReloadWorkerConfig
+func ReloadWorkerConfig(pCtx unsafe.Pointer, initCfg *C.cchar_t) C.bool {
+	defer recoverAPI("ReloadWorkerConfig", pCtx)
+	h := (*cgo.Handle)(pCtx)
+	pluginCtx := h.Value().(*PluginCtx)
+
+	err := pluginCtx.cfg.Load(ptr.GoString(unsafe.Pointer(initCfg)))
+	if err != nil {
+		return C.bool(false)
+	}
+	// Let the worker goroutine apply the new configuration
+	select {
+	case <-pluginCtx.ctx.Done():
+		return C.bool(false)
+	case pluginCtx.reloadCh <- struct{}{}:
+		return C.bool(true)
+	}
+}
+
+// AskForContainerInfo asks the fetcher engine of the worker identified by pCtx
+// to retrieve info about containerId; the result is sent through the worker callback.
+// It never blocks: the request is queued, and dropped if the queue is full
+// as per `fetcher.overflow_policy`. It is a no-op if the worker is not running.
+//
 //export AskForContainerInfo
-func AskForContainerInfo(containerId *C.cchar_t) {
-	containerID := ptr.GoString(unsafe.Pointer(containerId))
-	ch := container.GetFetcherChan()
-	if ch != nil {
-		ch <- containerID
+func AskForContainerInfo(pCtx unsafe.Pointer, containerId *C.cchar_t) {
+	defer recoverAPI("AskForContainerInfo", pCtx)
+	pluginCtx := pluginCtxOf(pCtx)
+	if pluginCtx == nil {
+		return
+	}
+	pluginCtx.fetchQueue.Push(container.NewRequest(ptr.GoString(unsafe.Pointer(containerId))))
+}
+
+// AskForContainerInfoHint is like AskForContainerInfo, but also passes what the plugin
+// detected from the cgroup of the process running in the container: its ctrType,
+// as a container_type value (CT_UNKNOWN if not known), and optionally the cgroup path and pid,
+// that can be NULL and 0. Engines handling ctrType are asked first, and the others only if they miss it.
+//
+//export AskForContainerInfoHint
+func AskForContainerInfoHint(pCtx unsafe.Pointer, containerId *C.cchar_t, ctrType C.int, cgroup *C.cchar_t, pid C.int64_t) {
+	defer recoverAPI("AskForContainerInfoHint", pCtx)
+	pluginCtx := pluginCtxOf(pCtx)
+	if pluginCtx == nil {
+		return
 	}
+	pluginCtx.fetchQueue.Push(container.Request{
+		ContainerID: ptr.GoString(unsafe.Pointer(containerId)),
+		Type:        int(ctrType),
+		Cgroup:      ptr.GoString(unsafe.Pointer(cgroup)),
+		Pid:         int64(pid),
+	})
+}
+
+// LookupContainer resolves the container running the host process pid or, if pid is 0,
+// owning the cgroup path, for processes whose container id the plugin failed to extract.
+// The cgroups of pid are read from /proc/<pid>/cgroup under the configured host_root.
+// If found, it sets ctrType to the container_type of the matched engine and asks for the container,
+// like AskForContainerInfoHint; it returns the container id, that must be freed by the caller,
+// or NULL if the process does not run in a container.
+//
+//export LookupContainer
+func LookupContainer(pCtx unsafe.Pointer, pid C.int64_t, cgroup *C.cchar_t, ctrType *C.int) *C.char {
+	defer recoverAPI("LookupContainer", pCtx)
+	pluginCtx := pluginCtxOf(pCtx)
+	if pluginCtx == nil {
+		return nil
+	}
+	var (
+		match container.CgroupMatch
+		path  string
+		ok    bool
+	)
+	if pid > 0 {
+		var err error
+		match, path, err = container.MatchPid(pluginCtx.cfg.GetHostRoot(), int64(pid))
+		if err != nil {
+			if !errors.Is(err, container.ErrNoContainer) {
+				pluginCtx.log.Debugf("failed to lookup container of pid %d: %v", pid, err)
+			}
+			return nil
+		}
+	} else {
+		path = ptr.GoString(unsafe.Pointer(cgroup))
+		if match, ok = container.MatchCgroup(path); !ok {
+			return nil
+		}
+	}
+	req := match.Request(path, int64(pid))
+	if ctrType != nil {
+		*ctrType = C.int(req.Type)
+	}
+	pluginCtx.fetchQueue.Push(req)
+	return C.CString(req.ContainerID)
+}
+
+// GetWorkerStats returns a JSON document with per-engine and fetcher counters.
+// The returned string is owned by the worker and is valid until the next call.
+//
+//export GetWorkerStats
+func GetWorkerStats(pCtx unsafe.Pointer) *C.cchar_t {
+	defer recoverAPI("GetWorkerStats", pCtx)
+	if pCtx == nil {
+		return nil
+	}
+	h := (*cgo.Handle)(pCtx)
+	pluginCtx := h.Value().(*PluginCtx)
+
+	pluginCtx.statsMtx.Lock()
+	defer pluginCtx.statsMtx.Unlock()
+	pluginCtx.statsBuffer.Write(pluginCtx.stats.JSON())
+	return (*C.cchar_t)(pluginCtx.statsBuffer.CharPtr())
 }
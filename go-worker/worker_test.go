@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/FedeDP/container-worker/pkg/config"
+	"github.com/FedeDP/container-worker/pkg/container"
+	"github.com/FedeDP/container-worker/pkg/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerApplyConfig(t *testing.T) {
+	// Sockets do not exist: engines are just waiting for them to be created
+	dir := t.TempDir()
+	dockerSocket := filepath.Join(dir, "docker.sock")
+	podmanSocket := filepath.Join(dir, "podman.sock")
+	cfgFmt := `{"label_max_len": %d, "engines": {"docker": {"enabled": true, "sockets": [%q]}, "podman": {"enabled": %t, "sockets": [%q]}}}`
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := config.New(nil)
+	w := newWorker(func(string, bool) {}, nil, nil, nil, cfg, &wg)
+	t.Cleanup(func() {
+		cancel()
+		w.mux.close()
+		w.inotifier.Close()
+		wg.Wait()
+	})
+
+	require.NoError(t, cfg.Load(fmt.Sprintf(cfgFmt, 50, dockerSocket, true, podmanSocket)))
+	w.applyConfig(ctx)
+	assert.Len(t, w.generators, 2)
+	assert.Contains(t, w.generators, container.EngineID{Type: "docker", Socket: dockerSocket})
+	require.Contains(t, w.listeners, fetcherID)
+	fetcher := w.listeners[fetcherID]
+	assert.Equal(t, 50, cfg.GetLabelMaxLen())
+
+	// Disable podman and change options
+	require.NoError(t, cfg.Load(fmt.Sprintf(cfgFmt, 80, dockerSocket, false, podmanSocket)))
+	w.applyConfig(ctx)
+	assert.Len(t, w.generators, 1)
+	assert.NotContains(t, w.generators, container.EngineID{Type: "podman", Socket: podmanSocket})
+	assert.Equal(t, 80, cfg.GetLabelMaxLen())
+	// The fetcher is updated in place
+	assert.Same(t, fetcher, w.listeners[fetcherID])
+}
+
+func TestWorkersIsolation(t *testing.T) {
+	dir := t.TempDir()
+	cfgFmt := `{"label_max_len": %d, "engines": {"docker": {"enabled": true, "sockets": [%q]}}}`
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg1, cfg2 := config.New(nil), config.New(nil)
+	w1 := newWorker(func(string, bool) {}, nil, nil, nil, cfg1, &wg)
+	w2 := newWorker(func(string, bool) {}, nil, nil, nil, cfg2, &wg)
+	t.Cleanup(func() {
+		cancel()
+		for _, w := range []*worker{w1, w2} {
+			w.mux.close()
+			w.inotifier.Close()
+		}
+		wg.Wait()
+	})
+
+	socket1 := filepath.Join(dir, "docker1.sock")
+	socket2 := filepath.Join(dir, "docker2.sock")
+	require.NoError(t, cfg1.Load(fmt.Sprintf(cfgFmt, 50, socket1)))
+	require.NoError(t, cfg2.Load(fmt.Sprintf(cfgFmt, 80, socket2)))
+	w1.applyConfig(ctx)
+	w2.applyConfig(ctx)
+
+	// Each worker only sees its own configuration
+	assert.Equal(t, 50, cfg1.GetLabelMaxLen())
+	assert.Equal(t, 80, cfg2.GetLabelMaxLen())
+	assert.Contains(t, w1.generators, container.EngineID{Type: "docker", Socket: socket1})
+	assert.NotContains(t, w1.generators, container.EngineID{Type: "docker", Socket: socket2})
+	assert.Contains(t, w2.generators, container.EngineID{Type: "docker", Socket: socket2})
+	assert.NotContains(t, w2.generators, container.EngineID{Type: "docker", Socket: socket1})
+	assert.NotSame(t, w1.fetchQueue, w2.fetchQueue)
+}
+
+func TestWorkerNotify(t *testing.T) {
+	var (
+		notFound []string
+		received int
+	)
+	w := newWorker(func(string, bool) { received++ }, nil, func(containerId string) {
+		notFound = append(notFound, containerId)
+	}, nil, config.New(nil), &sync.WaitGroup{})
+	engineID := container.EngineID{Type: "docker", Socket: "/docker.sock"}
+
+	// Requests for containers delivered by a listener are dropped
+	w.fetchQueue.Push(container.NewRequest("ctr1"))
+	w.notify(engineID, testEvent("ctr1", true))
+	_, ok := w.fetchQueue.Pop()
+	assert.False(t, ok)
+
+	w.notify(fetcherID, event.Event{Info: event.Info{Container: event.Container{ID: "ctr2"}}, NotFound: true})
+	assert.Equal(t, []string{"ctr2"}, notFound)
+	assert.Equal(t, 1, received)
+	assert.NotContains(t, w.tracked[fetcherID], "ctr2")
+}
+
+func TestWorkerNotifyFetched(t *testing.T) {
+	var received []bool
+	w := newWorker(func(_ string, isCreate bool) { received = append(received, isCreate) }, nil, nil, nil, config.New(nil), &sync.WaitGroup{})
+	engineID := container.EngineID{Type: "docker", Socket: "/docker.sock"}
+	w.listeners[engineID] = &listener{}
+
+	fetched := testEvent("ctr", true)
+	fetched.Source = engineID.String()
+	w.notify(fetcherID, fetched)
+	assert.Equal(t, []bool{true}, received)
+	assert.NotContains(t, w.tracked, fetcherID)
+	assert.Contains(t, w.tracked[engineID], fetched.FullID)
+
+	// Resync neither announces it again, nor misses its removal
+	assert.Empty(t, w.tracked.diff(resyncResult{id: engineID, startTime: time.Now(), evts: []event.Event{fetched}}))
+	evts := w.tracked.diff(resyncResult{id: engineID, startTime: time.Now()})
+	require.Len(t, evts, 1)
+	assert.False(t, evts[0].IsCreate)
+	assert.Equal(t, fetched.FullID, evts[0].FullID)
+
+	// Found by an engine stopped in the meantime
+	gone := testEvent("ctr2", true)
+	gone.Source = "podman@/podman.sock"
+	w.notify(fetcherID, gone)
+	assert.Equal(t, []bool{true, true}, received)
+	assert.NotContains(t, w.tracked, fetcherID)
+}
+
+func TestWorkerNotifyRedactsEnv(t *testing.T) {
+	var received []string
+	cfg := config.New(nil)
+	require.NoError(t, cfg.Load(`{"env": {"redact": ["*_PASSWORD"]}}`))
+	w := newWorker(func(data string, _ bool) { received = append(received, data) }, nil, nil, nil, cfg, &sync.WaitGroup{})
+
+	evt := testEvent("ctr", true)
+	evt.Env = []string{"DB_PASSWORD=hunter2", "HOME=/root"}
+	w.notify(container.EngineID{Type: "docker", Socket: "/docker.sock"}, evt)
+
+	require.Len(t, received, 1)
+	var info event.Info
+	require.NoError(t, json.Unmarshal([]byte(received[0]), &info))
+	assert.Equal(t, []string{"DB_PASSWORD=<redacted>", "HOME=/root"}, info.Env)
+	// The event itself is untouched
+	assert.Equal(t, "DB_PASSWORD=hunter2", evt.Env[0])
+}
+
+func TestWorkerNotifyFiltered(t *testing.T) {
+	var received []bool
+	cfg := config.New(nil)
+	require.NoError(t, cfg.Load(`{"filters": {"exclude": [{"image_repos": ["builder"]}]}}`))
+	w := newWorker(func(_ string, isCreate bool) { received = append(received, isCreate) }, nil, nil, nil, cfg, &sync.WaitGroup{})
+	engineID := container.EngineID{Type: "docker", Socket: "/docker.sock"}
+
+	excluded := testEvent("build", true)
+	excluded.Image = "builder:latest"
+	w.fetchQueue.Push(container.NewRequest("build"))
+	w.notify(engineID, excluded)
+	assert.Empty(t, received)
+	// Still resolvable on demand
+	req, ok := w.fetchQueue.Pop()
+	require.True(t, ok)
+	assert.Equal(t, "build", req.ContainerID)
+
+	// Resync does not announce it either
+	assert.Empty(t, w.tracked.diff(resyncResult{id: engineID, startTime: time.Now(), evts: []event.Event{excluded}}))
+
+	// Delete events carry no image, yet they are filtered too
+	w.notify(engineID, testEvent("build", false))
+	assert.Empty(t, received)
+	assert.Equal(t, uint64(1), w.stats.Snapshot().Engines[engineID.String()].Filtered)
+
+	w.notify(engineID, testEvent("ctr", true))
+	w.notify(engineID, testEvent("ctr", false))
+	assert.Equal(t, []bool{true, false}, received)
+
+	// Containers fetched on demand are announced
+	w.notify(fetcherID, excluded)
+	assert.Equal(t, []bool{true, false, true}, received)
+}
+
+func TestWorkerNotifyFilteredFetched(t *testing.T) {
+	var received []bool
+	cfg := config.New(nil)
+	require.NoError(t, cfg.Load(`{"filters": {"exclude": [{"image_repos": ["builder"]}]}}`))
+	w := newWorker(func(_ string, isCreate bool) { received = append(received, isCreate) }, nil, nil, nil, cfg, &sync.WaitGroup{})
+	engineID := container.EngineID{Type: "docker", Socket: "/docker.sock"}
+	criID := container.EngineID{Type: "cri", Socket: "/cri.sock"}
+	w.listeners[engineID] = &listener{}
+	w.listeners[criID] = &listener{}
+
+	excluded := testEvent("build", true)
+	excluded.Image = "builder:latest"
+	w.notify(engineID, excluded)
+	assert.Empty(t, received)
+
+	// Looked up on demand, then deleted: the deletion is announced too
+	fetched := excluded
+	fetched.Source = engineID.String()
+	w.notify(fetcherID, fetched)
+	w.notify(engineID, testEvent("build", false))
+	assert.Equal(t, []bool{true, false}, received)
+
+	// Same when found by another engine, even if its create event comes afterwards
+	excluded = testEvent("build2", true)
+	excluded.Image = "builder:latest"
+	fetched = excluded
+	fetched.Source = criID.String()
+	w.notify(fetcherID, fetched)
+	w.notify(engineID, excluded)
+	w.notify(engineID, testEvent("build2", false))
+	assert.Equal(t, []bool{true, false, true, false}, received)
+	assert.False(t, w.tracked.isAnnounced("build2"))
+
+	// Or by the same engine
+	excluded = testEvent("build3", true)
+	excluded.Image = "builder:latest"
+	fetched = excluded
+	fetched.Source = engineID.String()
+	w.notify(fetcherID, fetched)
+	w.notify(engineID, excluded)
+	w.notify(engineID, testEvent("build3", false))
+	assert.Equal(t, []bool{true, false, true, false, true, false}, received)
+}
+
+func TestWorkerNotifiesDropped(t *testing.T) {
+	notFoundCh := make(chan string, 1)
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := config.New(nil)
+	require.NoError(t, cfg.Load(`{"fetcher":{"queue_size":2}}`))
+	w := newWorker(func(string, bool) {}, nil, func(containerId string) {
+		notFoundCh <- containerId
+	}, nil, cfg, &wg)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.loop(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	// No engine serves the queue, thus the oldest request gets dropped
+	for _, id := range []string{"ctr1", "ctr2", "ctr3"} {
+		w.fetchQueue.Push(container.NewRequest(id))
+	}
+	select {
+	case containerId := <-notFoundCh:
+		assert.Equal(t, "ctr1", containerId)
+	case <-time.After(5 * time.Second):
+		t.Fatal("dropped request not notified")
+	}
+	assert.Equal(t, 2, w.fetchQueue.Len())
+}
@@ -7,7 +7,8 @@
 
 std::unique_ptr<falcosecurity::async_event_handler>
         s_async_handler[ASYNC_HANDLER_MAX];
-static void *s_async_ctx;
+falcosecurity::logger s_go_worker_logger;
+std::atomic<uint64_t> s_go_worker_synced_engines;
 
 std::vector<std::string> my_plugin::get_async_events()
 {
@@ -33,9 +34,38 @@ bool my_plugin::start_async_events(
     m_logger.log("starting async go-worker",
                  falcosecurity::_internal::SS_PLUGIN_LOG_SEV_DEBUG);
     nlohmann::json j(m_cfg);
-    s_async_ctx = StartWorker(generate_async_event<ASYNC_HANDLER_GO_WORKER>,
-                              j.dump().c_str());
-    return s_async_ctx != nullptr;
+    s_go_worker_logger = m_logger;
+    s_go_worker_synced_engines = 0;
+    char *report = nullptr;
+    m_async_ctx = StartWorker(generate_async_event<ASYNC_HANDLER_GO_WORKER>,
+                              log_go_worker, on_go_worker_synced,
+                              on_go_worker_not_found, j.dump().c_str(),
+                              &report);
+    if(report != nullptr)
+    {
+        auto r = nlohmann::json::parse(report, nullptr, false);
+        if(m_async_ctx == nullptr)
+        {
+            m_logger.log(fmt::format("failed to start async go-worker: {}",
+                                     report),
+                         falcosecurity::_internal::SS_PLUGIN_LOG_SEV_ERROR);
+        }
+        else if(!r.is_discarded() && r.value("degraded", false))
+        {
+            m_logger.log(
+                    fmt::format("async go-worker running in degraded mode: {}",
+                                report),
+                    falcosecurity::_internal::SS_PLUGIN_LOG_SEV_WARNING);
+        }
+        else
+        {
+            m_logger.log(fmt::format("async go-worker started: {}", report),
+                         falcosecurity::_internal::SS_PLUGIN_LOG_SEV_DEBUG);
+        }
+        // Allocated by the go-worker
+        free(report);
+    }
+    return m_async_ctx != nullptr;
 }
 
 // We need this API to stop the async thread when the
@@ -44,11 +74,17 @@ bool my_plugin::stop_async_events() noexcept
 {
     m_logger.log("stopping async go-worker",
                  falcosecurity::_internal::SS_PLUGIN_LOG_SEV_DEBUG);
-    if(s_async_ctx != nullptr)
+    if(m_async_ctx != nullptr)
     {
         // Implemented by GO worker.go
-        StopWorker(s_async_ctx);
-        s_async_ctx = nullptr;
+        if(!StopWorker(m_async_ctx, GO_WORKER_STOP_TIMEOUT_MS))
+        {
+            m_logger.log(
+                    fmt::format("async go-worker did not stop within {}ms",
+                                GO_WORKER_STOP_TIMEOUT_MS),
+                    falcosecurity::_internal::SS_PLUGIN_LOG_SEV_WARNING);
+        }
+        m_async_ctx = nullptr;
 
         for(int i = 0; i < ASYNC_HANDLER_MAX; i++)
         {
@@ -58,6 +94,62 @@ bool my_plugin::stop_async_events() noexcept
     return true;
 }
 
+void my_plugin::update_worker_metrics()
+{
+    if(m_async_ctx == nullptr)
+    {
+        return;
+    }
+    // Implemented by GO worker_api.go
+    const char *stats = GetWorkerStats(m_async_ctx);
+    if(stats == nullptr)
+    {
+        return;
+    }
+    auto j = nlohmann::json::parse(stats, nullptr, false);
+    if(j.is_discarded())
+    {
+        return;
+    }
+
+    uint64_t events = 0, inspect_failures = 0, fallbacks = 0, connected = 0,
+             disabled = 0;
+    uint64_t panics = j.value("panics", uint64_t(0));
+    for(const auto &engine : j.value("engines", nlohmann::json::object()))
+    {
+        events += engine.value("events_received", uint64_t(0));
+        inspect_failures += engine.value("inspect_failures", uint64_t(0));
+        fallbacks += engine.value("fallbacks", uint64_t(0));
+        panics += engine.value("panics", uint64_t(0));
+        const auto state = engine.value("state", "");
+        if(state == "connected")
+        {
+            connected++;
+        }
+        else if(state == "disabled")
+        {
+            disabled++;
+        }
+    }
+    const auto fetcher = j.value("fetcher", nlohmann::json::object());
+    panics += fetcher.value("panics", uint64_t(0));
+
+    m_metrics.at(m_worker_metrics.events).set_value(events);
+    m_metrics.at(m_worker_metrics.inspect_failures).set_value(inspect_failures);
+    m_metrics.at(m_worker_metrics.fallbacks).set_value(fallbacks);
+    m_metrics.at(m_worker_metrics.connected).set_value(connected);
+    m_metrics.at(m_worker_metrics.fetcher_requests)
+            .set_value(fetcher.value("requests", uint64_t(0)));
+    m_metrics.at(m_worker_metrics.fetcher_misses)
+            .set_value(fetcher.value("misses", uint64_t(0)));
+    m_metrics.at(m_worker_metrics.synced)
+            .set_value(s_go_worker_synced_engines.load());
+    m_metrics.at(m_worker_metrics.panics).set_value(panics);
+    m_metrics.at(m_worker_metrics.disabled).set_value(disabled);
+    m_metrics.at(m_worker_metrics.fetcher_dropped)
+            .set_value(fetcher.value("dropped", uint64_t(0)));
+}
+
 void my_plugin::dump(
         std::unique_ptr<falcosecurity::async_event_handler> async_handler)
 {
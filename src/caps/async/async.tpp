@@ -1,6 +1,7 @@
 #pragma once
 
 #include <libworker.h>
+#include <atomic>
 #include <chrono>
 
 enum async_handler_id {
@@ -10,8 +11,15 @@ enum async_handler_id {
 
 #define ASYNC_HANDLER_MAX (ASYNC_HANDLER_GO_WORKER + 1)
 
+// Max milliseconds to wait for the go-worker to stop, not to hang shutdown
+#define GO_WORKER_STOP_TIMEOUT_MS 5000
+
 extern std::unique_ptr<falcosecurity::async_event_handler>
         s_async_handler[ASYNC_HANDLER_MAX];
+// Logger used to report go-worker log messages
+extern falcosecurity::logger s_go_worker_logger;
+// Number of engines whose pre-existing containers have all been received
+extern std::atomic<uint64_t> s_go_worker_synced_engines;
 
 static inline uint64_t get_current_time_ns(int sec_shift)
 {
@@ -42,4 +50,37 @@ void generate_async_event(const char *json, bool added)
 
     enc.encode(s_async_handler[id]->writer());
     s_async_handler[id]->push();
-}
\ No newline at end of file
+}
+
+// Called by the go-worker once no engine found a container asked through
+// AskForContainerInfo(), even after retrying, or once the request got dropped;
+// like generate_async_event(), it is only called by the go-worker main goroutine.
+static inline void on_go_worker_not_found(const char *container_id)
+{
+    falcosecurity::events::asyncevent_e_encoder enc;
+    enc.set_tid(1);
+    std::string msg = container_id;
+    enc.set_name(ASYNC_EVENT_NAME_NOT_FOUND);
+    enc.set_data((void *)msg.c_str(), msg.size() + 1);
+
+    enc.encode(s_async_handler[ASYNC_HANDLER_GO_WORKER]->writer());
+    s_async_handler[ASYNC_HANDLER_GO_WORKER]->push();
+}
+
+// Go-worker severities map 1:1 to ss_plugin_log_severity values
+static inline void log_go_worker(const char *msg, uint8_t sev)
+{
+    s_go_worker_logger.log(
+            msg,
+            static_cast<falcosecurity::_internal::ss_plugin_log_severity>(sev));
+}
+
+// Called by the go-worker once all pre-existing containers of an engine
+// have been sent through generate_async_event()
+static inline void on_go_worker_synced(const char *engine)
+{
+    s_go_worker_synced_engines++;
+    s_go_worker_logger.log(
+            fmt::format("go-worker: initial sync of {} completed", engine),
+            falcosecurity::_internal::SS_PLUGIN_LOG_SEV_INFO);
+}
@@ -53,7 +53,9 @@ bool my_plugin::parse_async_event(const falcosecurity::parse_event_input& in)
     falcosecurity::events::asyncevent_e_decoder ad(evt);
     bool added = std::strcmp(ad.get_name(), ASYNC_EVENT_NAME_ADDED) == 0;
     bool removed = std::strcmp(ad.get_name(), ASYNC_EVENT_NAME_REMOVED) == 0;
-    if(!added && !removed)
+    bool not_found =
+            std::strcmp(ad.get_name(), ASYNC_EVENT_NAME_NOT_FOUND) == 0;
+    if(!added && !removed && !not_found)
     {
         // We are not interested in parsing async events that are not
         // generated by our plugin.
@@ -71,6 +73,16 @@ bool my_plugin::parse_async_event(const falcosecurity::parse_event_input& in)
                      falcosecurity::_internal::SS_PLUGIN_LOG_SEV_ERROR);
         return false;
     }
+    if(not_found)
+    {
+        // Stop tracking the request; the container will be added anyway
+        // if any engine sends it later.
+        m_logger.log(fmt::format("Container not found: {}",
+                                 json_charbuf_pointer),
+                     falcosecurity::_internal::SS_PLUGIN_LOG_SEV_DEBUG);
+        m_asked_containers.erase(json_charbuf_pointer);
+        return true;
+    }
     auto json_event = nlohmann::json::parse(json_charbuf_pointer);
     auto cinfo = json_event.get<std::shared_ptr<container_info>>();
     if(added)
@@ -151,6 +151,7 @@ class container_info
     std::string m_pod_sandbox_cniresult;
     bool m_is_pod_sandbox;
     std::string m_container_user; // TODO: to be exposed by state API
+    std::string m_containerd_namespace; // containerd only
 
     /**
      * The time at which the container was created (IN SECONDS), cast from a
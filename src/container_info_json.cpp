@@ -123,6 +123,7 @@ void from_json(const nlohmann::json& j, std::shared_ptr<container_info>& cinfo)
                      info->m_pod_sandbox_labels);
     object_from_json(container, "port_mappings", info->m_port_mappings);
     object_from_json(container, "Mounts", info->m_mounts);
+    info->m_containerd_namespace = container.value("namespace", "");
 
     for(int probe_type = container_health_probe::PT_HEALTHCHECK;
         probe_type <= container_health_probe::PT_READINESS_PROBE; probe_type++)
@@ -200,6 +201,7 @@ void to_json(nlohmann::json& j,
     j["pod_sandbox_labels"] = cinfo->m_pod_sandbox_labels;
     j["port_mappings"] = cinfo->m_port_mappings;
     j["Mounts"] = cinfo->m_mounts;
+    j["namespace"] = cinfo->m_containerd_namespace;
 
     for(auto& probe : cinfo->m_health_probes)
     {
@@ -29,9 +29,14 @@ limitations under the License.
 #define ASYNC_EVENT_NAME_REMOVED                                               \
     "container_removed" // the removed event is a whole new event and is only
                         // generated for listeners engines (by the go-worker).
+#define ASYNC_EVENT_NAME_NOT_FOUND                                             \
+    "container_not_found" // generated by the go-worker once no engine found a
+                          // container asked through AskForContainerInfo(); its
+                          // payload is just the container id.
 #define ASYNC_EVENT_NAMES                                                      \
     {                                                                          \
-        ASYNC_EVENT_NAME_ADDED, ASYNC_EVENT_NAME_REMOVED                       \
+        ASYNC_EVENT_NAME_ADDED, ASYNC_EVENT_NAME_REMOVED,                      \
+                ASYNC_EVENT_NAME_NOT_FOUND                                     \
     }
 #define ASYNC_EVENT_SOURCES                                                    \
     {                                                                          \
@@ -79,6 +84,7 @@ limitations under the License.
 #define CONTAINER_ID_FIELD_NAME "container_id"
 #define PIDNS_INIT_START_TS_FIELD_NAME "pidns_init_start_ts"
 #define CATEGORY_FIELD_NAME "category"
+#define PID_FIELD_NAME "pid"
 #define VPID_FIELD_NAME "vpid"
 #define PTID_FIELD_NAME "ptid"
 
@@ -87,6 +93,17 @@ limitations under the License.
 /////////////////////////
 #define METRIC_N_CONTAINERS "n_containers"
 #define METRIC_N_MISSING "n_missing_container_images"
+// Go-worker metrics, aggregated over all engines; see GetWorkerStats()
+#define METRIC_N_WORKER_EVENTS "n_worker_events_received"
+#define METRIC_N_WORKER_INSPECT_FAILURES "n_worker_inspect_failures"
+#define METRIC_N_WORKER_FALLBACKS "n_worker_minimal_info_fallbacks"
+#define METRIC_N_WORKER_CONNECTED "n_worker_engines_connected"
+#define METRIC_N_FETCHER_REQUESTS "n_fetcher_requests"
+#define METRIC_N_FETCHER_MISSES "n_fetcher_misses"
+#define METRIC_N_WORKER_SYNCED "n_worker_engines_synced"
+#define METRIC_N_WORKER_PANICS "n_worker_panics_recovered"
+#define METRIC_N_WORKER_DISABLED "n_worker_engines_disabled"
+#define METRIC_N_FETCHER_DROPPED "n_fetcher_requests_dropped"
 
 /////////////////////////
 // Generic plugin consts
@@ -5,4 +5,5 @@
 class containerd : public cgroup_matcher
 {
     bool resolve(const std::string& cgroup, std::string& container_id) override;
+    container_type get_type() const override { return CT_CONTAINERD; }
 };
@@ -59,12 +59,22 @@ matcher_manager::matcher_manager(const Engines& cfg)
 bool matcher_manager::match_cgroup(const std::string& cgroup,
                                    std::string& container_id,
                                    std::shared_ptr<container_info>& ctr)
+{
+    container_type type;
+    return match_cgroup(cgroup, container_id, ctr, type);
+}
+
+bool matcher_manager::match_cgroup(const std::string& cgroup,
+                                   std::string& container_id,
+                                   std::shared_ptr<container_info>& ctr,
+                                   container_type& type)
 {
     for(const auto& matcher : m_matchers)
     {
         if(matcher->resolve(cgroup, container_id))
         {
             ctr = matcher->to_container(container_id);
+            type = matcher->get_type();
             return true;
         }
     }
@@ -19,6 +19,10 @@ class cgroup_matcher
     {
         return nullptr;
     }
+
+    /// Type of the containers matched, passed as hint to the go-worker
+    /// when asking for their metadata.
+    virtual container_type get_type() const { return CT_UNKNOWN; }
 };
 
 class matcher_manager
@@ -28,6 +32,10 @@ class matcher_manager
 
     bool match_cgroup(const std::string& cgroup, std::string& container_id,
                       std::shared_ptr<container_info>& ctr);
+    // Same as above, also returning the type of the matching engine
+    bool match_cgroup(const std::string& cgroup, std::string& container_id,
+                      std::shared_ptr<container_info>& ctr,
+                      container_type& type);
 
     private:
     std::list<std::shared_ptr<cgroup_matcher>> m_matchers;
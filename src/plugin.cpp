@@ -103,6 +103,9 @@ bool my_plugin::init(falcosecurity::init_input& in)
         // entry
         m_threads_field_vpid = m_threads_table.get_field(
                 t.fields(), VPID_FIELD_NAME, st::SS_PLUGIN_ST_INT64);
+        // pid is passed to the go-worker when asking for container metadata
+        m_threads_field_pid = m_threads_table.get_field(
+                t.fields(), PID_FIELD_NAME, st::SS_PLUGIN_ST_INT64);
         m_threads_field_ptid = m_threads_table.get_field(
                 t.fields(), PTID_FIELD_NAME, st::SS_PLUGIN_ST_INT64);
 
@@ -157,11 +160,39 @@ bool my_plugin::init(falcosecurity::init_input& in)
     n_missing.set_value(0);
     m_metrics.push_back(n_missing);
 
+#ifdef _HAS_ASYNC
+    // Go-worker metrics, refreshed by get_metrics()
+    auto add_worker_metric = [this](const char* name)
+    {
+        falcosecurity::metric m(name);
+        m.set_value(0);
+        m_metrics.push_back(m);
+        return m_metrics.size() - 1;
+    };
+    m_worker_metrics.events = add_worker_metric(METRIC_N_WORKER_EVENTS);
+    m_worker_metrics.inspect_failures =
+            add_worker_metric(METRIC_N_WORKER_INSPECT_FAILURES);
+    m_worker_metrics.fallbacks = add_worker_metric(METRIC_N_WORKER_FALLBACKS);
+    m_worker_metrics.connected = add_worker_metric(METRIC_N_WORKER_CONNECTED);
+    m_worker_metrics.fetcher_requests =
+            add_worker_metric(METRIC_N_FETCHER_REQUESTS);
+    m_worker_metrics.fetcher_misses =
+            add_worker_metric(METRIC_N_FETCHER_MISSES);
+    m_worker_metrics.synced = add_worker_metric(METRIC_N_WORKER_SYNCED);
+    m_worker_metrics.panics = add_worker_metric(METRIC_N_WORKER_PANICS);
+    m_worker_metrics.disabled = add_worker_metric(METRIC_N_WORKER_DISABLED);
+    m_worker_metrics.fetcher_dropped =
+            add_worker_metric(METRIC_N_FETCHER_DROPPED);
+#endif
+
     return true;
 }
 
 const std::vector<falcosecurity::metric>& my_plugin::get_metrics()
 {
+#ifdef _HAS_ASYNC
+    update_worker_metrics();
+#endif
     return m_metrics;
 }
 
@@ -172,7 +203,8 @@ FALCOSECURITY_PLUGIN(my_plugin);
 std::string my_plugin::compute_container_id_for_thread(
         const falcosecurity::table_entry& thread_entry,
         const falcosecurity::table_reader& tr,
-        std::shared_ptr<container_info>& info)
+        std::shared_ptr<container_info>& info, container_type& type,
+        std::string& cgroup)
 {
     // retrieve tid cgroups, compute container_id and store it.
     std::string container_id;
@@ -188,11 +220,10 @@ std::string my_plugin::compute_container_id_for_thread(
             {
                 // read the "second" field (aka: the cgroup path)
                 // from the current entry of the cgroups table
-                std::string cgroup;
                 m_cgroups_field_second.read_value(tr, e, cgroup);
                 if(!cgroup.empty())
                 {
-                    m_mgr->match_cgroup(cgroup, container_id, info);
+                    m_mgr->match_cgroup(cgroup, container_id, info, type);
                     if(!container_id.empty())
                     {
                         m_logger.log(fmt::format("Matched container_id: {} "
@@ -337,7 +368,10 @@ void my_plugin::on_new_process(const falcosecurity::table_entry& thread_entry,
                                const falcosecurity::table_writer& tw)
 {
     std::shared_ptr<container_info> info = nullptr;
-    auto container_id = compute_container_id_for_thread(thread_entry, tr, info);
+    container_type type = CT_UNKNOWN;
+    std::string cgroup;
+    auto container_id = compute_container_id_for_thread(thread_entry, tr, info,
+                                                        type, cgroup);
     m_container_id_field.write_value(tw, thread_entry, container_id);
 
     if(info != nullptr)
@@ -376,8 +410,12 @@ void my_plugin::on_new_process(const falcosecurity::table_entry& thread_entry,
                m_asked_containers.end())
             {
                 m_asked_containers.insert(container_id);
-                // Implemented by GO worker.go
-                AskForContainerInfo(container_id.c_str());
+                int64_t pid = 0;
+                m_threads_field_pid.read_value(tr, thread_entry, pid);
+                // Implemented by GO worker_api.go; the matched type lets
+                // the go-worker ask the right engine first.
+                AskForContainerInfoHint(m_async_ctx, container_id.c_str(),
+                                        type, cgroup.c_str(), pid);
             }
 #endif
         }
@@ -56,6 +56,9 @@ class my_plugin
     // Async capability
     //////////////////////////
 
+    // Refreshes go-worker metrics through GetWorkerStats()
+    void update_worker_metrics();
+
     std::vector<std::string> get_async_events();
     std::vector<std::string> get_async_event_sources();
     bool start_async_events(
@@ -108,7 +111,8 @@ class my_plugin
     std::string compute_container_id_for_thread(
             const falcosecurity::table_entry& thread_entry,
             const falcosecurity::table_reader& tr,
-            std::shared_ptr<container_info>& info);
+            std::shared_ptr<container_info>& info, container_type& type,
+            std::string& cgroup);
     void
     write_thread_category(const std::shared_ptr<const container_info>& cinfo,
                           const falcosecurity::table_entry& thread_entry,
@@ -127,8 +131,26 @@ class my_plugin
     // Cache being asked containers to go-worker through AskForContainerInfo()
     // API. Avoids repeatedly calling the API.
     std::unordered_set<std::string> m_asked_containers;
+    // Handle of the go-worker instance, as returned by StartWorker()
+    void* m_async_ctx = nullptr;
 
     std::vector<falcosecurity::metric> m_metrics;
+#ifdef _HAS_ASYNC
+    // Indexes in m_metrics of the go-worker metrics, captured when created
+    struct
+    {
+        size_t events;
+        size_t inspect_failures;
+        size_t fallbacks;
+        size_t connected;
+        size_t fetcher_requests;
+        size_t fetcher_misses;
+        size_t synced;
+        size_t panics;
+        size_t disabled;
+        size_t fetcher_dropped;
+    } m_worker_metrics;
+#endif
 
     PluginConfig m_cfg;
 
@@ -144,6 +166,8 @@ class my_plugin
     falcosecurity::table_field m_threads_field_pidns_init_start_ts;
     // Accessors to the thread table "category" field
     falcosecurity::table_field m_threads_field_category;
+    // Accessors to the thread table "pid" field
+    falcosecurity::table_field m_threads_field_pid;
     // Accessors to the thread table "vpid" field
     falcosecurity::table_field m_threads_field_vpid;
     // Accessors to the thread table "ptid" field
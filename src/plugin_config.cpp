@@ -14,10 +14,32 @@ void from_json(const nlohmann::json& j, SimpleEngine& engine)
     engine.enabled = j.value("enabled", true);
 }
 
+void from_json(const nlohmann::json& j, TLS& tls)
+{
+    tls.ca_file = j.value("ca_file", "");
+    tls.cert_file = j.value("cert_file", "");
+    tls.key_file = j.value("key_file", "");
+    tls.server_name = j.value("server_name", "");
+}
+
+void from_json(const nlohmann::json& j, Namespaces& namespaces)
+{
+    namespaces.allow = j.value("allow", std::vector<std::string>{});
+    namespaces.deny = j.value("deny", std::vector<std::string>{});
+}
+
 void from_json(const nlohmann::json& j, SocketsEngine& engine)
 {
     engine.enabled = j.value("enabled", true);
     engine.sockets = j.value("sockets", std::vector<std::string>{});
+    engine.connect_timeout_ms =
+            j.value("connect_timeout_ms", DEFAULT_CONNECT_TIMEOUT_MS);
+    engine.request_timeout_ms =
+            j.value("request_timeout_ms", DEFAULT_REQUEST_TIMEOUT_MS);
+    engine.list_timeout_ms = j.value("list_timeout_ms", DEFAULT_LIST_TIMEOUT_MS);
+    engine.tls = j.value("tls", TLS{});
+    engine.namespaces =
+            j.value("namespaces", std::map<std::string, Namespaces>{});
 }
 
 void from_json(const nlohmann::json& j, Engines& engines)
@@ -30,13 +52,76 @@ void from_json(const nlohmann::json& j, Engines& engines)
     engines.docker = j.value("docker", SocketsEngine{});
     engines.podman = j.value("podman", SocketsEngine{});
     engines.cri = j.value("cri", SocketsEngine{});
+    // Opt-in: cri gets more infos about CRI-O containers.
+    SocketsEngine crio;
+    crio.enabled = false;
+    engines.crio = j.value("crio", crio);
     engines.containerd = j.value("containerd", SocketsEngine{});
 }
 
+void from_json(const nlohmann::json& j, Fetcher& fetcher)
+{
+    fetcher.queue_size = j.value("queue_size", DEFAULT_FETCHER_QUEUE_SIZE);
+    fetcher.overflow_policy =
+            j.value("overflow_policy", DEFAULT_FETCHER_OVERFLOW_POLICY);
+    fetcher.retry_schedule_ms = j.value(
+            "retry_schedule_ms", std::vector<int>DEFAULT_FETCHER_RETRY_SCHEDULE_MS);
+}
+
+void from_json(const nlohmann::json& j, Labels& labels)
+{
+    using patterns = std::vector<std::string>;
+    labels.include = j.value("include", patterns{});
+    labels.exclude = j.value("exclude", patterns{});
+    labels.pod_sandbox_include = j.value("pod_sandbox_include", patterns{});
+    labels.pod_sandbox_exclude = j.value("pod_sandbox_exclude", patterns{});
+    labels.key_max_len =
+            j.value("key_max_len", std::map<std::string, int>{});
+    labels.truncate = j.value("truncate", false);
+    labels.truncate_marker =
+            j.value("truncate_marker", DEFAULT_LABELS_TRUNCATE_MARKER);
+}
+
+void from_json(const nlohmann::json& j, Env& env)
+{
+    using patterns = std::vector<std::string>;
+    env.drop = j.value("drop", false);
+    env.allow = j.value("allow", patterns{});
+    env.redact = j.value("redact", patterns{});
+    env.redact_mode = j.value("redact_mode", DEFAULT_ENV_REDACT_MODE);
+    env.max_entries = j.value("max_entries", 0);
+}
+
+void from_json(const nlohmann::json& j, FilterRule& rule)
+{
+    using strings = std::vector<std::string>;
+    rule.engines = j.value("engines", strings{});
+    rule.containerd_namespaces = j.value("containerd_namespaces", strings{});
+    rule.k8s_namespaces = j.value("k8s_namespaces", strings{});
+    rule.image_repos = j.value("image_repos", strings{});
+    rule.labels = j.value("labels", "");
+    if(j.contains("pod_sandbox"))
+    {
+        rule.pod_sandbox = j.at("pod_sandbox").get<bool>();
+    }
+}
+
+void from_json(const nlohmann::json& j, Filters& filters)
+{
+    filters.include = j.value("include", std::vector<FilterRule>{});
+    filters.exclude = j.value("exclude", std::vector<FilterRule>{});
+}
+
 void from_json(const nlohmann::json& j, PluginConfig& cfg)
 {
     cfg.label_max_len = j.value("label_max_len", DEFAULT_LABEL_MAX_LEN);
     cfg.with_size = j.value("with_size", false);
+    cfg.resync_interval =
+            j.value("resync_interval", DEFAULT_RESYNC_INTERVAL);
+    cfg.fetcher = j.value("fetcher", Fetcher{});
+    cfg.labels = j.value("labels", Labels{});
+    cfg.env = j.value("env", Env{});
+    cfg.filters = j.value("filters", Filters{});
     cfg.engines = j.value("engines", Engines{});
 
     // Set default sockets if emtpy
@@ -81,6 +166,10 @@ void from_json(const nlohmann::json& j, PluginConfig& cfg)
         cfg.engines.cri.sockets.emplace_back(
                 "/run/host-containerd/containerd.sock");
     }
+    if(cfg.engines.crio.sockets.empty())
+    {
+        cfg.engines.crio.sockets.emplace_back("/run/crio/crio.sock");
+    }
     if(cfg.engines.containerd.sockets.empty())
     {
         cfg.engines.containerd.sockets.emplace_back(
@@ -89,26 +178,134 @@ void from_json(const nlohmann::json& j, PluginConfig& cfg)
     }
 }
 
+void to_json(nlohmann::json& j, const TLS& tls)
+{
+    // Only set fields are sent, since the go-worker rejects empty ones
+    j = nlohmann::json::object();
+    if(!tls.ca_file.empty())
+    {
+        j["ca_file"] = tls.ca_file;
+    }
+    if(!tls.cert_file.empty())
+    {
+        j["cert_file"] = tls.cert_file;
+    }
+    if(!tls.key_file.empty())
+    {
+        j["key_file"] = tls.key_file;
+    }
+    if(!tls.server_name.empty())
+    {
+        j["server_name"] = tls.server_name;
+    }
+}
+
+void to_json(nlohmann::json& j, const SocketsEngine& engine)
+{
+    j = nlohmann::json{{"enabled", engine.enabled},
+                       {"sockets", engine.sockets},
+                       {"connect_timeout_ms", engine.connect_timeout_ms},
+                       {"request_timeout_ms", engine.request_timeout_ms},
+                       {"list_timeout_ms", engine.list_timeout_ms}};
+    if(!engine.tls.empty())
+    {
+        j["tls"] = engine.tls;
+    }
+    // Only sent if set, since the go-worker rejects them for engines other
+    // than containerd
+    if(!engine.namespaces.empty())
+    {
+        j["namespaces"] = engine.namespaces;
+    }
+}
+
+void to_json(nlohmann::json& j, const Namespaces& namespaces)
+{
+    j = nlohmann::json{{"allow", namespaces.allow},
+                       {"deny", namespaces.deny}};
+}
+
 void to_json(nlohmann::json& j, const Engines& engines)
 {
-    j = nlohmann::json{{"docker",
-                        {{"enabled", engines.docker.enabled},
-                         {"sockets", engines.docker.sockets}}},
-                       {"podman",
-                        {{"enabled", engines.podman.enabled},
-                         {"sockets", engines.podman.sockets}}},
-                       {"cri",
-                        {{"enabled", engines.cri.enabled},
-                         {"sockets", engines.cri.sockets}}},
-                       {"containerd",
-                        {{"enabled", engines.containerd.enabled},
-                         {"sockets", engines.containerd.sockets}}}};
+    j = nlohmann::json{{"docker", engines.docker},
+                       {"podman", engines.podman},
+                       {"cri", engines.cri},
+                       {"crio", engines.crio},
+                       {"containerd", engines.containerd}};
+}
+
+void to_json(nlohmann::json& j, const Fetcher& fetcher)
+{
+    j = nlohmann::json{{"queue_size", fetcher.queue_size},
+                       {"overflow_policy", fetcher.overflow_policy},
+                       {"retry_schedule_ms", fetcher.retry_schedule_ms}};
+}
+
+void to_json(nlohmann::json& j, const Labels& labels)
+{
+    j = nlohmann::json{{"include", labels.include},
+                       {"exclude", labels.exclude},
+                       {"pod_sandbox_include", labels.pod_sandbox_include},
+                       {"pod_sandbox_exclude", labels.pod_sandbox_exclude},
+                       {"key_max_len", labels.key_max_len},
+                       {"truncate", labels.truncate},
+                       {"truncate_marker", labels.truncate_marker}};
+}
+
+void to_json(nlohmann::json& j, const Env& env)
+{
+    j = nlohmann::json{{"drop", env.drop},
+                       {"allow", env.allow},
+                       {"redact", env.redact},
+                       {"redact_mode", env.redact_mode},
+                       {"max_entries", env.max_entries}};
+}
+
+void to_json(nlohmann::json& j, const FilterRule& rule)
+{
+    // Only set fields are sent, since the go-worker rejects an empty selector
+    j = nlohmann::json::object();
+    if(!rule.engines.empty())
+    {
+        j["engines"] = rule.engines;
+    }
+    if(!rule.containerd_namespaces.empty())
+    {
+        j["containerd_namespaces"] = rule.containerd_namespaces;
+    }
+    if(!rule.k8s_namespaces.empty())
+    {
+        j["k8s_namespaces"] = rule.k8s_namespaces;
+    }
+    if(!rule.image_repos.empty())
+    {
+        j["image_repos"] = rule.image_repos;
+    }
+    if(!rule.labels.empty())
+    {
+        j["labels"] = rule.labels;
+    }
+    if(rule.pod_sandbox.has_value())
+    {
+        j["pod_sandbox"] = *rule.pod_sandbox;
+    }
+}
+
+void to_json(nlohmann::json& j, const Filters& filters)
+{
+    j = nlohmann::json{{"include", filters.include},
+                       {"exclude", filters.exclude}};
 }
 
 void to_json(nlohmann::json& j, const PluginConfig& cfg)
 {
     j["label_max_len"] = cfg.label_max_len;
     j["with_size"] = cfg.with_size;
+    j["resync_interval"] = cfg.resync_interval;
     j["host_root"] = cfg.host_root;
+    j["fetcher"] = cfg.fetcher;
+    j["labels"] = cfg.labels;
+    j["env"] = cfg.env;
+    j["filters"] = cfg.filters;
     j["engines"] = cfg.engines;
 }
@@ -1,10 +1,21 @@
 #pragma once
 
+#include <map>
+#include <optional>
 #include <nlohmann/json.hpp>
 #include <fmt/core.h>
 #include <falcosecurity/sdk.h>
 
 #define DEFAULT_LABEL_MAX_LEN 100
+#define DEFAULT_RESYNC_INTERVAL 0
+#define DEFAULT_CONNECT_TIMEOUT_MS 10000
+#define DEFAULT_REQUEST_TIMEOUT_MS 5000
+#define DEFAULT_LIST_TIMEOUT_MS 60000
+#define DEFAULT_FETCHER_QUEUE_SIZE 1024
+#define DEFAULT_FETCHER_OVERFLOW_POLICY "drop_oldest"
+#define DEFAULT_FETCHER_RETRY_SCHEDULE_MS {100, 500, 2000, 5000}
+#define DEFAULT_LABELS_TRUNCATE_MARKER "..."
+#define DEFAULT_ENV_REDACT_MODE "mask"
 
 struct SimpleEngine
 {
@@ -13,18 +24,61 @@ struct SimpleEngine
     SimpleEngine() { enabled = true; }
 };
 
+// TLS client configuration for tcp:// sockets; empty fields are unset.
+struct TLS
+{
+    std::string ca_file;
+    std::string cert_file;
+    std::string key_file;
+    std::string server_name;
+
+    bool empty() const
+    {
+        return ca_file.empty() && cert_file.empty() && key_file.empty() &&
+               server_name.empty();
+    }
+};
+
+// Containerd namespaces watched on a socket; patterns are globs,
+// or regular expressions if prefixed by "re:"
+struct Namespaces
+{
+    std::vector<std::string> allow;
+    std::vector<std::string> deny;
+};
+
 struct SocketsEngine
 {
     bool enabled;
     std::vector<std::string> sockets;
+    int connect_timeout_ms;
+    int request_timeout_ms;
+    int list_timeout_ms;
+    TLS tls;
+    // Keyed by socket, or "*" for all sockets; containerd only
+    std::map<std::string, Namespaces> namespaces;
 
-    SocketsEngine() { enabled = true; }
+    SocketsEngine()
+    {
+        enabled = true;
+        connect_timeout_ms = DEFAULT_CONNECT_TIMEOUT_MS;
+        request_timeout_ms = DEFAULT_REQUEST_TIMEOUT_MS;
+        list_timeout_ms = DEFAULT_LIST_TIMEOUT_MS;
+    }
 
     void log_sockets(falcosecurity::logger& logger,
                      const std::string& host_root) const
     {
         for(const auto& socket : sockets)
         {
+            // Remote endpoints are not below the host root
+            if(socket.rfind("tcp://", 0) == 0)
+            {
+                logger.log(fmt::format(
+                        "* enabled container runtime endpoint at '{}'",
+                        socket));
+                continue;
+            }
             logger.log(fmt::format("* enabled container runtime socket at '{}'",
                                    host_root + socket));
         }
@@ -41,6 +95,82 @@ struct StaticEngine
     StaticEngine() { enabled = false; }
 };
 
+struct Fetcher
+{
+    int queue_size;
+    // Either "drop_oldest" or "drop_newest"
+    std::string overflow_policy;
+    // Delays before looking up again a container not found; empty to disable
+    std::vector<int> retry_schedule_ms;
+
+    Fetcher()
+    {
+        queue_size = DEFAULT_FETCHER_QUEUE_SIZE;
+        overflow_policy = DEFAULT_FETCHER_OVERFLOW_POLICY;
+        retry_schedule_ms = DEFAULT_FETCHER_RETRY_SCHEDULE_MS;
+    }
+};
+
+// Label patterns are globs, or regular expressions if prefixed by "re:"
+struct Labels
+{
+    std::vector<std::string> include;
+    std::vector<std::string> exclude;
+    std::vector<std::string> pod_sandbox_include;
+    std::vector<std::string> pod_sandbox_exclude;
+    // Overrides label_max_len for the given keys
+    std::map<std::string, int> key_max_len;
+    bool truncate;
+    std::string truncate_marker;
+
+    Labels()
+    {
+        truncate = false;
+        truncate_marker = DEFAULT_LABELS_TRUNCATE_MARKER;
+    }
+};
+
+// Env patterns match variable names, as globs ignoring case,
+// or regular expressions if prefixed by "re:"
+struct Env
+{
+    bool drop;
+    std::vector<std::string> allow;
+    std::vector<std::string> redact;
+    // Either "mask" or "hash"
+    std::string redact_mode;
+    // 0 means unlimited
+    int max_entries;
+
+    Env()
+    {
+        drop = false;
+        redact_mode = DEFAULT_ENV_REDACT_MODE;
+        max_entries = 0;
+    }
+};
+
+// A filter rule matches a container if all of its set fields match
+struct FilterRule
+{
+    std::vector<std::string> engines;
+    std::vector<std::string> containerd_namespaces;
+    std::vector<std::string> k8s_namespaces;
+    // Globs, or regular expressions if prefixed by "re:"
+    std::vector<std::string> image_repos;
+    // Label selector, eg: "app=nginx,tier!=db,!ci"
+    std::string labels;
+    std::optional<bool> pod_sandbox;
+};
+
+// Containers are announced if they match any include rule,
+// or include is empty, and no exclude rule
+struct Filters
+{
+    std::vector<FilterRule> include;
+    std::vector<FilterRule> exclude;
+};
+
 struct Engines
 {
     SimpleEngine bpm;
@@ -49,6 +179,7 @@ struct Engines
     SocketsEngine docker;
     SocketsEngine podman;
     SocketsEngine cri;
+    SocketsEngine crio;
     SocketsEngine containerd;
     StaticEngine static_ctr;
 };
@@ -57,13 +188,19 @@ struct PluginConfig
 {
     int label_max_len;
     bool with_size;
+    int resync_interval;
     std::string host_root;
+    Fetcher fetcher;
+    Labels labels;
+    Env env;
+    Filters filters;
     Engines engines;
 
     PluginConfig()
     {
         label_max_len = DEFAULT_LABEL_MAX_LEN;
         with_size = false;
+        resync_interval = DEFAULT_RESYNC_INTERVAL;
         if(const char* hroot = std::getenv("HOST_ROOT"))
         {
             host_root = hroot;
@@ -98,6 +235,11 @@ struct PluginConfig
             logger.log("Enabled 'cri' container engine.");
             engines.cri.log_sockets(logger, host_root);
         }
+        if(engines.crio.enabled)
+        {
+            logger.log("Enabled 'crio' container engine.");
+            engines.crio.log_sockets(logger, host_root);
+        }
         if(engines.containerd.enabled)
         {
             logger.log("Enabled 'containerd' container engine.");
@@ -124,11 +266,26 @@ struct PluginConfig
 // plugin config json string to a structure.
 void from_json(const nlohmann::json& j, StaticEngine& engine);
 void from_json(const nlohmann::json& j, SimpleEngine& engine);
+void from_json(const nlohmann::json& j, TLS& tls);
+void from_json(const nlohmann::json& j, Namespaces& namespaces);
 void from_json(const nlohmann::json& j, SocketsEngine& engine);
 void from_json(const nlohmann::json& j, Engines& engines);
+void from_json(const nlohmann::json& j, Fetcher& fetcher);
+void from_json(const nlohmann::json& j, Labels& labels);
+void from_json(const nlohmann::json& j, Env& env);
+void from_json(const nlohmann::json& j, FilterRule& rule);
+void from_json(const nlohmann::json& j, Filters& filters);
 void from_json(const nlohmann::json& j, PluginConfig& cfg);
 
 // Build the json object to be passed to the go-worker as init config.
 // See go-worker/engine.go::cfg struct for the format
+void to_json(nlohmann::json& j, const TLS& tls);
+void to_json(nlohmann::json& j, const Namespaces& namespaces);
+void to_json(nlohmann::json& j, const SocketsEngine& engine);
 void to_json(nlohmann::json& j, const Engines& engines);
+void to_json(nlohmann::json& j, const Fetcher& fetcher);
+void to_json(nlohmann::json& j, const Labels& labels);
+void to_json(nlohmann::json& j, const Env& env);
+void to_json(nlohmann::json& j, const FilterRule& rule);
+void to_json(nlohmann::json& j, const Filters& filters);
 void to_json(nlohmann::json& j, const PluginConfig& cfg);
\ No newline at end of file
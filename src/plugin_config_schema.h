@@ -1,5 +1,7 @@
 #pragma once
 
+// Code generated by go-worker/pkg/config/schema_gen.go from schema.json; DO NOT EDIT.
+
 #define LONG_STRING_CONST(...) #__VA_ARGS__
 
 const char plugin_schema_string[] = LONG_STRING_CONST(
@@ -10,6 +12,7 @@ const char plugin_schema_string[] = LONG_STRING_CONST(
    "properties":{
       "label_max_len":{
          "type":"integer",
+         "minimum":0,
          "title":"Max label length",
          "description":"Labels exceeding this limit won't be reported."
       },
@@ -18,6 +21,32 @@ const char plugin_schema_string[] = LONG_STRING_CONST(
          "title":"Inspect containers with size",
          "description":"Inspect containers size where supported."
       },
+      "resync_interval":{
+         "type":"integer",
+         "minimum":0,
+         "title":"Resync interval",
+         "description":"Seconds between periodic resyncs of engines state, to recover lost events; 0 disables resync."
+      },
+      "labels":{
+         "$ref":"#/definitions/Labels",
+         "title":"Labels policy",
+         "description":"Selects the reported container and pod sandbox labels, and how values exceeding their max length are handled. Patterns are globs, or regular expressions if prefixed by 're:'."
+      },
+      "env":{
+         "$ref":"#/definitions/Env",
+         "title":"Env policy",
+         "description":"Selects the reported container env variables, and redacts the values of sensitive ones. Patterns match variable names, as globs ignoring case, or regular expressions if prefixed by 're:'."
+      },
+      "filters":{
+         "$ref":"#/definitions/Filters",
+         "title":"Containers filters",
+         "description":"Selects the containers announced by engines: a container is announced if it matches any include rule, or include is empty, and no exclude rule. Excluded containers can still be looked up on demand."
+      },
+      "fetcher":{
+         "$ref":"#/definitions/Fetcher",
+         "title":"On demand containers lookup",
+         "description":"Configures the queue of containers to be looked up on demand, eg: when seen before any engine event."
+      },
       "engines":{
          "$ref":"#/definitions/Engines",
          "title":"The plugin per-engine configuration",
@@ -25,6 +54,170 @@ const char plugin_schema_string[] = LONG_STRING_CONST(
       }
    },
    "definitions":{
+      "Labels":{
+         "type":"object",
+         "additionalProperties":false,
+         "properties":{
+            "include":{
+               "$ref":"#/definitions/patterns",
+               "description":"Container labels to be reported; all if empty."
+            },
+            "exclude":{
+               "$ref":"#/definitions/patterns",
+               "description":"Container labels not to be reported, even if included."
+            },
+            "pod_sandbox_include":{
+               "$ref":"#/definitions/patterns",
+               "description":"Pod sandbox labels to be reported; all if empty."
+            },
+            "pod_sandbox_exclude":{
+               "$ref":"#/definitions/patterns",
+               "description":"Pod sandbox labels not to be reported, even if included."
+            },
+            "key_max_len":{
+               "type":"object",
+               "additionalProperties":{
+                  "type":"integer",
+                  "minimum":0
+               },
+               "description":"Max value length of the given label keys, overriding label_max_len."
+            },
+            "truncate":{
+               "type":"boolean",
+               "description":"Truncate values exceeding their max length, rather than dropping them."
+            },
+            "truncate_marker":{
+               "type":"string",
+               "description":"Suffix of truncated values."
+            }
+         },
+         "title":"Labels"
+      },
+      "Env":{
+         "type":"object",
+         "additionalProperties":false,
+         "properties":{
+            "drop":{
+               "type":"boolean",
+               "description":"Do not report env at all."
+            },
+            "allow":{
+               "$ref":"#/definitions/patterns",
+               "description":"Variables to be reported; all if empty."
+            },
+            "redact":{
+               "$ref":"#/definitions/patterns",
+               "description":"Variables whose value is redacted, eg: '*_PASSWORD' or '*TOKEN*'."
+            },
+            "redact_mode":{
+               "type":"string",
+               "enum":["mask","hash"],
+               "description":"Redacted values are replaced with '<redacted>' (mask) or with their sha256 (hash)."
+            },
+            "max_entries":{
+               "type":"integer",
+               "minimum":0,
+               "description":"Max number of reported variables; 0 means unlimited."
+            }
+         },
+         "title":"Env"
+      },
+      "Filters":{
+         "type":"object",
+         "additionalProperties":false,
+         "properties":{
+            "include":{
+               "type":"array",
+               "items":{
+                  "$ref":"#/definitions/FilterRule"
+               },
+               "description":"Rules selecting the announced containers; all if empty."
+            },
+            "exclude":{
+               "type":"array",
+               "items":{
+                  "$ref":"#/definitions/FilterRule"
+               },
+               "description":"Rules selecting the containers not to be announced, even if included."
+            }
+         },
+         "title":"Filters"
+      },
+      "FilterRule":{
+         "type":"object",
+         "additionalProperties":false,
+         "properties":{
+            "engines":{
+               "type":"array",
+               "items":{
+                  "type":"string",
+                  "enum":["docker","podman","containerd","cri","crio"]
+               },
+               "description":"Engines of the container."
+            },
+            "containerd_namespaces":{
+               "type":"array",
+               "items":{
+                  "$ref":"#/definitions/nonEmptyString"
+               },
+               "description":"Containerd namespaces of the container, eg: 'k8s.io'."
+            },
+            "k8s_namespaces":{
+               "type":"array",
+               "items":{
+                  "$ref":"#/definitions/nonEmptyString"
+               },
+               "description":"Kubernetes namespaces of the container, from its io.kubernetes.pod.namespace label."
+            },
+            "image_repos":{
+               "$ref":"#/definitions/patterns",
+               "description":"Image repositories of the container, eg: 'docker.io/library/*'."
+            },
+            "labels":{
+               "$ref":"#/definitions/nonEmptyString",
+               "description":"Label selector of comma separated 'key=value', 'key!=value', 'key' and '!key' requirements, matched against reported labels."
+            },
+            "pod_sandbox":{
+               "type":"boolean",
+               "description":"Whether the container is a pod sandbox, ie: a pause container."
+            }
+         },
+         "description":"Matches a container if all of its set fields match.",
+         "title":"FilterRule"
+      },
+      "patterns":{
+         "type":"array",
+         "items":{
+            "$ref":"#/definitions/nonEmptyString"
+         }
+      },
+      "Fetcher":{
+         "type":"object",
+         "additionalProperties":false,
+         "properties":{
+            "queue_size":{
+               "type":"integer",
+               "minimum":1,
+               "title":"Queue size",
+               "description":"Max number of pending lookups."
+            },
+            "overflow_policy":{
+               "type":"string",
+               "enum":["drop_oldest","drop_newest"],
+               "title":"Overflow policy",
+               "description":"Lookup dropped when the queue is full."
+            },
+            "retry_schedule_ms":{
+               "type":"array",
+               "items":{
+                  "type":"integer",
+                  "minimum":0
+               },
+               "title":"Retry schedule",
+               "description":"Delays in milliseconds before looking up again a container not found by any engine, eg: since it is still being created; empty to disable retries."
+            }
+         }
+      },
       "Engines":{
          "type":"object",
          "additionalProperties":false,
@@ -41,6 +234,10 @@ const char plugin_schema_string[] = LONG_STRING_CONST(
             "cri":{
                "$ref":"#/definitions/SocketsContainer"
             },
+            "crio":{
+               "$ref":"#/definitions/SocketsContainer",
+               "description":"Looks up CRI-O containers on demand through the CRI-O HTTP API, when the other engines miss them. Disabled by default."
+            },
             "lxc":{
                "$ref":"#/definitions/SimpleContainer"
             },
@@ -94,6 +291,32 @@ const char plugin_schema_string[] = LONG_STRING_CONST(
                "items":{
                   "type":"string"
                }
+            },
+            "connect_timeout_ms":{
+               "type":"integer",
+               "minimum":1,
+               "description":"Max milliseconds to connect to the engine."
+            },
+            "request_timeout_ms":{
+               "type":"integer",
+               "minimum":1,
+               "description":"Max milliseconds for each single engine API call."
+            },
+            "list_timeout_ms":{
+               "type":"integer",
+               "minimum":1,
+               "description":"Max milliseconds to list all containers of the engine."
+            },
+            "tls":{
+               "$ref":"#/definitions/TLS",
+               "description":"TLS client configuration for tcp:// sockets; only supported by docker, podman tcp:// sockets are plain tcp only."
+            },
+            "namespaces":{
+               "type":"object",
+               "additionalProperties":{
+                  "$ref":"#/definitions/Namespaces"
+               },
+               "description":"Namespaces watched on each socket, keyed by socket, or '*' for all sockets without their own; only supported by containerd."
             }
          },
          "required":[
@@ -102,6 +325,44 @@ const char plugin_schema_string[] = LONG_STRING_CONST(
          ],
          "title":"SocketsContainer"
       },
+      "Namespaces":{
+         "type":"object",
+         "additionalProperties":false,
+         "properties":{
+            "allow":{
+               "$ref":"#/definitions/patterns",
+               "description":"Namespaces to be watched, eg: 'k8s.io'; all if empty."
+            },
+            "deny":{
+               "$ref":"#/definitions/patterns",
+               "description":"Namespaces not to be watched, even if allowed, eg: 'moby' or 'buildkit'."
+            }
+         },
+         "title":"Namespaces"
+      },
+      "TLS":{
+         "type":"object",
+         "additionalProperties":false,
+         "properties":{
+            "ca_file":{
+               "$ref":"#/definitions/nonEmptyString",
+               "description":"CA bundle verifying the engine certificate; system roots are used if unset."
+            },
+            "cert_file":{
+               "$ref":"#/definitions/nonEmptyString",
+               "description":"Client certificate, for mutual TLS; requires key_file."
+            },
+            "key_file":{
+               "$ref":"#/definitions/nonEmptyString",
+               "description":"Client certificate key, for mutual TLS; requires cert_file."
+            },
+            "server_name":{
+               "$ref":"#/definitions/nonEmptyString",
+               "description":"Name verified against the engine certificate; the socket host is used if unset."
+            }
+         },
+         "title":"TLS"
+      },
       "StaticContainer":{
          "type":"object",
          "additionalProperties":false,
@@ -133,4 +394,3 @@ const char plugin_schema_string[] = LONG_STRING_CONST(
 }
 
 ); // LONG_STRING_CONST macro
-
@@ -12,7 +12,12 @@ TEST(plugin_config, from_json)
       "enabled": true,
       "sockets": [
         "/run/containerd/containerd.sock"
-      ]
+      ],
+      "namespaces": {
+        "*": {
+          "deny": ["moby", "buildkit"]
+        }
+      }
     },
     "cri": {
       "enabled": true,
@@ -24,7 +29,13 @@ TEST(plugin_config, from_json)
       "enabled": true,
       "sockets": [
         "/var/run/docker.sock"
-      ]
+      ],
+      "connect_timeout_ms": 2000,
+      "request_timeout_ms": 1000,
+      "tls": {
+        "ca_file": "/etc/docker/certs/ca.pem",
+        "server_name": "docker.local"
+      }
     },
     "libvirt_lxc": {
       "enabled": false
@@ -38,7 +49,25 @@ TEST(plugin_config, from_json)
     }
   },
   "label_max_len": 120,
-  "with_size": true
+  "with_size": true,
+  "resync_interval": 30,
+  "fetcher": {
+    "queue_size": 64
+  },
+  "labels": {
+    "exclude": ["re:annotation\\..*"],
+    "truncate": true
+  },
+  "env": {
+    "redact": ["*_PASSWORD"],
+    "max_entries": 64
+  },
+  "filters": {
+    "exclude": [
+      {"pod_sandbox": true},
+      {"engines": ["docker"], "labels": "ci=true"}
+    ]
+  }
 })";
     auto config_json = nlohmann::json::parse(config);
 
@@ -54,6 +83,47 @@ TEST(plugin_config, from_json)
 
     EXPECT_TRUE(cfg.with_size);
     EXPECT_EQ(cfg.label_max_len, 120);
+    EXPECT_EQ(cfg.resync_interval, 30);
+    EXPECT_EQ(cfg.fetcher.queue_size, 64);
+    EXPECT_EQ(cfg.fetcher.overflow_policy,
+              DEFAULT_FETCHER_OVERFLOW_POLICY); // missing defaults
+    EXPECT_EQ(cfg.fetcher.retry_schedule_ms,
+              std::vector<int>DEFAULT_FETCHER_RETRY_SCHEDULE_MS);
+
+    EXPECT_EQ(cfg.engines.docker.connect_timeout_ms, 2000);
+    EXPECT_EQ(cfg.engines.docker.request_timeout_ms, 1000);
+    EXPECT_EQ(cfg.engines.docker.list_timeout_ms,
+              DEFAULT_LIST_TIMEOUT_MS); // missing defaults
+    EXPECT_EQ(cfg.engines.cri.connect_timeout_ms, DEFAULT_CONNECT_TIMEOUT_MS);
+    EXPECT_EQ(cfg.engines.docker.tls.ca_file, "/etc/docker/certs/ca.pem");
+    EXPECT_EQ(cfg.engines.docker.tls.server_name, "docker.local");
+    EXPECT_TRUE(cfg.engines.docker.tls.cert_file.empty());
+    EXPECT_TRUE(cfg.engines.cri.tls.empty());
+    EXPECT_TRUE(cfg.engines.containerd.namespaces["*"].allow.empty());
+    EXPECT_EQ(cfg.engines.containerd.namespaces["*"].deny,
+              (std::vector<std::string>{"moby", "buildkit"}));
+    EXPECT_TRUE(cfg.engines.docker.namespaces.empty());
+
+    EXPECT_TRUE(cfg.labels.include.empty());
+    EXPECT_EQ(cfg.labels.exclude,
+              std::vector<std::string>{"re:annotation\\..*"});
+    EXPECT_TRUE(cfg.labels.truncate);
+    EXPECT_EQ(cfg.labels.truncate_marker,
+              DEFAULT_LABELS_TRUNCATE_MARKER); // missing defaults
+
+    EXPECT_FALSE(cfg.env.drop);
+    EXPECT_EQ(cfg.env.redact, std::vector<std::string>{"*_PASSWORD"});
+    EXPECT_EQ(cfg.env.redact_mode,
+              DEFAULT_ENV_REDACT_MODE); // missing defaults
+    EXPECT_EQ(cfg.env.max_entries, 64);
+
+    EXPECT_TRUE(cfg.filters.include.empty());
+    ASSERT_EQ(cfg.filters.exclude.size(), 2);
+    EXPECT_EQ(cfg.filters.exclude[0].pod_sandbox, true);
+    EXPECT_FALSE(cfg.filters.exclude[1].pod_sandbox.has_value());
+    EXPECT_EQ(cfg.filters.exclude[1].engines,
+              std::vector<std::string>{"docker"});
+    EXPECT_EQ(cfg.filters.exclude[1].labels, "ci=true");
 }
 
 TEST(plugin_config, from_json_missing_engines)
@@ -69,6 +139,8 @@ TEST(plugin_config, from_json_missing_engines)
     EXPECT_TRUE(cfg.engines.docker.enabled);
     EXPECT_EQ(cfg.engines.docker.sockets[0],
               "/var/run/docker.sock"); // check that default sockets are added
+    EXPECT_FALSE(cfg.engines.crio.enabled); // opt-in
+    EXPECT_EQ(cfg.engines.crio.sockets[0], "/run/crio/crio.sock");
     EXPECT_TRUE(cfg.engines.containerd.enabled);
     EXPECT_TRUE(cfg.engines.lxc.enabled);
     EXPECT_TRUE(cfg.engines.podman.enabled);
@@ -104,45 +176,134 @@ TEST(plugin_config, to_json)
     std::string expected_config = R"({
   "engines": {
     "containerd": {
+      "connect_timeout_ms": 10000,
       "enabled": true,
+      "list_timeout_ms": 60000,
+      "namespaces": {
+        "/run/containerd/containerd.sock": {
+          "allow": [
+            "k8s.io"
+          ],
+          "deny": []
+        }
+      },
+      "request_timeout_ms": 5000,
       "sockets": [
         "/run/containerd/containerd.sock"
       ]
     },
     "cri": {
+      "connect_timeout_ms": 10000,
       "enabled": true,
+      "list_timeout_ms": 60000,
+      "request_timeout_ms": 5000,
       "sockets": [
         "/run/crio/crio.sock"
       ]
     },
+    "crio": {
+      "connect_timeout_ms": 10000,
+      "enabled": false,
+      "list_timeout_ms": 60000,
+      "request_timeout_ms": 5000,
+      "sockets": []
+    },
     "docker": {
+      "connect_timeout_ms": 10000,
       "enabled": true,
+      "list_timeout_ms": 60000,
+      "request_timeout_ms": 5000,
       "sockets": [
-        "/var/run/docker.sock"
-      ]
+        "/var/run/docker.sock",
+        "tcp://127.0.0.1:2376"
+      ],
+      "tls": {
+        "server_name": "docker.local"
+      }
     },
     "podman": {
+      "connect_timeout_ms": 10000,
       "enabled": false,
+      "list_timeout_ms": 60000,
+      "request_timeout_ms": 5000,
       "sockets": [
         "/run/podman/podman.sock",
         "/run/user/1000/podman/podman.sock"
       ]
     }
   },
+  "env": {
+    "allow": [],
+    "drop": false,
+    "max_entries": 0,
+    "redact": [
+      "*_PASSWORD",
+      "*TOKEN*"
+    ],
+    "redact_mode": "hash"
+  },
+  "fetcher": {
+    "overflow_policy": "drop_oldest",
+    "queue_size": 1024,
+    "retry_schedule_ms": [
+      100,
+      500,
+      2000,
+      5000
+    ]
+  },
+  "filters": {
+    "exclude": [
+      {
+        "image_repos": [
+          "localhost:5000/ci/*"
+        ]
+      }
+    ],
+    "include": [
+      {
+        "containerd_namespaces": [
+          "k8s.io"
+        ],
+        "pod_sandbox": false
+      }
+    ]
+  },
   "host_root": "",
   "label_max_len": 120,
+  "labels": {
+    "exclude": [],
+    "include": [
+      "app",
+      "io.kubernetes.pod.*"
+    ],
+    "key_max_len": {
+      "io.kubernetes.pod.name": 253
+    },
+    "pod_sandbox_exclude": [],
+    "pod_sandbox_include": [],
+    "truncate": true,
+    "truncate_marker": "..."
+  },
+  "resync_interval": 0,
   "with_size": true
 })";
     auto cfg = PluginConfig{};
     cfg.engines.cri.enabled = true;
     cfg.engines.cri.sockets.emplace_back("/run/crio/crio.sock");
 
+    cfg.engines.crio.enabled = false;
+
     cfg.engines.containerd.enabled = true;
     cfg.engines.containerd.sockets.emplace_back(
             "/run/containerd/containerd.sock");
+    cfg.engines.containerd.namespaces["/run/containerd/containerd.sock"]
+            .allow = {"k8s.io"};
 
     cfg.engines.docker.enabled = true;
     cfg.engines.docker.sockets.emplace_back("/var/run/docker.sock");
+    cfg.engines.docker.sockets.emplace_back("tcp://127.0.0.1:2376");
+    cfg.engines.docker.tls.server_name = "docker.local";
 
     cfg.engines.podman.enabled = false;
     cfg.engines.podman.sockets.emplace_back("/run/podman/podman.sock");
@@ -152,6 +313,21 @@ TEST(plugin_config, to_json)
     cfg.label_max_len = 120;
     cfg.with_size = true;
 
+    cfg.labels.include = {"app", "io.kubernetes.pod.*"};
+    cfg.labels.key_max_len["io.kubernetes.pod.name"] = 253;
+    cfg.labels.truncate = true;
+
+    cfg.env.redact = {"*_PASSWORD", "*TOKEN*"};
+    cfg.env.redact_mode = "hash";
+
+    FilterRule include;
+    include.containerd_namespaces = {"k8s.io"};
+    include.pod_sandbox = false;
+    cfg.filters.include.push_back(include);
+    FilterRule exclude;
+    exclude.image_repos = {"localhost:5000/ci/*"};
+    cfg.filters.exclude.push_back(exclude);
+
     nlohmann::json j(cfg);
     EXPECT_EQ(j.dump(2).c_str(), expected_config);
 }
\ No newline at end of file
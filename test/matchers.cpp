@@ -61,8 +61,10 @@ TEST_F(container_cgroup, docker_cgroupfs)
 
     std::string container_id;
     std::shared_ptr<container_info> info;
-    EXPECT_TRUE(m_mgr.match_cgroup(cgroup, container_id, info));
+    container_type type = CT_UNKNOWN;
+    EXPECT_TRUE(m_mgr.match_cgroup(cgroup, container_id, info, type));
     EXPECT_EQ(expected_container_id, container_id);
+    EXPECT_EQ(CT_DOCKER, type);
 }
 
 TEST_F(container_cgroup, docker_systemd)